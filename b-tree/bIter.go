@@ -0,0 +1,124 @@
+package b_tree
+
+// B-tree iterator, it keeps the path from the root to the current leaf.
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+}
+
+// find the closest position that is less or equal to the input key
+func (tree *BTree) SeekLE(key []byte) *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := nodeLookupLE(node, key, tree.compare)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	// the separators in the internal nodes can lead to a leaf whose
+	// first key is after the input key, the previous key is before it.
+	if iter.Valid() {
+		if cur, _ := iter.Deref(); tree.compare(cur, key) > 0 {
+			iter.Prev()
+		}
+	}
+	return iter
+}
+
+// find the first position that is greater or equal to the input key
+func (tree *BTree) Seek(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.Valid() {
+		cur, _ := iter.Deref()
+		if tree.compare(cur, key) == 0 {
+			return iter
+		}
+	}
+	iter.Next()
+	return iter
+}
+
+// the iterator is on a key. the dummy empty key is skipped.
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 {
+		return false
+	}
+	last := len(iter.path) - 1
+	if iter.pos[last] >= iter.path[last].nkeys() {
+		return false // past the last key
+	}
+	return len(iter.path[last].getKey(iter.pos[last])) > 0
+}
+
+// get the current KV pair
+func (iter *BIter) Deref() ([]byte, []byte) {
+	last := len(iter.path) - 1
+	node := iter.path[last]
+	return node.getKey(iter.pos[last]), node.getVal(iter.pos[last])
+}
+
+// moving forward
+func (iter *BIter) Next() {
+	if len(iter.path) > 0 {
+		iterNext(iter, len(iter.path)-1)
+	}
+}
+
+// moving backward
+func (iter *BIter) Prev() {
+	if len(iter.path) > 0 {
+		iterPrev(iter, len(iter.path)-1)
+	}
+}
+
+// move the position at a level, false if there is no more key.
+// at the ends the leaf position stays out of the range.
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level > 0 {
+		if !iterNext(iter, level-1) { // move to a sibling node
+			return false
+		}
+	} else {
+		last := len(iter.pos) - 1
+		iter.pos[last] = iter.path[last].nkeys() // past the last key
+		return false
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] >= iter.path[level].nkeys() {
+		iter.pos[level] = iter.path[level].nkeys() - 1 // back from the end
+		return true
+	}
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level > 0 {
+		if !iterPrev(iter, level-1) { // move to a sibling node
+			return false
+		}
+	} else {
+		return false // stay on the dummy key
+	}
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
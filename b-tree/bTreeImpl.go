@@ -1,7 +1,6 @@
 package b_tree
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
@@ -21,6 +20,45 @@ type BTree struct {
 	get func(uint64) BNode // dereference a pointer
 	new func(BNode) uint64 // allocate a new page
 	del func(uint64)       // deallocate a page
+	// optional data stored with each kid pointer
+	flags uint64
+	// the key order, nil for bytes.Compare
+	order *Comparator
+	// the last inserted key and whether the key being inserted is
+	// next to it, see splitHint
+	last []byte
+	dir  int
+	// a node is rebalanced on delete below this size in bytes,
+	// BTREE_PAGE_SIZE/4 if 0
+	minFill int
+}
+
+// the size below which a node is rebalanced with a sibling
+func (tree *BTree) fillMin() int {
+	if tree.minFill == 0 {
+		return BTREE_PAGE_SIZE / 4
+	}
+	return tree.minFill
+}
+
+const (
+	TREE_HASHES = 1 << 0 // the hash of each kid node, see merkle.go
+	TREE_PREFIX = 1 << 1 // prefix compression of the pages, see prefix.go
+	TREE_COUNTS = 1 << 2 // the number of keys under each kid, see count.go
+)
+
+// the value of an internal node entry that points to the kid node.
+// | count | hash |, each one only with its flag.
+func (tree *BTree) kidVal(kid BNode) []byte {
+	var val []byte
+	if tree.flags&TREE_COUNTS != 0 {
+		val = make([]byte, 8, 8+HASH_SIZE)
+		binary.LittleEndian.PutUint64(val, uint64(tree.nodeCount(kid)))
+	}
+	if tree.flags&TREE_HASHES != 0 {
+		val = append(val, nodeHash(kid)...)
+	}
+	return val
 }
 
 // page config
@@ -124,21 +162,20 @@ func (node BNode) nbytes() uint16 {
 }
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
-
-func nodeLookupLE(node BNode, key []byte) uint16 {
-	nkeys := node.nkeys()
-	found := uint16(0)
-
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+// the first key is never compared, it's a lower bound of the node.
+
+func nodeLookupLE(node BNode, key []byte, compare func([]byte, []byte) int) uint16 {
+	// binary search for the first key that is greater than the key
+	lo, hi := uint16(1), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if compare(node.getKey(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1
 }
 
 // add a new key to a leaf node
@@ -222,20 +259,27 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
 
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := BNode{data: make([]byte, int(node.nbytes())+BTREE_PAGE_SIZE)}
 
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(node, key, tree.compare)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
-		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		// leaf, node.getKey(idx) <= key, unless the key is before the
+		// first key and after the separator in the parent node.
+		cmp := tree.compare(key, node.getKey(idx))
+		tree.dir = SPLIT_EVEN
+		if cmp == 0 {
 			// found the key, update it.
 			leafUpdate(new, node, idx, key, val)
+		} else if cmp < 0 {
+			leafInsert(new, node, idx, key, val)
+			tree.dir = insertDir(tree, new, idx)
 		} else {
 			// insert it after the position.
 			leafInsert(new, node, idx+1, key, val)
+			tree.dir = insertDir(tree, new, idx+1)
 		}
 	case BNODE_NODE:
 		// internal node, insert it to a kid node.
@@ -263,41 +307,87 @@ func nodeInsert(
 	// recursive insertion to the kid node
 	knode = treeInsert(tree, knode, key, val)
 	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	nsplit, splited := nodeSplit3(tree, knode, splitHint(tree, knode, key))
 	// update the kid links
 	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
 }
 
 // Split Big Nodes
 
+// where the keys are being added to a node, see splitHint
+const (
+	SPLIT_EVEN    = 0
+	SPLIT_APPEND  = 1  // at the end, the left node is filled
+	SPLIT_PREPEND = -1 // at the start, the right node is filled
+)
+
+// whether the key inserted at idx of a leaf is right after or right
+// before the last inserted key, i.e. the keys are sequential.
+func insertDir(tree *BTree, leaf BNode, idx uint16) int {
+	switch {
+	case len(tree.last) == 0:
+		return SPLIT_EVEN
+	case idx > 0 && tree.compare(leaf.getKey(idx-1), tree.last) == 0:
+		return SPLIT_APPEND
+	case idx+1 < leaf.nkeys() && tree.compare(leaf.getKey(idx+1), tree.last) == 0:
+		return SPLIT_PREPEND
+	}
+	return SPLIT_EVEN
+}
+
+// sequential keys are added at the same end of a node. an even split
+// leaves the other half of the page empty, since no key will be added
+// there, so the node that won't get the new keys is filled instead.
+// the last key is kept in the tree, so this also applies to the inserts
+// of a transaction.
+func splitHint(tree *BTree, node BNode, key []byte) int {
+	idx := nodeLookupLE(node, key, tree.compare)
+	first := uint16(0)
+	if node.btype() == BNODE_LEAF && len(node.getKey(0)) == 0 {
+		first = 1 // the dummy key
+	}
+	switch {
+	case tree.dir == SPLIT_APPEND && idx+1 == node.nkeys():
+		return SPLIT_APPEND
+	case tree.dir == SPLIT_PREPEND && idx <= first:
+		return SPLIT_PREPEND
+	}
+	return SPLIT_EVEN
+}
+
 // split a bigger-than-allowed node into two.
-// the second node always fits on a page.
+// the second node always fits on a page. the sizes are balanced if both
+// nodes can fit, otherwise the second node takes as many keys as it can.
+// with a hint of sequential inserts, one node is filled instead.
 
-func nodeSplit2(left BNode, right BNode, old BNode) {
-	// Calculate the split point that ensures the right node fits in a page
+func nodeSplit2(tree *BTree, left BNode, right BNode, old BNode, hint int) {
 	nkeys := old.nkeys()
-	var i uint16
-	var subtree_size uint16
-
-	// Find the split point by accumulating KV pairs until we reach page size
-	for i = 0; i < nkeys; i++ {
-		// Size of current key-value pair
-		klen := uint16(len(old.getKey(i)))
-		vlen := uint16(len(old.getVal(i)))
-		pair_size := 4 + klen + vlen // 4 bytes for lengths + key + value
-
-		// Size including header, pointers, and offsets
-		subtree_size = HEADER + 8*(i+1) + 2*(i+1) + subtree_size + pair_size
-
-		// Check if adding this pair would exceed page size for right node
-		if subtree_size > BTREE_PAGE_SIZE {
-			break
+	// the smallest split point where the right node fits
+	first := uint16(1)
+	for first < nkeys-1 && !tree.rangeFits(old, first, nkeys) {
+		first++
+	}
+	nsplit := first
+	best := -1
+	for i := first; i < nkeys && tree.rangeFits(old, 0, i); i++ {
+		if hint == SPLIT_PREPEND {
+			break // the smallest right node
+		}
+		if hint == SPLIT_APPEND {
+			nsplit = i // the largest left node
+			continue
+		}
+		_, lsize := tree.rangeSize(old, 0, i)
+		_, rsize := tree.rangeSize(old, i, nkeys)
+		size := lsize
+		if rsize > size {
+			size = rsize
+		}
+		if best < 0 || size < best {
+			nsplit, best = i, size
 		}
 	}
 
-	// Split point found at index i
-	nsplit := i
-
 	// Configure left node
 	left.setHeader(old.btype(), nsplit)
 	nodeAppendRange(left, old, 0, 0, nsplit)
@@ -307,33 +397,47 @@ func nodeSplit2(left BNode, right BNode, old BNode) {
 	nodeAppendRange(right, old, 0, nsplit, nkeys-nsplit)
 
 	// Validate the split
-	if right.nbytes() > BTREE_PAGE_SIZE {
+	if !tree.fits(right) {
 		panic("right node too big after split")
 	}
 }
 
+// the node to be written, at most 1 page in the plain format
+func nodeTrim(node BNode) BNode {
+	if int(node.nbytes()) <= BTREE_PAGE_SIZE && len(node.data) > BTREE_PAGE_SIZE {
+		node.data = node.data[:BTREE_PAGE_SIZE]
+	}
+	return node
+}
+
+// a node for the keys of another node
+func nodeAlloc(size uint16) BNode {
+	if size < BTREE_PAGE_SIZE {
+		size = BTREE_PAGE_SIZE
+	}
+	return BNode{data: make([]byte, size)}
+}
+
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old.data = old.data[:BTREE_PAGE_SIZE]
-		return 1, [3]BNode{old}
+func nodeSplit3(tree *BTree, old BNode, hint int) (uint16, [3]BNode) {
+	if tree.fits(old) {
+		return 1, [3]BNode{nodeTrim(old)}
 	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	left := nodeAlloc(old.nbytes()) // might be split later
+	right := nodeAlloc(old.nbytes())
 
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
-		return 2, [3]BNode{left, right}
+	nodeSplit2(tree, left, right, old, hint)
+	if tree.fits(left) {
+		return 2, [3]BNode{nodeTrim(left), nodeTrim(right)}
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	nodeSplit2(leftleft, middle, left)
-	if leftleft.nbytes() > BTREE_PAGE_SIZE {
+	leftleft := nodeAlloc(left.nbytes())
+	middle := nodeAlloc(left.nbytes())
+	nodeSplit2(tree, leftleft, middle, left, hint)
+	if !tree.fits(leftleft) {
 		panic("node bigger than page")
 	}
-	return 3, [3]BNode{leftleft, middle, right}
+	return 3, [3]BNode{nodeTrim(leftleft), nodeTrim(middle), nodeTrim(right)}
 }
 
 //Update Internal Nodes
@@ -343,18 +447,65 @@ update itself accordingly. The code for updating an internal node is similar to
 updating a leaf node.
 */
 
+// the keys of an internal node are separators: kid[i-1] < key[i] <= kid[i].
+// the first key is a lower bound of the node.
+
+// the shortest key that is greater than the last key of the left node
+// and less or equal to the first key of the right node.
+func (tree *BTree) separator(left BNode, right BNode) []byte {
+	first := right.getKey(0)
+	if right.btype() == BNODE_NODE {
+		return first // already a separator
+	}
+	return tree.shortestSep(left.getKey(left.nkeys()-1), first)
+}
+
+// the shortest key in (last, first]
+func (tree *BTree) shortestSep(last []byte, first []byte) []byte {
+	if tree.order == nil {
+		return first[:commonPrefix(last, first)+1]
+	}
+	for n := 1; n < len(first); n++ {
+		if tree.compare(last, first[:n]) < 0 && tree.compare(first[:n], first) <= 0 {
+			return first[:n]
+		}
+	}
+	return first
+}
+
+// the lower bound of the first kid replacing the link
+func (tree *BTree) lowerBound(old BNode, idx uint16, kid BNode) []byte {
+	key := old.getKey(idx)
+	if kid.nkeys() > 0 && tree.compare(kid.getKey(0), key) < 0 {
+		key = kid.getKey(0) // a key before the separator was inserted
+	}
+	return key
+}
+
 // replace a link with multiple links
 func nodeReplaceKidN(
 	tree *BTree, new BNode, old BNode, idx uint16,
 	kids ...BNode,
+) {
+	nodeReplaceKids(tree, new, old, idx, 1, kids...)
+}
+
+// replace n links with multiple links
+func nodeReplaceKids(
+	tree *BTree, new BNode, old BNode, idx uint16, n uint16,
+	kids ...BNode,
 ) {
 	inc := uint16(len(kids))
-	new.setHeader(BNODE_NODE, old.nkeys()+inc-1)
+	new.setHeader(BNODE_NODE, old.nkeys()+inc-n)
 	nodeAppendRange(new, old, 0, 0, idx)
 	for i, node := range kids {
-		nodeAppendKV(new, idx+uint16(i), tree.new(node), node.getKey(0), nil)
+		key := tree.lowerBound(old, idx, node)
+		if i > 0 {
+			key = tree.separator(kids[i-1], node)
+		}
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), key, tree.kidVal(node))
 	}
-	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+inc, idx+n, old.nkeys()-(idx+n))
 }
 
 // We have finished the B-tree insertion. Deletion and the rest of the code will be introduced
@@ -368,15 +519,15 @@ func leafDelete(new BNode, old BNode, idx uint16) {
 
 func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	// where to find the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(node, key, tree.compare)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if tree.compare(key, node.getKey(idx)) != 0 {
 			return BNode{} // not found
 		}
 		// delete the key in the leaf
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		new := nodeAlloc(node.nbytes())
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
@@ -393,6 +544,7 @@ func nodeReplace2Kid(
 	idx uint16, // index du premier nœud à remplacer
 	ptr uint64, // pointeur vers le nœud fusionné
 	key []byte, // première clé du nœud fusionné
+	val []byte, // données associées au pointeur (voir BTree.kidVal)
 ) {
 	// Le nombre de clés diminue de 1 car on fusionne deux nœuds
 	new.setHeader(BNODE_NODE, old.nkeys()-1)
@@ -401,8 +553,7 @@ func nodeReplace2Kid(
 	nodeAppendRange(new, old, 0, 0, idx)
 
 	// Ajouter le nouveau nœud fusionné
-	// On utilise nil comme valeur car c'est un nœud interne
-	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendKV(new, idx, ptr, key, val)
 
 	// Copier toutes les entrées après les nœuds fusionnés
 	// On saute idx+2 car on remplace deux nœuds par un seul
@@ -423,54 +574,120 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 		return BNode{} // not found
 	}
 	tree.del(kptr)
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	new := nodeAlloc(node.nbytes() + BTREE_PAGE_SIZE)
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, sibling, updated)
+		merged := nodeAlloc(sibling.nbytes() + updated.nbytes() + BTREE_MAX_KEY_SIZE)
+		nodeMerge(merged, sibling, updated, node.getKey(idx))
 		tree.del(node.getPtr(idx - 1))
-		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(new, node, idx-1, tree.new(merged), node.getKey(idx-1), tree.kidVal(merged))
 	case mergeDir > 0: // right
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
-		nodeMerge(merged, updated, sibling)
+		merged := nodeAlloc(sibling.nbytes() + updated.nbytes() + BTREE_MAX_KEY_SIZE)
+		nodeMerge(merged, updated, sibling, node.getKey(idx+1))
 		tree.del(node.getPtr(idx + 1))
-		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
+		nodeReplace2Kid(new, node, idx, tree.new(merged), tree.lowerBound(node, idx, merged), tree.kidVal(merged))
 	case mergeDir == 0:
-		if updated.nkeys() <= 0 {
-			panic("updated node must have more than 0 keys")
+		// or move keys from a fuller sibling
+		dir, sibling := shouldBorrow(tree, node, idx, updated)
+		switch {
+		case dir < 0 && nodeRedistribute(tree, new, node, idx-1, sibling, updated):
+			tree.del(node.getPtr(idx - 1))
+		case dir > 0 && nodeRedistribute(tree, new, node, idx, updated, sibling):
+			tree.del(node.getPtr(idx + 1))
+		case updated.nkeys() == 0:
+			// the only kid is empty, so is the node. it's merged
+			// with a sibling of the node by the level above.
+			if node.nkeys() != 1 {
+				panic("an empty node with siblings was not merged")
+			}
+			new.setHeader(BNODE_NODE, 0)
+		default:
+			nodeReplaceKidN(tree, new, node, idx, updated)
 		}
-		nodeReplaceKidN(tree, new, node, idx, updated)
 	}
 	return new
 }
 
-// merge 2 nodes into 1
-func nodeMerge(new BNode, left BNode, right BNode) {
+// an underfull node that can't be merged takes keys from the fuller
+// sibling if the sibling is not underfull.
+func shouldBorrow(
+	tree *BTree, node BNode,
+	idx uint16, updated BNode,
+) (int, BNode) {
+	if tree.nodeBytes(updated) >= tree.fillMin() {
+		return 0, BNode{}
+	}
+	dir, sibling, size := 0, BNode{}, tree.fillMin()
+	if idx > 0 {
+		left := tree.get(node.getPtr(idx - 1))
+		if n := tree.nodeBytes(left); n > size {
+			dir, sibling, size = -1, left, n
+		}
+	}
+	if idx+1 < node.nkeys() {
+		right := tree.get(node.getPtr(idx + 1))
+		if n := tree.nodeBytes(right); n > size {
+			dir, sibling, size = +1, right, n
+		}
+	}
+	return dir, sibling
+}
+
+// replace the kids idx and idx+1 with 2 nodes of the same keys evenly
+// split. the separator in the parent is updated. false if the parent
+// would no longer fit on a page with the new separator.
+func nodeRedistribute(tree *BTree, new BNode, node BNode, idx uint16, left BNode, right BNode) bool {
+	combined := nodeAlloc(left.nbytes() + right.nbytes() + BTREE_MAX_KEY_SIZE)
+	nodeMerge(combined, left, right, node.getKey(idx+1))
+	newLeft := nodeAlloc(combined.nbytes())
+	newRight := nodeAlloc(combined.nbytes())
+	nodeSplit2(tree, newLeft, newRight, combined, SPLIT_EVEN)
+	if !tree.fits(newLeft) {
+		panic("node bigger than page")
+	}
+	kids := []BNode{nodeTrim(newLeft), nodeTrim(newRight)}
+	// try the parent without allocating the kids
+	dry := *tree
+	dry.new = func(BNode) uint64 { return 0 }
+	nodeReplaceKids(&dry, new, node, idx, 2, kids...)
+	if !tree.fits(new) {
+		return false
+	}
+	nodeReplaceKids(tree, new, node, idx, 2, kids...)
+	return true
+}
+
+// merge 2 nodes into 1. the first key of an internal right node is
+// replaced by the separator of the 2 nodes in the parent.
+func nodeMerge(new BNode, left BNode, right BNode, sep []byte) {
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
-	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+	if right.btype() == BNODE_NODE && right.nkeys() > 0 {
+		nodeAppendKV(new, left.nkeys(), right.getPtr(0), sep, right.getVal(0))
+		nodeAppendRange(new, right, left.nkeys()+1, 1, right.nkeys()-1)
+	} else {
+		nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+	}
 }
 
 func shouldMerge(
 	tree *BTree, node BNode,
 	idx uint16, updated BNode,
 ) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if tree.nodeBytes(updated) > tree.fillMin() {
 		return 0, BNode{}
 	}
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if tree.mergeFits(sibling, updated, node.getKey(idx)) {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if tree.mergeFits(updated, sibling, node.getKey(idx+1)) {
 			return +1, sibling
 		}
 	}
@@ -519,24 +736,29 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 		nodeAppendKV(root, 0, 0, nil, nil)
 		nodeAppendKV(root, 1, 0, key, val)
 		tree.root = tree.new(root)
+		tree.last = append(tree.last[:0], key...)
 		return
 	}
 	node := tree.get(tree.root)
 	tree.del(tree.root)
 	node = treeInsert(tree, node, key, val)
-	nsplit, splitted := nodeSplit3(node)
+	nsplit, splitted := nodeSplit3(tree, node, splitHint(tree, node, key))
 	if nsplit > 1 {
 		// the root was split, add a new level.
 		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range splitted[:nsplit] {
-			ptr, key := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, key, nil)
+			ptr, key := tree.new(knode), []byte(nil)
+			if i > 0 {
+				key = tree.separator(splitted[i-1], knode)
+			}
+			nodeAppendKV(root, uint16(i), ptr, key, tree.kidVal(knode))
 		}
 		tree.root = tree.new(root)
 	} else {
 		tree.root = tree.new(splitted[0])
 	}
+	tree.last = append(tree.last[:0], key...)
 }
 
 func (tree *BTree) Get(key []byte) ([]byte, bool) {
@@ -551,12 +773,12 @@ func (tree *BTree) Get(key []byte) ([]byte, bool) {
 	// Tant qu'on n'a pas trouvé la clé ou atteint une feuille
 	for {
 		// Trouve l'index du plus grand enfant dont la clé est <= à la clé recherchée
-		idx := nodeLookupLE(node, key)
+		idx := nodeLookupLE(node, key, tree.compare)
 
 		switch node.btype() {
 		case BNODE_LEAF:
 			// Dans un nœud feuille, vérifie si la clé existe
-			if bytes.Equal(key, node.getKey(idx)) {
+			if tree.compare(key, node.getKey(idx)) == 0 {
 				return node.getVal(idx), true
 			}
 			return nil, false
@@ -570,3 +792,24 @@ func (tree *BTree) Get(key []byte) ([]byte, bool) {
 		}
 	}
 }
+
+// the average fraction of a page used by the pages of the tree
+func (tree *BTree) Utilization() float64 {
+	if tree.root == 0 {
+		return 0
+	}
+	used, npages := tree.utilization(tree.get(tree.root))
+	return float64(used) / float64(npages*BTREE_PAGE_SIZE)
+}
+
+// the bytes used by the pages of a subtree and the number of pages
+func (tree *BTree) utilization(node BNode) (int, int) {
+	used, npages := tree.nodeBytes(node), 1
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			u, n := tree.utilization(tree.get(node.getPtr(i)))
+			used, npages = used+u, npages+n
+		}
+	}
+	return used, npages
+}
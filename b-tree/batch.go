@@ -0,0 +1,293 @@
+package b_tree
+
+import "sort"
+
+// batched reads and writes. the keys are sorted and passed down the tree
+// together, each node on the way is read once and each changed node is
+// copied once, however many keys of the batch are under it. the changed
+// nodes are split into as many nodes as needed, then the underfull ones
+// are merged with a sibling, see mergeRangeKids.
+
+// a write of WriteBatch
+type BatchOp struct {
+	Key []byte
+	Val []byte
+	Del bool // delete the key, Val is not used
+}
+
+// an entry of a node being built
+type nodeEntry struct {
+	key []byte
+	ptr uint64
+	val []byte
+}
+
+func entrySize(e nodeEntry) int {
+	return 8 + 2 + 4 + len(e.key) + len(e.val)
+}
+
+// split a node into the nodes that fit. the right node of each split
+// takes as many keys as it can, so the nodes on the right are full and
+// only the first 2 nodes are balanced.
+func nodeSplitN(tree *BTree, old BNode) []BNode {
+	nodes := []BNode{}
+	for !tree.fits(old) {
+		left := nodeAlloc(old.nbytes())
+		right := nodeAlloc(old.nbytes())
+		nodeSplit2(tree, left, right, old, SPLIT_EVEN)
+		nodes = append([]BNode{nodeTrim(right)}, nodes...)
+		old = left
+	}
+	return append([]BNode{nodeTrim(old)}, nodes...)
+}
+
+// the nodes of the entries. the entries are added to a node of at most
+// 2*BTREE_NODE_MAX bytes, which is split when it's full. the last of the
+// split nodes goes on with the next entries.
+func buildNodes(tree *BTree, btype uint16, entries []nodeEntry) []BNode {
+	nodes := []BNode{}
+	from, size := 0, HEADER
+	build := func(to int) []BNode {
+		node := nodeAlloc(uint16(size))
+		node.setHeader(btype, uint16(to-from))
+		for i, e := range entries[from:to] {
+			nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+		}
+		return nodeSplitN(tree, node)
+	}
+	for i, e := range entries {
+		if size+entrySize(e) <= 2*BTREE_NODE_MAX {
+			size += entrySize(e)
+			continue
+		}
+		split := build(i)
+		nodes = append(nodes, split[:len(split)-1]...)
+		// the entries of the last node are added again
+		last := split[len(split)-1]
+		from, size = i-int(last.nkeys()), HEADER
+		for _, e := range entries[from : i+1] {
+			size += entrySize(e)
+		}
+	}
+	return append(nodes, build(len(entries))...)
+}
+
+// apply the sorted writes to a leaf, nil if nothing changed
+func leafApply(tree *BTree, node BNode, ops []BatchOp) []BNode {
+	entries := []nodeEntry{}
+	changed := false
+	i, j := uint16(0), 0
+	for i < node.nkeys() || j < len(ops) {
+		cmp := -1 // the key of the leaf first
+		if i >= node.nkeys() {
+			cmp = +1
+		} else if j < len(ops) {
+			cmp = tree.compare(node.getKey(i), ops[j].Key)
+		}
+		switch {
+		case cmp < 0:
+			entries = append(entries, nodeEntry{key: node.getKey(i), val: node.getVal(i)})
+			i++
+		case cmp > 0:
+			if !ops[j].Del {
+				entries = append(entries, nodeEntry{key: ops[j].Key, val: ops[j].Val})
+				changed = true
+			}
+			j++
+		default:
+			if !ops[j].Del {
+				entries = append(entries, nodeEntry{key: ops[j].Key, val: ops[j].Val})
+			}
+			changed = true
+			i, j = i+1, j+1
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if len(entries) == 0 {
+		return []BNode{} // empty
+	}
+	return buildNodes(tree, BNODE_LEAF, entries)
+}
+
+// apply the sorted writes to a subtree. the result replaces the node,
+// it's nil if nothing changed and empty if no key is left.
+func treeApply(tree *BTree, node BNode, ops []BatchOp) []BNode {
+	if node.btype() == BNODE_LEAF {
+		return leafApply(tree, node, ops)
+	}
+	kids := []rangeKid{}
+	changed := false
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := rangeKid{key: node.getKey(i), ptr: node.getPtr(i), val: node.getVal(i)}
+		// the writes before the next kid
+		n := len(ops)
+		if i+1 < node.nkeys() {
+			next := node.getKey(i + 1)
+			n = sort.Search(len(ops), func(j int) bool {
+				return tree.compare(ops[j].Key, next) >= 0
+			})
+		}
+		var updated []BNode
+		if n > 0 {
+			updated = treeApply(tree, tree.get(kid.ptr), ops[:n])
+		}
+		ops = ops[n:]
+		if updated == nil {
+			kids = append(kids, kid)
+			continue
+		}
+		changed = true
+		tree.del(kid.ptr)
+		for k, new := range updated {
+			if k > 0 {
+				kid.key = tree.separator(updated[k-1], new)
+			}
+			kids = append(kids, rangeKid{key: kid.key, node: new})
+		}
+	}
+	if !changed {
+		return nil
+	}
+	kids = mergeRangeKids(tree, kids)
+	if len(kids) == 0 {
+		return []BNode{}
+	}
+	entries := make([]nodeEntry, len(kids))
+	for i, kid := range kids {
+		if i == 0 {
+			kid.key = node.getKey(0) // the lower bound of the node
+		}
+		if kid.node.data != nil {
+			kid.ptr, kid.val = tree.new(kid.node), tree.kidVal(kid.node)
+		}
+		entries[i] = nodeEntry{key: kid.key, ptr: kid.ptr, val: kid.val}
+	}
+	return buildNodes(tree, BNODE_NODE, entries)
+}
+
+// apply the writes in a single pass. the writes are sorted by key,
+// the last one wins for the same key.
+func (tree *BTree) WriteBatch(ops []BatchOp) {
+	for _, op := range ops {
+		if len(op.Key) == 0 {
+			panic("key length must not be zero")
+		}
+		if len(op.Key) > BTREE_MAX_KEY_SIZE {
+			panic("key length exceeds BTREE_MAX_KEY_SIZE")
+		}
+		if !op.Del && len(op.Val) > BTREE_MAX_VAL_SIZE {
+			panic("value length exceeds BTREE_MAX_VAL_SIZE")
+		}
+	}
+	sorted := append([]BatchOp(nil), ops...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return tree.compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	// remove the duplicates, keep the last write of each key
+	unique := sorted[:0]
+	for i, op := range sorted {
+		if i+1 < len(sorted) && tree.compare(op.Key, sorted[i+1].Key) == 0 {
+			continue
+		}
+		unique = append(unique, op)
+	}
+	var root BNode
+	if tree.root == 0 {
+		// the first node with the dummy key
+		root = BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root.setHeader(BNODE_LEAF, 1)
+		nodeAppendKV(root, 0, 0, nil, nil)
+	} else {
+		root = tree.get(tree.root)
+	}
+	nodes := treeApply(tree, root, unique)
+	if nodes == nil {
+		return // nothing changed
+	}
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	// add levels until there is a single root
+	for len(nodes) > 1 {
+		entries := make([]nodeEntry, len(nodes))
+		for i, node := range nodes {
+			key := []byte(nil)
+			if i > 0 {
+				key = tree.separator(nodes[i-1], node)
+			}
+			entries[i] = nodeEntry{key: key, ptr: tree.new(node), val: tree.kidVal(node)}
+		}
+		nodes = buildNodes(tree, BNODE_NODE, entries)
+	}
+	// remove the levels of a single kid
+	root = nodes[0]
+	for root.btype() == BNODE_NODE && root.nkeys() == 1 {
+		ptr := root.getPtr(0)
+		root = tree.get(ptr)
+		tree.del(ptr)
+	}
+	tree.root = tree.new(root)
+	if len(unique) > 0 {
+		tree.last = append(tree.last[:0], unique[len(unique)-1].Key...)
+	}
+}
+
+// look up the sorted keys in a subtree, the values are stored by the
+// indexes of the keys
+func treeMultiGet(tree *BTree, node BNode, keys [][]byte, idxs []int, vals [][]byte, found []bool) {
+	for i := uint16(0); i < node.nkeys() && len(idxs) > 0; i++ {
+		n := len(idxs)
+		if i+1 < node.nkeys() {
+			next := node.getKey(i + 1)
+			n = sort.Search(len(idxs), func(j int) bool {
+				return tree.compare(keys[idxs[j]], next) >= 0
+			})
+		}
+		switch node.btype() {
+		case BNODE_LEAF:
+			for _, idx := range idxs[:n] {
+				if tree.compare(keys[idx], node.getKey(i)) == 0 {
+					vals[idx], found[idx] = node.getVal(i), true
+				}
+			}
+		case BNODE_NODE:
+			if n > 0 {
+				treeMultiGet(tree, tree.get(node.getPtr(i)), keys, idxs[:n], vals, found)
+			}
+		default:
+			panic("bad node!")
+		}
+		idxs = idxs[n:]
+	}
+}
+
+// look up the keys in a single pass, the results are in the order of
+// the keys. like BTree.Get, the values point into the pages.
+func (tree *BTree) MultiGet(keys [][]byte) ([][]byte, []bool) {
+	vals, found := make([][]byte, len(keys)), make([]bool, len(keys))
+	if tree.root == 0 {
+		return vals, found
+	}
+	idxs := make([]int, len(keys))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		return tree.compare(keys[idxs[i]], keys[idxs[j]]) < 0
+	})
+	treeMultiGet(tree, tree.get(tree.root), keys, idxs, vals, found)
+	return vals, found
+}
+
+func (db *KV) MultiGet(keys [][]byte) ([][]byte, []bool) {
+	return db.tree.MultiGet(keys)
+}
+
+// apply the writes to the main tree with a single flush
+func (db *KV) WriteBatch(ops []BatchOp) error {
+	db.checkNoTx()
+	db.tree.WriteBatch(ops)
+	return flushPages(db)
+}
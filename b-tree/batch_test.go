@@ -0,0 +1,170 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// check the KVs of the main tree against a map
+func checkMap(t *testing.T, db *KV, kvs map[string]string) {
+	t.Helper()
+	n := 0
+	for iter := db.tree.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		if want, ok := kvs[string(key)]; !ok || string(val) != want {
+			t.Fatalf("%q = %q, want %q %v", key, val, want, ok)
+		}
+		n++
+	}
+	if n != len(kvs) {
+		t.Fatalf("got %d keys, want %d", n, len(kvs))
+	}
+}
+
+// fail if the tree reads a page twice, until stop is called
+func readOnce(t *testing.T, tree *BTree) (stop func()) {
+	get := tree.get
+	seen := map[uint64]bool{}
+	tree.get = func(ptr uint64) BNode {
+		if seen[ptr] {
+			t.Fatalf("page %d is read twice", ptr)
+		}
+		seen[ptr] = true
+		return get(ptr)
+	}
+	return func() { tree.get = get }
+}
+
+func TestWriteBatch(t *testing.T) {
+	for _, config := range []KV{{}, {Counts: true, Hashes: true, Prefix: true}} {
+		path := t.TempDir() + "/batch.db"
+		config.Path = path
+		db := testOpen(t, &config)
+		rng := rand.New(rand.NewSource(1))
+		kvs := map[string]string{}
+		check := func() {
+			t.Helper()
+			checkTree(t, &db.tree)
+			checkKids(t, &db.tree)
+			checkMap(t, db, kvs)
+			checkPages(t, db)
+		}
+		for round := 0; round < 100; round++ {
+			ops := []BatchOp{}
+			for i := rng.Intn(1000); i > 0; i-- {
+				key := fmt.Sprintf("key%05d", rng.Intn(10000))
+				if rng.Intn(3) == 0 {
+					ops = append(ops, BatchOp{Key: []byte(key), Del: true})
+					delete(kvs, key)
+				} else {
+					// the values of the same key differ, the last write wins
+					val := fmt.Sprintf("v%d-%d", round, i)
+					ops = append(ops, BatchOp{Key: []byte(key), Val: []byte(val)})
+					kvs[key] = val
+				}
+			}
+			stop := readOnce(t, &db.tree)
+			if err := db.WriteBatch(ops); err != nil {
+				t.Fatal(err)
+			}
+			stop()
+			check()
+		}
+
+		// nothing is committed without a change
+		seq := db.Seq()
+		if err := db.WriteBatch(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.WriteBatch([]BatchOp{{Key: []byte("missing"), Del: true}, {Key: []byte("z"), Del: true}}); err != nil {
+			t.Fatal(err)
+		}
+		if db.Seq() != seq {
+			t.Fatalf("empty batches are committed, seq %d, want %d", db.Seq(), seq)
+		}
+		db.Close()
+		db = testOpen(t, &KV{Path: path})
+		check()
+		db.Close()
+	}
+}
+
+func TestWriteBatchEmptyTree(t *testing.T) {
+	cases := [][]BatchOp{
+		{{Key: []byte("a"), Val: []byte("1")}},
+		{{Key: []byte("a"), Del: true}},
+		{{Key: []byte("a"), Val: []byte("1")}, {Key: []byte("a"), Del: true}},
+		{{Key: []byte("a"), Del: true}, {Key: []byte("a"), Val: []byte("2")}},
+	}
+	// many keys, the root is split
+	big := []BatchOp{}
+	for i := 5000; i > 0; i-- {
+		big = append(big, BatchOp{Key: []byte(fmt.Sprintf("key%05d", i)), Val: []byte(fmt.Sprint(i))})
+	}
+	cases = append(cases, big)
+	for _, ops := range cases {
+		db := testOpen(t, &KV{Path: t.TempDir() + "/batch.db", Counts: true})
+		if err := db.WriteBatch(ops); err != nil {
+			t.Fatal(err)
+		}
+		kvs := map[string]string{}
+		for _, op := range ops {
+			if op.Del {
+				delete(kvs, string(op.Key))
+			} else {
+				kvs[string(op.Key)] = string(op.Val)
+			}
+		}
+		checkTree(t, &db.tree)
+		checkKids(t, &db.tree)
+		checkMap(t, db, kvs)
+		if key, _, ok := db.First(); len(kvs) > 0 && (!ok || len(key) == 0) {
+			t.Fatalf("first key %q %v", key, ok)
+		}
+		db.Close()
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/batch.db"})
+	defer db.Close()
+	if vals, found := db.MultiGet([][]byte{[]byte("a"), nil}); len(vals) != 2 || found[0] || found[1] {
+		t.Fatalf("found keys in an empty tree: %q %v", vals, found)
+	}
+	ops := []BatchOp{}
+	for i := 0; i < 5000; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		ops = append(ops, BatchOp{Key: []byte(key), Val: []byte("v" + key)})
+	}
+	if err := db.WriteBatch(ops); err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		// unsorted, duplicated and missing keys
+		keys := [][]byte{}
+		for i := 10 + rng.Intn(500); i > 0; i-- {
+			keys = append(keys, []byte(fmt.Sprintf("key%05d", rng.Intn(5100))))
+		}
+		keys = append(keys, []byte("a"), []byte("z"))
+		keys = append(keys, keys[:10]...)
+		rng.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+		stop := readOnce(t, &db.tree)
+		vals, found := db.MultiGet(keys)
+		stop()
+		if len(vals) != len(keys) || len(found) != len(keys) {
+			t.Fatalf("%d results for %d keys", len(vals), len(keys))
+		}
+		for i, key := range keys {
+			val, ok := db.Get(key)
+			if found[i] != ok || string(vals[i]) != string(val) {
+				t.Fatalf("key #%d %q: %q %v, want %q %v", i, key, vals[i], found[i], val, ok)
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// buckets are named trees in the same file. the catalog tree maps
+// bucket names to the root pointers, its root is in the master page.
+// all trees share the free list and are updated by the same commit.
+// the snapshots, branches and the root history only cover the main tree.
+
+type bucketState struct {
+	tree  BTree
+	dirty bool // the root is not yet in the catalog
+}
+
+// a handle to a bucket. the updates are committed right away,
+// unless the bucket is from a transaction.
+type Bucket struct {
+	db   *KV
+	name string
+	tx   *KVTX
+}
+
+var errNoBucket = errors.New("bucket not found")
+
+func (db *KV) bucketTree(name string) (*bucketState, bool) {
+	if b, ok := db.buckets[name]; ok {
+		return b, true
+	}
+	val, ok := db.catalog.Get([]byte(name))
+	if !ok {
+		return nil, false
+	}
+	b := &bucketState{tree: db.newTree(binary.LittleEndian.Uint64(val))}
+	db.buckets[name] = b
+	return b, true
+}
+
+// a tree sharing the page callbacks of the main tree
+func (db *KV) newTree(root uint64) BTree {
+	return BTree{
+		root: root, get: db.pageGet, new: db.pageNew, del: db.pageDel,
+		flags: db.tree.flags, order: db.tree.order, minFill: db.tree.minFill,
+	}
+}
+
+// write the updated bucket roots to the catalog before a commit
+func bucketsStore(db *KV) {
+	for name, b := range db.buckets {
+		if b.dirty {
+			var val [8]byte
+			binary.LittleEndian.PutUint64(val[:], b.tree.root)
+			db.catalog.Insert([]byte(name), val[:])
+			b.dirty = false
+		}
+	}
+}
+
+func bucketCreate(db *KV, name string) error {
+	if len(name) == 0 || len(name) > BTREE_MAX_KEY_SIZE {
+		return errors.New("bad bucket name")
+	}
+	if _, ok := db.bucketTree(name); ok {
+		return fmt.Errorf("bucket %q already exists", name)
+	}
+	db.buckets[name] = &bucketState{tree: db.newTree(0), dirty: true}
+	return nil
+}
+
+func bucketDelete(db *KV, name string) error {
+	b, ok := db.bucketTree(name)
+	if !ok {
+		return errNoBucket
+	}
+	// free every page of the tree
+	stack := []uint64{b.tree.root}
+	for len(stack) > 0 {
+		ptr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ptr == 0 {
+			continue
+		}
+		node := db.pageGet(ptr)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				stack = append(stack, node.getPtr(i))
+			}
+		}
+		db.pageDel(ptr)
+	}
+	delete(db.buckets, name)
+	db.catalog.Delete([]byte(name))
+	return nil
+}
+
+// the names of all buckets
+func (db *KV) Buckets() []string {
+	names := []string{}
+	for iter := db.catalog.Seek(nil); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		names = append(names, string(key))
+	}
+	// created but not yet in the catalog
+	for name := range db.buckets {
+		if _, ok := db.catalog.Get([]byte(name)); !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (db *KV) Bucket(name string) (*Bucket, error) {
+	if _, ok := db.bucketTree(name); !ok {
+		return nil, errNoBucket
+	}
+	return &Bucket{db: db, name: name}, nil
+}
+
+func (db *KV) CreateBucket(name string) (*Bucket, error) {
+	db.checkNoTx()
+	if err := bucketCreate(db, name); err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: name}, flushPages(db)
+}
+
+// delete a bucket and all its keys
+func (db *KV) DeleteBucket(name string) error {
+	db.checkNoTx()
+	if err := bucketDelete(db, name); err != nil {
+		return err
+	}
+	return flushPages(db)
+}
+
+func (tx *KVTX) Bucket(name string) (*Bucket, error) {
+	if _, ok := tx.db.bucketTree(name); !ok {
+		return nil, errNoBucket
+	}
+	return &Bucket{db: tx.db, name: name, tx: tx}, nil
+}
+
+func (tx *KVTX) CreateBucket(name string) (*Bucket, error) {
+	if err := bucketCreate(tx.db, name); err != nil {
+		return nil, err
+	}
+	return &Bucket{db: tx.db, name: name, tx: tx}, nil
+}
+
+func (tx *KVTX) DeleteBucket(name string) error {
+	return bucketDelete(tx.db, name)
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, bool) {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return nil, false
+	}
+	return state.tree.Get(key)
+}
+
+func (b *Bucket) Set(key []byte, val []byte) error {
+	if b.tx == nil {
+		b.db.checkNoTx()
+	}
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return errNoBucket
+	}
+	state.tree.Insert(key, val)
+	state.dirty = true
+	if b.tx != nil {
+		return nil
+	}
+	return flushPages(b.db)
+}
+
+func (b *Bucket) Del(key []byte) (bool, error) {
+	if b.tx == nil {
+		b.db.checkNoTx()
+	}
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return false, errNoBucket
+	}
+	deleted := state.tree.Delete(key)
+	state.dirty = state.dirty || deleted
+	if b.tx != nil {
+		return deleted, nil
+	}
+	return deleted, flushPages(b.db)
+}
+
+// iterate the bucket from the first key that is greater or equal to the input
+func (b *Bucket) Seek(key []byte) *BIter {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return &BIter{}
+	}
+	return state.tree.Seek(key)
+}
+
+// the position of the key in the bucket, see BTree.Rank
+func (b *Bucket) Rank(key []byte) int {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return 0
+	}
+	return state.tree.Rank(key)
+}
+
+// the approximate number of keys in the range of the bucket and their
+// size in bytes, see BTree.EstimateRange
+func (b *Bucket) EstimateRange(start []byte, end []byte) (int, int) {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return 0, 0
+	}
+	return state.tree.EstimateRange(start, end)
+}
+
+// iterate the bucket from the nth key, see BTree.SeekIndex
+func (b *Bucket) SeekIndex(n int) *BIter {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return &BIter{}
+	}
+	return state.tree.SeekIndex(n)
+}
+
+// n random keys of the bucket, see BTree.Sample
+func (b *Bucket) Sample(n int, rng *rand.Rand) [][]byte {
+	state, ok := b.db.bucketTree(b.name)
+	if !ok {
+		return nil
+	}
+	return state.tree.Sample(n, rng)
+}
@@ -0,0 +1,208 @@
+package b_tree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// building a tree from sorted KVs without BTree.Insert. the leaves are
+// filled one after another, a node is written once it is full and its
+// first key goes to the node of the level above, so each page is
+// written exactly once and the tree grows from the bottom up.
+
+// the input of BulkLoad, BIter is one
+type KVIterator interface {
+	Valid() bool
+	Deref() ([]byte, []byte)
+	Next()
+}
+
+// the number of pages kept in memory before they are copied to the file
+const BULK_SPILL_PAGES = 1024
+
+// the nodes being filled at a level of the tree. a full node is only
+// written once the next one is started, so that the last node of an
+// internal level can take an entry from it instead of having a single kid.
+type bulkLevel struct {
+	keys  [][]byte
+	vals  [][]byte
+	ptrs  []uint64
+	cut   int    // the entries before it are of the full node
+	size  int    // the size in bytes of the node after the cut
+	split bool   // a node of this level was written
+	last  []byte // the last key of the written node
+}
+
+type bulkLoader struct {
+	db     *KV
+	limit  int // node size limit from the fill factor
+	levels []*bulkLevel
+}
+
+// load the sorted KVs into the empty main tree and commit them.
+// the fill factor in (0, 1] is the fraction of each page that is used,
+// the rest is left for later inserts. the input must be in the order
+// of the tree without duplicates, nothing is loaded otherwise.
+func BulkLoad(db *KV, iter KVIterator, fillFactor float64) error {
+	if !(0 < fillFactor && fillFactor <= 1) {
+		return fmt.Errorf("bad fill factor %v", fillFactor)
+	}
+	if db.tree.root != 0 {
+		return errors.New("the tree is not empty")
+	}
+	tx := KVTX{}
+	db.Begin(&tx)
+	bl := &bulkLoader{db: db, limit: int(fillFactor * BTREE_PAGE_SIZE)}
+	if err := bl.load(iter); err != nil {
+		db.Abort(&tx)
+		return fmt.Errorf("BulkLoad: %w", err)
+	}
+	return db.Commit(&tx)
+}
+
+func (bl *bulkLoader) load(iter KVIterator) error {
+	var prev []byte
+	for n := 0; iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		switch {
+		case len(key) == 0:
+			return fmt.Errorf("empty key at #%d", n)
+		case len(key) > BTREE_MAX_KEY_SIZE:
+			return fmt.Errorf("key too long at #%d", n)
+		case len(val) > BTREE_MAX_VAL_SIZE:
+			return fmt.Errorf("value too long at #%d", n)
+		}
+		if n > 0 {
+			cmp := bl.db.tree.compare(prev, key)
+			if cmp == 0 {
+				return fmt.Errorf("duplicate key %q at #%d", key, n)
+			}
+			if cmp > 0 {
+				return fmt.Errorf("unsorted key %q at #%d", key, n)
+			}
+		} else {
+			// the dummy key, the tree covers the whole key space
+			if err := bl.add(0, nil, nil, 0); err != nil {
+				return err
+			}
+		}
+		prev = append(prev[:0], key...)
+		if err := bl.add(0, key, val, 0); err != nil {
+			return err
+		}
+		n++
+	}
+	return bl.finish()
+}
+
+// append an entry to the node of a level, the full node is written
+// first. a node has at least 2 entries unless 2 entries exceed a page,
+// which only happens to the leaves, so the levels always get smaller.
+func (bl *bulkLoader) add(level int, key []byte, val []byte, ptr uint64) error {
+	if level == len(bl.levels) {
+		bl.levels = append(bl.levels, &bulkLevel{size: HEADER})
+	}
+	lv := bl.levels[level]
+	size := 8 + 2 + 4 + len(key) + len(val)
+	n := len(lv.keys) - lv.cut
+	if n > 0 && (lv.size+size > BTREE_PAGE_SIZE || (n > 1 && lv.size+size > bl.limit)) {
+		if err := bl.write(level, lv.cut); err != nil {
+			return err
+		}
+		lv.cut, lv.size = len(lv.keys), HEADER
+	}
+	lv.keys = append(lv.keys, append([]byte(nil), key...))
+	lv.vals = append(lv.vals, append([]byte(nil), val...))
+	lv.ptrs = append(lv.ptrs, ptr)
+	lv.size += size
+	return nil
+}
+
+// the node of the first n entries of a level
+func (bl *bulkLoader) node(level int, n int) BNode {
+	lv := bl.levels[level]
+	btype := uint16(BNODE_LEAF)
+	if level > 0 {
+		btype = BNODE_NODE
+	}
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(btype, uint16(n))
+	for i := 0; i < n; i++ {
+		nodeAppendKV(node, uint16(i), lv.ptrs[i], lv.keys[i], lv.vals[i])
+	}
+	return node
+}
+
+// write the node of the first n entries of a level and link it from the
+// level above, nothing if n is 0
+func (bl *bulkLoader) write(level int, n int) error {
+	if n == 0 {
+		return nil
+	}
+	lv := bl.levels[level]
+	node := bl.node(level, n)
+	tree := &bl.db.tree
+	ptr := tree.new(node)
+	kidVal := tree.kidVal(node)
+	// the key in the parent node, see BTree.separator
+	key := node.getKey(0)
+	if lv.split && level == 0 {
+		key = tree.shortestSep(lv.last, key)
+	}
+	lv.last = append(lv.last[:0], lv.keys[n-1]...)
+	lv.keys, lv.vals, lv.ptrs = lv.keys[n:], lv.vals[n:], lv.ptrs[n:]
+	lv.cut -= n
+	lv.split = true
+	if len(bl.db.page.updates) >= BULK_SPILL_PAGES {
+		if err := spillPages(bl.db); err != nil {
+			return err
+		}
+	}
+	return bl.add(level+1, key, kidVal, ptr)
+}
+
+// write the last nodes, the last level with a single node is the root
+func (bl *bulkLoader) finish() error {
+	for level := 0; level < len(bl.levels); level++ {
+		lv := bl.levels[level]
+		if len(lv.keys) == 0 {
+			continue
+		}
+		if level > 0 && lv.cut > 0 && len(lv.keys)-lv.cut == 1 {
+			// no single kid, up to 3 internal entries fit in a page
+			if len(lv.keys) <= 3 {
+				lv.cut = 0
+			} else {
+				lv.cut--
+			}
+		}
+		if level == len(bl.levels)-1 && !lv.split && lv.cut == 0 {
+			bl.db.tree.root = bl.db.tree.new(bl.node(level, len(lv.keys)))
+			return nil
+		}
+		if err := bl.write(level, lv.cut); err != nil {
+			return err
+		}
+		if err := bl.write(level, len(lv.keys)); err != nil {
+			return err
+		}
+	}
+	return nil // no input
+}
+
+// copy the new pages to the file before the commit to bound the memory.
+// they are only used after the master page is updated.
+func spillPages(db *KV) error {
+	npages := int(db.page.flushed + db.page.nappend)
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	if err := extendMmap(db, npages); err != nil {
+		return err
+	}
+	for ptr, page := range db.page.updates {
+		copy(db.pageRead(ptr).data, page)
+	}
+	db.page.updates = map[uint64][]byte{}
+	return nil
+}
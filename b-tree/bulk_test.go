@@ -0,0 +1,138 @@
+package b_tree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the KVs of a sorted slice, the value is the key after a "v"
+type sliceIter struct {
+	keys []string
+	i    int
+}
+
+func (it *sliceIter) Valid() bool { return it.i < len(it.keys) }
+func (it *sliceIter) Deref() ([]byte, []byte) {
+	return []byte(it.keys[it.i]), []byte("v" + it.keys[it.i])
+}
+func (it *sliceIter) Next() { it.i++ }
+
+func testOpen(t *testing.T, db *KV) *KV {
+	t.Helper()
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// check that the leaves are at the same depth and that the internal
+// nodes have more than a single kid. returns the height.
+func checkTree(t *testing.T, tree *BTree) int {
+	t.Helper()
+	var walk func(ptr uint64) int
+	walk = func(ptr uint64) int {
+		node := tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			return 1
+		}
+		if node.nkeys() < 2 {
+			t.Fatalf("internal node %d with %d kids", ptr, node.nkeys())
+		}
+		height := walk(node.getPtr(0))
+		for i := uint16(1); i < node.nkeys(); i++ {
+			if h := walk(node.getPtr(i)); h != height {
+				t.Fatalf("leaves at depths %d and %d", h, height)
+			}
+		}
+		return height + 1
+	}
+	if tree.root == 0 {
+		return 0
+	}
+	return walk(tree.root)
+}
+
+// check the KVs of the main tree in order
+func checkKeys(t *testing.T, db *KV, keys []string) {
+	t.Helper()
+	i := 0
+	for iter := db.tree.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if i >= len(keys) || string(key) != keys[i] || string(val) != "v"+keys[i] {
+			t.Fatalf("bad key #%d %.20q", i, key)
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("got %d keys, want %d", i, len(keys))
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, ff := range []float64{0.5, 1} {
+		for _, n := range []int{0, 1, 50, 20000} {
+			path := t.TempDir() + "/bulk.db"
+			db := testOpen(t, &KV{Path: path})
+			if err := BulkLoad(db, &sliceIter{keys: []string{"a", "c", "b"}}, ff); err == nil {
+				t.Fatal("unsorted keys loaded")
+			}
+			if err := BulkLoad(db, &sliceIter{keys: []string{"a", "a"}}, ff); err == nil {
+				t.Fatal("duplicate keys loaded")
+			}
+			keys := []string{}
+			for i := 0; i < n; i++ {
+				keys = append(keys, fmt.Sprintf("key%08d", i))
+			}
+			if err := BulkLoad(db, &sliceIter{keys: keys}, ff); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			db = testOpen(t, &KV{Path: path})
+			checkTree(t, &db.tree)
+			checkKeys(t, db, keys)
+			db.Close()
+		}
+	}
+}
+
+// a fill factor that leaves room for a single large entry per node
+func TestBulkLoadLargeKeys(t *testing.T) {
+	cases := []struct {
+		ff   float64
+		klen int
+		n    int
+	}{
+		{0.1, 504, 10},
+		{0.1, 504, 1000},
+		{0.4, 1000, 10},
+		{0.4, 1000, 500},
+		{0.01, 8, 2000},
+		{1, 1000, 300},
+	}
+	for _, c := range cases {
+		keys := []string{}
+		for i := 0; i < c.n; i++ {
+			key := fmt.Sprintf("%08d", i)
+			keys = append(keys, key+strings.Repeat("x", c.klen-len(key)))
+		}
+		path := t.TempDir() + "/bulk.db"
+		db := testOpen(t, &KV{Path: path})
+		done := make(chan error, 1)
+		go func() { done <- BulkLoad(db, &sliceIter{keys: keys}, c.ff) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * time.Second):
+			t.Fatalf("BulkLoad(%v, %d keys of %d bytes) does not end", c.ff, c.n, c.klen)
+		}
+		db.Close()
+		db = testOpen(t, &KV{Path: path})
+		checkTree(t, &db.tree)
+		checkKeys(t, db, keys)
+		db.Close()
+	}
+}
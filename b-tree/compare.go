@@ -0,0 +1,140 @@
+package b_tree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the order of the keys of a tree. the default is bytes.Compare.
+// the ID of the comparator is recorded in the master page, so a file
+// can only be opened with the comparator it was created with.
+// keys that compare as equal are the same key.
+type Comparator struct {
+	ID      uint64 // nonzero, IDs below 256 are reserved
+	Name    string
+	Compare func(a []byte, b []byte) int
+}
+
+const (
+	CMP_BYTES   = 0 // bytes.Compare
+	CMP_NOCASE  = 1 // ASCII case-insensitive
+	CMP_NATURAL = 2 // digit runs are compared as numbers
+)
+
+var comparators = map[uint64]*Comparator{
+	CMP_NOCASE:  {ID: CMP_NOCASE, Name: "nocase", Compare: compareNoCase},
+	CMP_NATURAL: {ID: CMP_NATURAL, Name: "natural", Compare: compareNatural},
+}
+
+// make a comparator available for KV.Comparator.
+// it must be registered before opening the files that use it.
+func RegisterComparator(cmp *Comparator) error {
+	if cmp.ID < 256 || cmp.Compare == nil {
+		return fmt.Errorf("bad comparator %d", cmp.ID)
+	}
+	if _, ok := comparators[cmp.ID]; ok {
+		return fmt.Errorf("comparator %d is already registered", cmp.ID)
+	}
+	comparators[cmp.ID] = cmp
+	return nil
+}
+
+// nil for the default order
+func findComparator(id uint64) (*Comparator, error) {
+	if id == CMP_BYTES {
+		return nil, nil
+	}
+	cmp, ok := comparators[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown comparator %d", id)
+	}
+	return cmp, nil
+}
+
+func (cmp *Comparator) id() uint64 {
+	if cmp == nil {
+		return CMP_BYTES
+	}
+	return cmp.ID
+}
+
+// compare 2 keys of the tree. the empty dummy key is before all keys.
+func (tree *BTree) compare(a []byte, b []byte) int {
+	if tree.order == nil {
+		return bytes.Compare(a, b)
+	}
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	case len(b) == 0:
+		return +1
+	}
+	return tree.order.Compare(a, b)
+}
+
+func toLower(ch byte) byte {
+	if 'A' <= ch && ch <= 'Z' {
+		return ch + 'a' - 'A'
+	}
+	return ch
+}
+
+func compareNoCase(a []byte, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := toLower(a[i]), toLower(b[i])
+		if x != y {
+			return compareInt(int(x), int(y))
+		}
+	}
+	return compareInt(len(a), len(b))
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+func compareInt(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+// "a2" < "a10". the numbers that only differ by leading zeros are
+// ordered by bytes.Compare, so only identical keys are equal.
+func compareNatural(a []byte, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return compareInt(int(a[i]), int(b[j]))
+			}
+			i, j = i+1, j+1
+			continue
+		}
+		// 2 numbers, the longer one is bigger without the leading zeros
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+		x, y := bytes.TrimLeft(a[si:i], "0"), bytes.TrimLeft(b[sj:j], "0")
+		if len(x) != len(y) {
+			return compareInt(len(x), len(y))
+		}
+		if r := bytes.Compare(x, y); r != 0 {
+			return r
+		}
+	}
+	if r := compareInt(len(a)-i, len(b)-j); r != 0 {
+		return r
+	}
+	return bytes.Compare(a, b)
+}
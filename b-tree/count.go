@@ -0,0 +1,259 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// counting the keys of a range [start, end), an empty end is the end of
+// the tree. with TREE_COUNTS, each internal node entry stores the number
+// of keys under the kid node, so the number of keys before a key is the
+// sum of the counts of the kids left of the path to it, and the key at
+// a position is found by subtracting the counts on the way down.
+// without counts, the positions on the paths are scaled by the average
+// fan-out of the nodes on the paths to estimate the count.
+
+// the count of a kid node stored in an internal node
+func kidCount(node BNode, idx uint16) int {
+	return int(binary.LittleEndian.Uint64(node.getVal(idx)))
+}
+
+// the number of keys under a node, without the dummy key
+func (tree *BTree) nodeCount(node BNode) int {
+	switch node.btype() {
+	case BNODE_LEAF:
+		return leafRank(tree, node, nil, true)
+	case BNODE_NODE:
+		if tree.flags&TREE_COUNTS == 0 {
+			panic("tree counts are not enabled")
+		}
+		count := 0
+		for i := uint16(0); i < node.nkeys(); i++ {
+			count += kidCount(node, i)
+		}
+		return count
+	default:
+		panic("bad node!")
+	}
+}
+
+// the number of keys of a leaf before the key, or all of them.
+// the dummy key is not counted.
+func leafRank(tree *BTree, leaf BNode, key []byte, all bool) int {
+	n := int(leaf.nkeys())
+	if !all {
+		n = sort.Search(n, func(i int) bool {
+			return tree.compare(leaf.getKey(uint16(i)), key) >= 0
+		})
+	}
+	if n > 0 && len(leaf.getKey(0)) == 0 {
+		n--
+	}
+	return n
+}
+
+// a position in a node of the path to a key
+type rankStep struct {
+	node BNode
+	idx  uint16
+}
+
+// the path from the root to the leaf of the key, or of the end of the
+// tree if all is set. the position in the leaf is not included.
+func (tree *BTree) rankPath(key []byte, all bool) []rankStep {
+	path := []rankStep{}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := node.nkeys() - 1
+		if !all {
+			idx = nodeLookupLE(node, key, tree.compare)
+		}
+		path = append(path, rankStep{node, idx})
+		ptr = 0
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		}
+	}
+	return path
+}
+
+// the exact number of keys before the key
+func (tree *BTree) rank(key []byte, all bool) int {
+	path := tree.rankPath(key, all)
+	if len(path) == 0 {
+		return 0
+	}
+	rank := 0
+	for _, step := range path[:len(path)-1] {
+		for i := uint16(0); i < step.idx; i++ {
+			rank += kidCount(step.node, i)
+		}
+	}
+	return rank + leafRank(tree, path[len(path)-1].node, key, all)
+}
+
+// the exact number of keys in the range. it takes O(log n) with
+// TREE_COUNTS, otherwise the range is scanned.
+func (tree *BTree) Count(start []byte, end []byte) int {
+	all := len(end) == 0
+	if !all && tree.compare(start, end) >= 0 {
+		return 0
+	}
+	if tree.flags&TREE_COUNTS != 0 {
+		return tree.rank(end, all) - tree.rank(start, false)
+	}
+	count := 0
+	for iter := tree.Seek(start); iter.Valid(); iter.Next() {
+		if key, _ := iter.Deref(); !all && tree.compare(key, end) >= 0 {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// the approximate number of keys in the range and their size in bytes.
+// only the nodes on the paths to the 2 bounds are read.
+func (tree *BTree) EstimateRange(start []byte, end []byte) (int, int) {
+	all := len(end) == 0
+	if tree.root == 0 || (!all && tree.compare(start, end) >= 0) {
+		return 0, 0
+	}
+	paths := [2][]rankStep{tree.rankPath(start, false), tree.rankPath(end, all)}
+	height := len(paths[0])
+	// the averages of the nodes on the paths, the root is not typical
+	fanout, nodes := 0, 0
+	leafKeys, leafBytes := 0, 0
+	for _, path := range paths {
+		for level, step := range path {
+			node := step.node
+			switch {
+			case level == height-1:
+				leafKeys += leafRank(tree, node, nil, true)
+				leafBytes += int(node.getOffset(node.nkeys())) - 4*int(node.nkeys())
+			case level > 0 || height == 2:
+				fanout += int(node.nkeys())
+				nodes++
+			}
+		}
+	}
+	// the number of keys under a kid of a node at each level
+	kidKeys := make([]float64, height)
+	if height > 1 {
+		kidKeys[height-2] = float64(leafKeys) / 2
+	}
+	for level := height - 3; level >= 0; level-- {
+		kidKeys[level] = kidKeys[level+1] * float64(fanout) / float64(nodes)
+	}
+	bounds := [2]float64{}
+	for i, path := range paths {
+		for level, step := range path[:height-1] {
+			if tree.flags&TREE_COUNTS != 0 {
+				for j := uint16(0); j < step.idx; j++ {
+					bounds[i] += float64(kidCount(step.node, j))
+				}
+			} else {
+				bounds[i] += float64(step.idx) * kidKeys[level]
+			}
+		}
+	}
+	bounds[0] += float64(leafRank(tree, paths[0][height-1].node, start, false))
+	bounds[1] += float64(leafRank(tree, paths[1][height-1].node, end, all))
+	count := int(bounds[1] - bounds[0] + 0.5)
+	if count < 0 {
+		count = 0
+	}
+	size := 0
+	if leafKeys > 0 {
+		size = int(float64(count) * float64(leafBytes) / float64(leafKeys))
+	}
+	return count, size
+}
+
+// the exact number of keys in the range of the main tree
+func (db *KV) Count(start []byte, end []byte) int {
+	return db.tree.Count(start, end)
+}
+
+// the approximate number of keys in the range of the main tree and
+// their size in bytes, see BTree.EstimateRange
+func (db *KV) EstimateRange(start []byte, end []byte) (int, int) {
+	return db.tree.EstimateRange(start, end)
+}
+
+// the position of the key in the tree, the number of keys before it.
+// it takes O(height) with TREE_COUNTS.
+func (tree *BTree) Rank(key []byte) int {
+	if len(key) == 0 {
+		return 0 // not the end of the tree for Count
+	}
+	return tree.Count(nil, key)
+}
+
+// the iterator at the nth key from 0, invalid if there are not as many
+// keys. it takes O(height) with TREE_COUNTS, otherwise n keys are read.
+func (tree *BTree) SeekIndex(n int) *BIter {
+	if n < 0 {
+		return &BIter{}
+	}
+	if tree.flags&TREE_COUNTS == 0 {
+		iter := tree.Seek(nil)
+		for ; n > 0 && iter.Valid(); n-- {
+			iter.Next()
+		}
+		return iter
+	}
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := uint16(0)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if len(node.getKey(0)) == 0 {
+				n++ // the dummy key
+			}
+			if n >= int(node.nkeys()) {
+				return &BIter{}
+			}
+			idx, ptr = uint16(n), 0
+		case BNODE_NODE:
+			for ; idx < node.nkeys() && n >= kidCount(node, idx); idx++ {
+				n -= kidCount(node, idx)
+			}
+			if idx == node.nkeys() {
+				return &BIter{} // past the last key
+			}
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+	}
+	return iter
+}
+
+// the nth key from 0 and its value
+func (tree *BTree) Select(n int) ([]byte, []byte, bool) {
+	iter := tree.SeekIndex(n)
+	if !iter.Valid() {
+		return nil, nil, false
+	}
+	key, val := iter.Deref()
+	return key, val, true
+}
+
+// the position of the key in the main tree, see BTree.Rank
+func (db *KV) Rank(key []byte) int {
+	return db.tree.Rank(key)
+}
+
+// the nth key of the main tree, see BTree.Select
+func (db *KV) Select(n int) ([]byte, []byte, bool) {
+	return db.tree.Select(n)
+}
+
+// iterate the main tree from the nth key, see BTree.SeekIndex
+func (db *KV) SeekIndex(n int) *BIter {
+	return db.tree.SeekIndex(n)
+}
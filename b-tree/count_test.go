@@ -0,0 +1,153 @@
+package b_tree
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// a tree of random keys, the values are vlen bytes or of random sizes
+// if vlen is negative. returns the sorted keys and the values.
+func randomTree(t *testing.T, config KV, n int, vlen int, rng *rand.Rand) (*KV, []string, map[string]string) {
+	t.Helper()
+	config.Path = t.TempDir() + "/count.db"
+	db := testOpen(t, &config)
+	kvs := map[string]string{}
+	ops := []BatchOp{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%06d", rng.Intn(10*n))
+		size := vlen
+		if size < 0 {
+			size = rng.Intn(100)
+		}
+		val := fmt.Sprintf("%0*d", size, i)[:size]
+		ops = append(ops, BatchOp{Key: []byte(key), Val: []byte(val)})
+		kvs[key] = val
+	}
+	if err := db.WriteBatch(ops); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return db, keys, kvs
+}
+
+// the keys of [start, end) and their size, an empty end is the end
+func scanRange(keys []string, kvs map[string]string, start string, end string) (int, int) {
+	count, size := 0, 0
+	for _, key := range keys {
+		if key >= start && (end == "" || key < end) {
+			count++
+			size += len(key) + len(kvs[key])
+		}
+	}
+	return count, size
+}
+
+// the error of an estimate relative to the total
+func estimateError(est int, exact int, total int) float64 {
+	if total == 0 {
+		return float64(est)
+	}
+	return math.Abs(float64(est-exact)) / float64(total)
+}
+
+func TestCount(t *testing.T) {
+	for _, config := range []KV{{}, {Counts: true}, {Counts: true, Hashes: true, Prefix: true}} {
+		rng := rand.New(rand.NewSource(1))
+		for _, n := range []int{0, 1, 100, 20000} {
+			for _, vlen := range []int{-1, 20} {
+				db, keys, kvs := randomTree(t, config, n, vlen, rng)
+				total, totalSize := scanRange(keys, kvs, "", "")
+				height := db.Stats().Tree.Height
+				for i := 0; i < 200; i++ {
+					start, end := fmt.Sprintf("key%06d", rng.Intn(10*n+1)), fmt.Sprintf("key%06d", rng.Intn(10*n+1))
+					switch i % 5 {
+					case 0:
+						start = ""
+					case 1:
+						end = ""
+					}
+					count, size := scanRange(keys, kvs, start, end)
+					if got := db.Count([]byte(start), []byte(end)); got != count {
+						t.Fatalf("Count(%q, %q) = %d, want %d", start, end, got, count)
+					}
+					// exact with the counts or a single leaf. otherwise the keys
+					// of the leaves on the paths stand for all the leaves, the
+					// error depends on how full they are.
+					est, estSize := db.EstimateRange([]byte(start), []byte(end))
+					maxErr, maxSizeErr := 0.5, 0.5
+					if config.Counts || height <= 1 {
+						maxErr, maxSizeErr = 0, 0.15
+					}
+					if vlen >= 0 && maxErr == 0 {
+						maxSizeErr = 0 // the same size for every key
+					}
+					if e := estimateError(est, count, total); e > maxErr {
+						t.Fatalf("EstimateRange(%q, %q) = %d keys, want %d of %d", start, end, est, count, total)
+					}
+					if e := estimateError(estSize, size, totalSize); e > maxSizeErr {
+						t.Fatalf("EstimateRange(%q, %q) = %d bytes, want %d of %d", start, end, estSize, size, totalSize)
+					}
+				}
+				db.Close()
+			}
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	for _, config := range []KV{{}, {Counts: true}, {Counts: true, Hashes: true, Prefix: true}} {
+		rng := rand.New(rand.NewSource(1))
+		for _, n := range []int{0, 1, 100, 5000} {
+			db, keys, kvs := randomTree(t, config, n, -1, rng)
+			// the keys in the tree, between them and past the ends
+			probes := append([]string{"", "a", "z"}, keys...)
+			for i := 0; i < 100; i++ {
+				probes = append(probes, fmt.Sprintf("key%06d", rng.Intn(10*n+1)))
+			}
+			for _, key := range probes {
+				want := sort.SearchStrings(keys, key)
+				if got := db.Rank([]byte(key)); got != want {
+					t.Fatalf("Rank(%q) = %d, want %d", key, got, want)
+				}
+			}
+			for i := -1; i <= len(keys); i++ {
+				key, val, ok := db.Select(i)
+				if i < 0 || i == len(keys) {
+					if ok {
+						t.Fatalf("Select(%d) = %q of %d keys", i, key, len(keys))
+					}
+					continue
+				}
+				if !ok || string(key) != keys[i] || string(val) != kvs[keys[i]] {
+					t.Fatalf("Select(%d) = %q %q %v, want %q", i, key, val, ok, keys[i])
+				}
+			}
+			// iterate from random positions
+			for i := 0; i < 20 && n > 0; i++ {
+				pos := rng.Intn(len(keys))
+				end := pos + 50
+				if end > len(keys) {
+					end = len(keys)
+				}
+				iter := db.SeekIndex(pos)
+				for _, want := range keys[pos:end] {
+					if !iter.Valid() {
+						t.Fatalf("SeekIndex(%d) ends before %q", pos, want)
+					}
+					if key, _ := iter.Deref(); string(key) != want {
+						t.Fatalf("SeekIndex(%d): %q, want %q", pos, key, want)
+					}
+					iter.Next()
+				}
+			}
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package b_tree
+
+// deleting the keys of a range [start, end), an empty end is the end of
+// the tree. the range is covered by the kids between the paths to its 2
+// bounds. a kid whose separators are both in the range is dropped with
+// all its pages, only the kids on the 2 paths are rewritten. the kid
+// left of a dropped kid covers its keys afterwards, there are none.
+
+// a kid of the node being rewritten
+type rangeKid struct {
+	key  []byte
+	ptr  uint64 // the unchanged kid
+	val  []byte
+	node BNode // the rewritten kid, not allocated yet
+}
+
+// free the pages of a subtree, returns the number of keys.
+// the height of a leaf is 0. with TREE_COUNTS, the leaves are not read.
+func (tree *BTree) dropSubtree(ptr uint64, height int) int {
+	node := tree.get(ptr)
+	tree.del(ptr)
+	if height == 0 {
+		return tree.nodeCount(node)
+	}
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if height == 1 && tree.flags&TREE_COUNTS != 0 {
+			tree.del(node.getPtr(i))
+			count += kidCount(node, i)
+		} else {
+			count += tree.dropSubtree(node.getPtr(i), height-1)
+		}
+	}
+	return count
+}
+
+// delete the keys of the range from a subtree whose keys are after lo,
+// before hi if it's not nil. the first subtree also has the dummy key.
+// returns the new node or nothing if unchanged, and the number of keys.
+func treeDeleteRange(
+	tree *BTree, node BNode, height int,
+	start []byte, end []byte, lo []byte, hi []byte, first bool,
+) (BNode, int) {
+	all := len(end) == 0
+	if node.btype() == BNODE_LEAF {
+		// the dummy key is never in the range
+		inRange := func(key []byte) bool {
+			return len(key) > 0 && tree.compare(key, start) >= 0 &&
+				(all || tree.compare(key, end) < 0)
+		}
+		nkeys := uint16(0)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if !inRange(node.getKey(i)) {
+				nkeys++
+			}
+		}
+		count := int(node.nkeys() - nkeys)
+		if count == 0 {
+			return BNode{}, 0
+		}
+		new := nodeAlloc(node.nbytes())
+		new.setHeader(BNODE_LEAF, nkeys)
+		j := uint16(0)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if key := node.getKey(i); !inRange(key) {
+				nodeAppendKV(new, j, 0, key, node.getVal(i))
+				j++
+			}
+		}
+		return new, count
+	}
+	kids := []rangeKid{}
+	count := 0
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kid := rangeKid{key: node.getKey(i), ptr: node.getPtr(i), val: node.getVal(i)}
+		klo, khi := lo, hi
+		if i > 0 {
+			klo = node.getKey(i)
+		}
+		if i+1 < node.nkeys() {
+			khi = node.getKey(i + 1)
+		}
+		kfirst := first && i == 0
+		switch {
+		case (khi != nil && tree.compare(khi, start) <= 0) ||
+			(!all && tree.compare(klo, end) >= 0):
+			// outside of the range
+		case !kfirst && tree.compare(klo, start) >= 0 &&
+			(all || (khi != nil && tree.compare(khi, end) <= 0)):
+			// inside of the range
+			if height == 1 && tree.flags&TREE_COUNTS != 0 {
+				tree.del(kid.ptr)
+				count += kidCount(node, i)
+			} else {
+				count += tree.dropSubtree(kid.ptr, height-1)
+			}
+			continue
+		default:
+			updated, n := treeDeleteRange(
+				tree, tree.get(kid.ptr), height-1, start, end, klo, khi, kfirst)
+			if n == 0 {
+				break
+			}
+			tree.del(kid.ptr)
+			count += n
+			if updated.nkeys() == 0 {
+				continue // empty
+			}
+			kid.node = updated
+		}
+		kids = append(kids, kid)
+	}
+	if count == 0 {
+		return BNode{}, 0
+	}
+	kids = mergeRangeKids(tree, kids)
+	new := nodeAlloc(node.nbytes())
+	new.setHeader(BNODE_NODE, uint16(len(kids)))
+	for i, kid := range kids {
+		if i == 0 {
+			kid.key = node.getKey(0) // the lower bound of the node
+		}
+		if kid.node.data != nil {
+			kid.ptr, kid.val = tree.new(kid.node), tree.kidVal(kid.node)
+		}
+		nodeAppendKV(new, uint16(i), kid.ptr, kid.key, kid.val)
+	}
+	return new, count
+}
+
+// merge the underfull rewritten kids with a sibling, see shouldMerge
+func mergeRangeKids(tree *BTree, kids []rangeKid) []rangeKid {
+	for i := 0; i < len(kids); i++ {
+		kid := kids[i]
+		if kid.node.data == nil || tree.nodeBytes(kid.node) > tree.fillMin() {
+			continue
+		}
+		for _, j := range []int{i - 1, i + 1} {
+			if j < 0 || j >= len(kids) {
+				continue
+			}
+			left, right := i, j
+			if j < i {
+				left, right = j, i
+			}
+			lnode, rnode := kids[left].node, kids[right].node
+			if lnode.data == nil {
+				lnode = tree.get(kids[left].ptr)
+			}
+			if rnode.data == nil {
+				rnode = tree.get(kids[right].ptr)
+			}
+			if !tree.mergeFits(lnode, rnode, kids[right].key) {
+				continue
+			}
+			merged := nodeAlloc(lnode.nbytes() + rnode.nbytes() + BTREE_MAX_KEY_SIZE)
+			nodeMerge(merged, lnode, rnode, kids[right].key)
+			if kids[j].node.data == nil {
+				tree.del(kids[j].ptr) // the unchanged sibling
+			}
+			kids[left] = rangeKid{key: kids[left].key, node: nodeTrim(merged)}
+			kids = append(kids[:right], kids[right+1:]...)
+			i = left - 1 // check the merged node again
+			break
+		}
+	}
+	return kids
+}
+
+// delete the keys of the range, returns the number of deleted keys
+func (tree *BTree) DeleteRange(start []byte, end []byte) int {
+	if tree.root == 0 || (len(end) > 0 && tree.compare(start, end) >= 0) {
+		return 0
+	}
+	height := 0
+	for node := tree.get(tree.root); node.btype() == BNODE_NODE; height++ {
+		node = tree.get(node.getPtr(0))
+	}
+	updated, count := treeDeleteRange(
+		tree, tree.get(tree.root), height, start, end, nil, nil, true)
+	if count == 0 {
+		return 0
+	}
+	tree.del(tree.root)
+	if updated.btype() == BNODE_LEAF || updated.nkeys() > 1 {
+		tree.root = tree.new(updated)
+		return count
+	}
+	// remove the levels of a single kid
+	tree.root = updated.getPtr(0)
+	for node := tree.get(tree.root); node.btype() == BNODE_NODE && node.nkeys() == 1; {
+		tree.del(tree.root)
+		tree.root = node.getPtr(0)
+		node = tree.get(tree.root)
+	}
+	return count
+}
+
+// delete the keys of the range from the main tree
+func (db *KV) DeleteRange(start []byte, end []byte) (int, error) {
+	db.checkNoTx()
+	count := db.tree.DeleteRange(start, end)
+	return count, flushPages(db)
+}
@@ -0,0 +1,136 @@
+package b_tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// check the counts and the hashes of the kids stored in the internal
+// nodes against the kids
+func checkKids(t *testing.T, tree *BTree) {
+	t.Helper()
+	var walk func(ptr uint64) int
+	walk = func(ptr uint64) int {
+		node := tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			return leafRank(tree, node, nil, true)
+		}
+		count := 0
+		for i := uint16(0); i < node.nkeys(); i++ {
+			kid := tree.get(node.getPtr(i))
+			n := walk(node.getPtr(i))
+			if tree.flags&TREE_COUNTS != 0 && kidCount(node, i) != n {
+				t.Fatalf("node %d: kid %d has %d keys, not %d", ptr, i, n, kidCount(node, i))
+			}
+			if tree.flags&TREE_HASHES != 0 && !bytes.Equal(kidHash(node, i), nodeHash(kid)) {
+				t.Fatalf("node %d: bad hash of kid %d", ptr, i)
+			}
+			count += n
+		}
+		return count
+	}
+	if tree.root != 0 {
+		walk(tree.root)
+	}
+}
+
+// the sorted keys of the map
+func sortedKeys(kvs map[string]bool) []string {
+	keys := []string{}
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeleteRange(t *testing.T) {
+	configs := []KV{{}, {Counts: true}, {Hashes: true}, {Prefix: true}, {Counts: true, Hashes: true, Prefix: true}}
+	for _, config := range configs {
+		path := t.TempDir() + "/range.db"
+		config.Path = path
+		db := testOpen(t, &config)
+		rng := rand.New(rand.NewSource(1))
+		kvs := map[string]bool{}
+		randKey := func() string {
+			return fmt.Sprintf("key%05d", rng.Intn(20000))
+		}
+		check := func() {
+			t.Helper()
+			checkTree(t, &db.tree)
+			checkKids(t, &db.tree)
+			checkKeys(t, db, sortedKeys(kvs))
+			checkPages(t, db)
+		}
+		for round := 0; round < 100; round++ {
+			ops := []BatchOp{}
+			for i := rng.Intn(500); i > 0; i-- {
+				key := randKey()
+				ops = append(ops, BatchOp{Key: []byte(key), Val: []byte("v" + key)})
+				kvs[key] = true
+			}
+			if err := db.WriteBatch(ops); err != nil {
+				t.Fatal(err)
+			}
+			var start, end []byte
+			switch rng.Intn(6) {
+			case 0:
+				start = nil // the first subtree, with the dummy key
+			case 1:
+				start = []byte("") // the same
+			default:
+				start = []byte(randKey())
+			}
+			switch rng.Intn(6) {
+			case 0:
+				end = nil // the end of the tree
+			case 1:
+				end = []byte{}
+			case 2:
+				end = append(append([]byte(nil), start...), 0) // maybe a single key
+			default:
+				end = []byte(randKey())
+			}
+			want := 0
+			for key := range kvs {
+				if key >= string(start) && (len(end) == 0 || key < string(end)) {
+					delete(kvs, key)
+					want++
+				}
+			}
+			count, err := db.DeleteRange(start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != want {
+				t.Fatalf("DeleteRange(%q, %q) = %d, want %d", start, end, count, want)
+			}
+			check()
+		}
+		// all the keys
+		count, err := db.DeleteRange(nil, nil)
+		if err != nil || count != len(kvs) {
+			t.Fatalf("deleted %d of %d keys: %v", count, len(kvs), err)
+		}
+		kvs = map[string]bool{}
+		check()
+		if count, _ := db.DeleteRange(nil, nil); count != 0 {
+			t.Fatalf("deleted %d keys of an empty tree", count)
+		}
+		for i := 0; i < 1000; i++ {
+			key := randKey()
+			if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = true
+		}
+		check()
+		db.Close()
+		db = testOpen(t, &KV{Path: path})
+		check()
+		db.Close()
+	}
+}
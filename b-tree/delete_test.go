@@ -0,0 +1,131 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// the leaves of a tree from left to right
+func treeLeaves(tree *BTree) []BNode {
+	leaves := []BNode{}
+	var walk func(node BNode)
+	walk = func(node BNode) {
+		if node.btype() == BNODE_LEAF {
+			leaves = append(leaves, node)
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			walk(tree.get(node.getPtr(i)))
+		}
+	}
+	if tree.root != 0 {
+		walk(tree.get(tree.root))
+	}
+	return leaves
+}
+
+func TestMinFillConfig(t *testing.T) {
+	for _, fill := range []float64{-0.1, 0.51, 1} {
+		db := &KV{Path: t.TempDir() + "/fill.db", MinFill: fill}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("opened with MinFill %v", fill)
+		}
+	}
+	for fill, want := range map[float64]int{0: BTREE_PAGE_SIZE / 4, 0.1: BTREE_PAGE_SIZE / 10, 0.5: BTREE_PAGE_SIZE / 2} {
+		db := testOpen(t, &KV{Path: t.TempDir() + "/fill.db", MinFill: fill})
+		if got := db.tree.fillMin(); got != want {
+			t.Fatalf("MinFill %v: %d bytes, want %d", fill, got, want)
+		}
+		db.Close()
+	}
+}
+
+// 2 leaves, the keys are deleted from the left one. the left leaf takes
+// keys from the right one until both fit in a page.
+func TestRedistribute(t *testing.T) {
+	for _, fill := range []float64{0, 0.4, 0.5} {
+		db := testOpen(t, &KV{Path: t.TempDir() + "/fill.db", MinFill: fill})
+		keys := []string{}
+		for i := 0; i < 35; i++ {
+			key := fmt.Sprintf("key%03d%0100d", i, 0)
+			if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		leaves := treeLeaves(&db.tree)
+		if len(leaves) != 2 {
+			t.Fatalf("%d leaves", len(leaves))
+		}
+		split := string(leaves[1].getKey(0))
+		borrowed := false
+		for len(keys) > 0 {
+			first := treeLeaves(&db.tree)[0]
+			if _, err := db.Del(first.getKey(1)); err != nil {
+				t.Fatal(err)
+			}
+			keys = keys[1:]
+			leaves := treeLeaves(&db.tree)
+			if len(leaves) == 1 {
+				checkKeys(t, db, keys)
+				break // merged when the keys fit in a page
+			}
+			for i, leaf := range leaves {
+				// within an entry of an even split
+				if size := db.tree.nodeBytes(leaf); size < db.tree.fillMin()-250 {
+					t.Fatalf("MinFill %v: leaf %d of %d bytes", fill, i, size)
+				}
+			}
+			// the separator is between the leaves
+			sep := string(db.tree.get(db.tree.root).getKey(1))
+			last := string(leaves[0].getKey(leaves[0].nkeys() - 1))
+			if !(last < sep && sep <= string(leaves[1].getKey(0))) {
+				t.Fatalf("separator %.10q of the leaves %.10q and %.10q", sep, last, leaves[1].getKey(0))
+			}
+			if string(leaves[1].getKey(0)) > split {
+				borrowed = true // the right leaf lost its first keys
+			}
+			checkTree(t, &db.tree)
+		}
+		if !borrowed {
+			t.Fatalf("MinFill %v: no keys are moved to the left leaf", fill)
+		}
+		db.Close()
+	}
+}
+
+// the pages are fuller after many deletes with a higher MinFill
+func TestDeleteFill(t *testing.T) {
+	util := map[float64]float64{}
+	for _, fill := range []float64{0.1, 0.5} {
+		db := testOpen(t, &KV{Path: t.TempDir() + "/fill.db", MinFill: fill})
+		rng := rand.New(rand.NewSource(1))
+		kvs := map[string]bool{}
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%05d%0*d", rng.Intn(100000), rng.Intn(100), 0)
+			if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = true
+		}
+		for _, key := range sortedKeys(kvs) {
+			if rng.Intn(5) == 0 {
+				continue
+			}
+			if ok, err := db.Del([]byte(key)); err != nil || !ok {
+				t.Fatalf("Del(%q) = %v %v", key, ok, err)
+			}
+			delete(kvs, key)
+		}
+		checkTree(t, &db.tree)
+		checkKeys(t, db, sortedKeys(kvs))
+		checkPages(t, db)
+		util[fill] = db.Utilization()
+		db.Close()
+	}
+	if util[0.5] <= util[0.1] {
+		t.Fatalf("utilization %v", util)
+	}
+}
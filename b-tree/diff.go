@@ -0,0 +1,215 @@
+package b_tree
+
+import "bytes"
+
+// the differences between two versions of a tree that share pages.
+// both trees are walked in key order from a stack of pending items,
+// a pending item is either a subtree or a KV pair. when both sides are
+// at the same page pointer, or at the same hash with TREE_HASHES,
+// the whole subtree is skipped.
+
+const (
+	DIFF_ADDED   = 1 // only in the newer tree
+	DIFF_REMOVED = 2 // only in the older tree
+	DIFF_CHANGED = 3 // in both trees with different values
+)
+
+type DiffEntry struct {
+	Kind int
+	Key  []byte
+	Old  []byte // nil if added
+	New  []byte // nil if removed
+}
+
+type diffItem struct {
+	ptr    uint64 // a subtree if nonzero, otherwise a KV pair
+	height int    // of the subtree, 0 for leaf pages
+	key    []byte // the first key or a lower bound of the subtree
+	val    []byte
+	hash   []byte // of the subtree, with TREE_HASHES
+}
+
+type diffSide struct {
+	tree  *BTree
+	stack []diffItem // the next item is on the top
+}
+
+type DiffIter struct {
+	old   diffSide
+	new   diffSide
+	same  bool // both trees are in the same file
+	cur   DiffEntry
+	valid bool
+}
+
+func diffSideInit(tree *BTree) diffSide {
+	side := diffSide{tree: tree}
+	if tree.root == 0 {
+		return side
+	}
+	// all leaves are at the same depth
+	height := 0
+	for node := tree.get(tree.root); node.btype() == BNODE_NODE; height++ {
+		node = tree.get(node.getPtr(0))
+	}
+	item := diffItem{ptr: tree.root, height: height}
+	if tree.flags&TREE_HASHES != 0 {
+		item.hash = nodeHash(tree.get(tree.root))
+	}
+	side.stack = append(side.stack, item)
+	return side
+}
+
+// replace the subtree on the top with its items
+func (side *diffSide) expand() {
+	top := side.stack[len(side.stack)-1]
+	side.stack = side.stack[:len(side.stack)-1]
+	node := side.tree.get(top.ptr)
+	for i := int(node.nkeys()) - 1; i >= 0; i-- {
+		idx := uint16(i)
+		key := node.getKey(idx)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if len(key) > 0 { // skip the dummy key
+				side.stack = append(side.stack, diffItem{key: key, val: node.getVal(idx)})
+			}
+		case BNODE_NODE:
+			if idx == 0 {
+				key = top.key // the lower bound of the node
+			}
+			item := diffItem{ptr: node.getPtr(idx), height: top.height - 1, key: key}
+			if side.tree.flags&TREE_HASHES != 0 {
+				item.hash = kidHash(node, idx)
+			}
+			side.stack = append(side.stack, item)
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+func (side *diffSide) top() *diffItem {
+	if len(side.stack) == 0 {
+		return nil
+	}
+	return &side.stack[len(side.stack)-1]
+}
+
+func (side *diffSide) pop() diffItem {
+	top := side.stack[len(side.stack)-1]
+	side.stack = side.stack[:len(side.stack)-1]
+	return top
+}
+
+// iterate the changes from the old tree to the new tree
+func treeDiff(old *BTree, new *BTree, same bool) *DiffIter {
+	iter := &DiffIter{old: diffSideInit(old), new: diffSideInit(new), same: same}
+	iter.Next()
+	return iter
+}
+
+// the changes from this version to a newer version.
+// the versions can be from different files, such as replicas,
+// only the subtrees with different hashes are read in that case.
+func (view *KVView) Diff(newer *KVView) *DiffIter {
+	return treeDiff(&view.tree, &newer.tree, view.db == newer.db)
+}
+
+// the same subtree on both sides
+func (iter *DiffIter) sameTree(a *diffItem, b *diffItem) bool {
+	if a.ptr == 0 || b.ptr == 0 {
+		return false
+	}
+	if iter.same && a.ptr == b.ptr {
+		return true
+	}
+	return a.hash != nil && b.hash != nil && bytes.Equal(a.hash, b.hash)
+}
+
+func (iter *DiffIter) Valid() bool {
+	return iter.valid
+}
+
+func (iter *DiffIter) Deref() DiffEntry {
+	return iter.cur
+}
+
+// both trees are in the same key order
+func (iter *DiffIter) compare(a []byte, b []byte) int {
+	return iter.old.tree.compare(a, b)
+}
+
+// move to the next difference
+func (iter *DiffIter) Next() {
+	iter.valid = false
+	for !iter.valid {
+		a, b := iter.old.top(), iter.new.top()
+		switch {
+		case a == nil && b == nil:
+			return // done
+		case a == nil:
+			iter.emitOne(&iter.new, DIFF_ADDED)
+		case b == nil:
+			iter.emitOne(&iter.old, DIFF_REMOVED)
+		case iter.sameTree(a, b):
+			// nothing changed in this subtree
+			iter.old.pop()
+			iter.new.pop()
+		case a.ptr != 0 && b.ptr != 0:
+			cmp := iter.compare(a.key, b.key)
+			switch {
+			case cmp < 0 || (cmp == 0 && a.height > b.height):
+				iter.old.expand()
+			case cmp > 0 || (cmp == 0 && a.height < b.height):
+				iter.new.expand()
+			default:
+				iter.old.expand()
+				iter.new.expand()
+			}
+		case a.ptr != 0:
+			// the subtree may contain keys before the KV
+			if iter.compare(a.key, b.key) <= 0 {
+				iter.old.expand()
+			} else {
+				iter.emitOne(&iter.new, DIFF_ADDED)
+			}
+		case b.ptr != 0:
+			if iter.compare(b.key, a.key) <= 0 {
+				iter.new.expand()
+			} else {
+				iter.emitOne(&iter.old, DIFF_REMOVED)
+			}
+		default:
+			// 2 KV pairs
+			cmp := iter.compare(a.key, b.key)
+			switch {
+			case cmp < 0:
+				iter.emitOne(&iter.old, DIFF_REMOVED)
+			case cmp > 0:
+				iter.emitOne(&iter.new, DIFF_ADDED)
+			default:
+				x, y := iter.old.pop(), iter.new.pop()
+				if !bytes.Equal(x.val, y.val) {
+					iter.cur = DiffEntry{Kind: DIFF_CHANGED, Key: x.key, Old: x.val, New: y.val}
+					iter.valid = true
+				}
+			}
+		}
+	}
+}
+
+// a KV pair that only exists on one side, or a subtree to expand.
+func (iter *DiffIter) emitOne(side *diffSide, kind int) {
+	if side.top().ptr != 0 {
+		side.expand()
+		return
+	}
+	item := side.pop()
+	iter.cur = DiffEntry{Kind: kind, Key: item.key}
+	if kind == DIFF_ADDED {
+		iter.cur.New = item.val
+	} else {
+		iter.cur.Old = item.val
+	}
+	iter.valid = true
+}
@@ -0,0 +1,140 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// freed pages are kept in a list until no root in the history uses them.
+// the list is rewritten to new pages for each commit.
+//
+// the free list page format, pages are chained by the next pointer.
+// | type | count | unused | next | ptr-seq pairs |
+// |  2B  |  2B   |   4B   |  8B  | count * 16B   |
+// a zero seq means the page can be reused right away,
+// the FREE_SHARED bit marks the pages that wait for a GC.
+
+const BNODE_FREE = 3
+
+const FREE_LIST_HEADER = 16
+const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 16
+
+const FREE_SHARED = 1 << 63
+
+type freeEntry struct {
+	ptr uint64
+	seq uint64 // the commit that freed the page
+}
+
+// read the persisted free list
+func freeListLoad(db *KV) error {
+	entries := []freeEntry{}
+	for ptr := db.meta.free; ptr != 0; {
+		node := db.pageRead(ptr)
+		if binary.LittleEndian.Uint16(node.data) != BNODE_FREE {
+			return errors.New("Bad free list page.")
+		}
+		count := int(binary.LittleEndian.Uint16(node.data[2:]))
+		for i := 0; i < count; i++ {
+			pos := FREE_LIST_HEADER + 16*i
+			entries = append(entries, freeEntry{
+				ptr: binary.LittleEndian.Uint64(node.data[pos:]),
+				seq: binary.LittleEndian.Uint64(node.data[pos+8:]),
+			})
+		}
+		db.meta.pages = append(db.meta.pages, ptr)
+		ptr = binary.LittleEndian.Uint64(node.data[8:])
+	}
+	for _, e := range entries {
+		if e.seq == 0 {
+			db.page.ready = append(db.page.ready, e.ptr)
+		} else if e.seq&FREE_SHARED != 0 {
+			e.seq &^= FREE_SHARED
+			db.page.shared = append(db.page.shared, e)
+		} else {
+			db.page.held = append(db.page.held, e)
+		}
+	}
+	freeListRelease(db)
+	return nil
+}
+
+// write the free list to new pages.
+// it must be done after all other page allocations of the commit.
+func freeListStore(db *KV) {
+	// the pages for the list itself are taken from the list
+	ptrs := []uint64{}
+	for {
+		total := len(db.page.ready) + len(db.page.retired) +
+			len(db.page.held) + len(db.page.shared)
+		if len(ptrs)*FREE_LIST_CAP >= total {
+			break
+		}
+		ptrs = append(ptrs, db.pageAlloc())
+	}
+	npages := len(ptrs)
+
+	entries := []freeEntry{}
+	for _, ptr := range db.page.ready {
+		entries = append(entries, freeEntry{ptr: ptr})
+	}
+	for _, ptr := range db.page.retired {
+		entries = append(entries, freeEntry{ptr: ptr})
+	}
+	entries = append(entries, db.page.held...)
+	for _, e := range db.page.shared {
+		entries = append(entries, freeEntry{ptr: e.ptr, seq: e.seq | FREE_SHARED})
+	}
+
+	for i, ptr := range ptrs {
+		chunk := entries[i*FREE_LIST_CAP:]
+		if len(chunk) > FREE_LIST_CAP {
+			chunk = chunk[:FREE_LIST_CAP]
+		}
+		next := uint64(0)
+		if i+1 < npages {
+			next = ptrs[i+1]
+		}
+		data := make([]byte, BTREE_PAGE_SIZE)
+		binary.LittleEndian.PutUint16(data[0:], BNODE_FREE)
+		binary.LittleEndian.PutUint16(data[2:], uint16(len(chunk)))
+		binary.LittleEndian.PutUint64(data[8:], next)
+		for j, e := range chunk {
+			pos := FREE_LIST_HEADER + 16*j
+			binary.LittleEndian.PutUint64(data[pos:], e.ptr)
+			binary.LittleEndian.PutUint64(data[pos+8:], e.seq)
+		}
+		db.page.updates[ptr] = data
+	}
+	db.meta.free = 0
+	if npages > 0 {
+		db.meta.free = ptrs[0]
+	}
+	db.meta.pages = append(db.meta.pages, ptrs...)
+}
+
+// move the pages that are no longer used by any root to the ready list.
+// called after a commit is durable.
+func freeListRelease(db *KV) {
+	db.page.ready = append(db.page.ready, db.page.retired...)
+	db.page.retired = db.page.retired[:0]
+	oldest := historyOldest(db)
+	i := 0
+	for i < len(db.page.held) && db.page.held[i].seq <= oldest {
+		db.page.ready = append(db.page.ready, db.page.held[i].ptr)
+		i++
+	}
+	db.page.held = db.page.held[i:]
+}
+
+// number of freed pages, including those held back by the root history
+func (db *KV) freeListLen() int {
+	return len(db.page.ready) + len(db.page.held) + len(db.page.shared)
+}
+
+func sortFreeEntries(entries []freeEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+}
@@ -0,0 +1,92 @@
+package b_tree
+
+// lookups of the keys next to a key. they use the iterators, which skip
+// the dummy key and move across the leaves. like BTree.Get, the results
+// point into the pages, they must be copied to be kept or modified.
+
+// the KV at the iterator, false if it is out of the range
+func iterKV(iter *BIter) ([]byte, []byte, bool) {
+	if !iter.Valid() {
+		return nil, nil, false
+	}
+	key, val := iter.Deref()
+	return key, val, true
+}
+
+// the iterator at the last key
+func (tree *BTree) seekLast() *BIter {
+	iter := &BIter{tree: tree}
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		ptr = 0
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		}
+	}
+	return iter
+}
+
+// the smallest key
+func (tree *BTree) First() ([]byte, []byte, bool) {
+	return iterKV(tree.Seek(nil))
+}
+
+// the largest key
+func (tree *BTree) Last() ([]byte, []byte, bool) {
+	return iterKV(tree.seekLast())
+}
+
+// the largest key less than or equal to the key
+func (tree *BTree) Floor(key []byte) ([]byte, []byte, bool) {
+	return iterKV(tree.SeekLE(key))
+}
+
+// the smallest key greater than or equal to the key
+func (tree *BTree) Ceiling(key []byte) ([]byte, []byte, bool) {
+	return iterKV(tree.Seek(key))
+}
+
+// the largest key less than the key
+func (tree *BTree) Lower(key []byte) ([]byte, []byte, bool) {
+	iter := tree.SeekLE(key)
+	if cur, _, ok := iterKV(iter); ok && tree.compare(cur, key) == 0 {
+		iter.Prev()
+	}
+	return iterKV(iter)
+}
+
+// the smallest key greater than the key
+func (tree *BTree) Higher(key []byte) ([]byte, []byte, bool) {
+	iter := tree.Seek(key)
+	if cur, _, ok := iterKV(iter); ok && tree.compare(cur, key) == 0 {
+		iter.Next()
+	}
+	return iterKV(iter)
+}
+
+func (db *KV) First() ([]byte, []byte, bool) {
+	return db.tree.First()
+}
+
+func (db *KV) Last() ([]byte, []byte, bool) {
+	return db.tree.Last()
+}
+
+func (db *KV) Floor(key []byte) ([]byte, []byte, bool) {
+	return db.tree.Floor(key)
+}
+
+func (db *KV) Ceiling(key []byte) ([]byte, []byte, bool) {
+	return db.tree.Ceiling(key)
+}
+
+func (db *KV) Lower(key []byte) ([]byte, []byte, bool) {
+	return db.tree.Lower(key)
+}
+
+func (db *KV) Higher(key []byte) ([]byte, []byte, bool) {
+	return db.tree.Higher(key)
+}
@@ -0,0 +1,86 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// the neighbour lookups against the sorted keys
+func checkLookups(t *testing.T, db *KV, keys []string, kvs map[string]string, probes []string) {
+	t.Helper()
+	// the key at i, false if it is out of the range
+	at := func(i int) (string, bool) {
+		if i < 0 || i >= len(keys) {
+			return "", false
+		}
+		return keys[i], true
+	}
+	check := func(name string, probe string, key []byte, val []byte, ok bool, want string, found bool) {
+		t.Helper()
+		if ok != found || string(key) != want || (ok && string(val) != kvs[want]) {
+			t.Fatalf("%s(%q) = %q %q %v, want %q %v", name, probe, key, val, ok, want, found)
+		}
+	}
+	key, val, ok := db.First()
+	want, found := at(0)
+	check("First", "", key, val, ok, want, found)
+	key, val, ok = db.Last()
+	want, found = at(len(keys) - 1)
+	check("Last", "", key, val, ok, want, found)
+	for _, probe := range probes {
+		i := sort.SearchStrings(keys, probe) // the first key >= probe
+		exact := i < len(keys) && keys[i] == probe
+		floor, higher := i-1, i
+		if exact {
+			floor, higher = i, i+1
+		}
+		key, val, ok = db.Floor([]byte(probe))
+		want, found = at(floor)
+		check("Floor", probe, key, val, ok, want, found)
+		key, val, ok = db.Ceiling([]byte(probe))
+		want, found = at(i)
+		check("Ceiling", probe, key, val, ok, want, found)
+		key, val, ok = db.Lower([]byte(probe))
+		want, found = at(i - 1)
+		check("Lower", probe, key, val, ok, want, found)
+		key, val, ok = db.Higher([]byte(probe))
+		want, found = at(higher)
+		check("Higher", probe, key, val, ok, want, found)
+	}
+}
+
+func TestLookups(t *testing.T) {
+	for _, config := range []KV{{}, {Prefix: true}} {
+		rng := rand.New(rand.NewSource(1))
+		for _, n := range []int{0, 1, 2, 100, 20000} {
+			db, keys, kvs := randomTree(t, config, n, -1, rng)
+			// the keys, the keys next to them and the ends
+			probes := []string{"", "\x00", "a", "key", "z", "\xff"}
+			for _, key := range keys {
+				if rng.Intn(10) == 0 || len(keys) < 100 {
+					probes = append(probes, key, key+"\x00", key[:len(key)-1])
+				}
+			}
+			for i := 0; i < 100; i++ {
+				probes = append(probes, fmt.Sprintf("key%06d", rng.Intn(10*n+1)))
+			}
+			// the ends of the leaves
+			for _, leaf := range treeLeaves(&db.tree) {
+				first, last := string(leaf.getKey(0)), string(leaf.getKey(leaf.nkeys()-1))
+				probes = append(probes, first, first+"\x00", last, last+"\x00")
+			}
+			checkLookups(t, db, keys, kvs, probes)
+
+			// only the dummy key is left
+			if n > 0 {
+				if _, err := db.DeleteRange(nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				checkLookups(t, db, nil, nil, probes)
+			}
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package b_tree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// with TREE_HASHES, each internal node entry stores the hash of the kid
+// node next to the kid pointer, so the hash of the root covers the tree.
+// page pointers are not hashed, the same KVs in the same tree shape have
+// the same hashes in different database files.
+
+const HASH_SIZE = sha256.Size
+
+func nodeHash(node BNode) []byte {
+	h := sha256.New()
+	var buf [4]byte
+	binary.LittleEndian.PutUint16(buf[0:], node.btype())
+	binary.LittleEndian.PutUint16(buf[2:], node.nkeys())
+	h.Write(buf[:])
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key, val := node.getKey(i), node.getVal(i)
+		binary.LittleEndian.PutUint16(buf[0:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(buf[2:], uint16(len(val)))
+		h.Write(buf[:])
+		h.Write(key)
+		h.Write(val)
+	}
+	return h.Sum(nil)
+}
+
+// the hash of a kid node stored in an internal node
+func kidHash(node BNode, idx uint16) []byte {
+	val := node.getVal(idx)
+	return val[len(val)-HASH_SIZE:]
+}
+
+var errNoHashes = errors.New("tree hashes are not enabled")
+
+// the hash of the whole tree
+func (db *KV) RootHash() ([]byte, error) {
+	if db.tree.flags&TREE_HASHES == 0 {
+		return nil, errNoHashes
+	}
+	if db.tree.root == 0 {
+		return nil, nil
+	}
+	return nodeHash(db.tree.get(db.tree.root)), nil
+}
+
+// the nodes from the root to the leaf that contains the key.
+// together with the root hash, they prove that the key has this value.
+func (db *KV) Prove(key []byte) ([][]byte, error) {
+	if db.tree.flags&TREE_HASHES == 0 {
+		return nil, errNoHashes
+	}
+	proof := [][]byte{}
+	for ptr := db.tree.root; ptr != 0; {
+		node := db.tree.get(ptr)
+		proof = append(proof, append([]byte(nil), node.data[:node.nbytes()]...))
+		idx := nodeLookupLE(node, key, db.tree.compare)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if db.tree.compare(key, node.getKey(idx)) != 0 {
+				return nil, errors.New("key not found")
+			}
+			ptr = 0
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+	if len(proof) == 0 {
+		return nil, errors.New("key not found")
+	}
+	return proof, nil
+}
+
+// check a proof from KV.Prove against a root hash.
+// the keys must be in the default order, see VerifyProofOrder.
+func VerifyProof(root []byte, key []byte, val []byte, proof [][]byte) bool {
+	return VerifyProofOrder(CMP_BYTES, root, key, val, proof)
+}
+
+// check a proof from a file with the comparator of the ID
+func VerifyProofOrder(cmpID uint64, root []byte, key []byte, val []byte, proof [][]byte) (ok bool) {
+	order, err := findComparator(cmpID)
+	if err != nil {
+		return false
+	}
+	tree := &BTree{order: order}
+	defer func() {
+		if recover() != nil {
+			ok = false // malformed node
+		}
+	}()
+	hash := root
+	for i, data := range proof {
+		node := BNode{data: data}
+		if int(node.nbytes()) != len(data) || !bytes.Equal(hash, nodeHash(node)) {
+			return false
+		}
+		idx := nodeLookupLE(node, key, tree.compare)
+		switch node.btype() {
+		case BNODE_LEAF:
+			return i == len(proof)-1 &&
+				tree.compare(key, node.getKey(idx)) == 0 && bytes.Equal(val, node.getVal(idx))
+		case BNODE_NODE:
+			hash = kidHash(node, idx)
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 )
 
 func mmapInit(fp *os.File) (int, []byte, error) {
@@ -38,39 +39,88 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 
 type KV struct {
 	Path string
+	// root history retention. the latest root is always kept,
+	// a root is also kept if it is one of the last KeepRoots roots
+	// or if it was committed less than KeepFor ago. the history is a
+	// single page of at most HIST_CAP roots, a larger KeepRoots is an
+	// error and the oldest roots within KeepFor are dropped past it.
+	KeepRoots int
+	KeepFor   time.Duration
+	// store the hash of each kid node, see merkle.go.
+	// only used when creating the database.
+	Hashes bool
+	// store the number of keys under each kid node, see count.go.
+	// only used when creating the database.
+	Counts bool
+	// store the common prefix of the keys once per page, see prefix.go.
+	// it stays enabled for the file, the older pages are still readable.
+	Prefix bool
+	// the key order of the main tree and the buckets, see Comparator.
+	// it must be the one the database was created with.
+	Comparator uint64
+	// a page under this fraction of BTREE_PAGE_SIZE is merged with or
+	// takes keys from a sibling on delete, in [0, 0.5], 0 for 1/4.
+	MinFill float64
 	// internals
-	fp   *os.File
-	tree BTree
-	mmap struct {
+	fp    *os.File
+	tree  BTree
+	seq   uint64 // sequence number of the last commit
+	refs  BTree  // named snapshots and branches
+	head  string // the checked out branch
+	nrefs int    // number of refs besides the checked out branch
+	// the bucket names and roots
+	catalog BTree
+	buckets map[string]*bucketState
+	tx      *KVTX // the open transaction
+	mmap    struct {
 		file   int
 		total  int      // file size, can be larger than the database si
 		chunks [][]byte // multiple mmaps, can be non-continuous
 	}
 	page struct {
-		flushed uint64
-		temp    [][]byte // newly allocated pages
-		freed   []uint64
-	}
+		flushed uint64            // database size in number of pages
+		nappend uint64            // number of pages to be appended
+		updates map[uint64][]byte // newly allocated or reused pages
+		ready   []uint64          // freed pages that can be reused
+		held    []freeEntry       // freed pages still used by an older root
+		shared  []freeEntry       // freed pages that may be used by a ref
+		retired []uint64          // pages of the previous meta data
+		gcBase  int               // number of shared pages after the last GC
+		dirty   bool              // the free list changed without updates
+	}
+	meta struct {
+		free  uint64   // first page of the free list
+		hist  uint64   // the root history page
+		pages []uint64 // pages used by the free list and the history
+	}
+	history []rootEntry
 }
 
 func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
-		return nil
-	}
-	// double the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	for db.mmap.total < npages*BTREE_PAGE_SIZE {
+		// double the address space
+		chunk, err := syscall.Mmap(
+			int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.total += db.mmap.total
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
 	}
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
 	return nil
 }
 
 func (db *KV) pageGet(ptr uint64) BNode {
+	if page, ok := db.page.updates[ptr]; ok {
+		return nodeDecompress(BNode{page}) // not yet written to the file
+	}
+	return nodeDecompress(db.pageRead(ptr))
+}
+
+// read a page from the mmap
+func (db *KV) pageRead(ptr uint64) BNode {
 	start := uint64(0)
 	for _, chunk := range db.mmap.chunks {
 		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
@@ -85,35 +135,89 @@ func (db *KV) pageGet(ptr uint64) BNode {
 
 const DB_SIG = "BuildYourOwnDB05"
 
+// the master page format.
+// | sig | root | used | seq | free | hist | refs | flags | catalog | cmp |
+// | 16B |  8B  |  8B  | 8B  |  8B  |  8B  |  8B  |  8B   |   8B    | 8B  |
+// older files have zeros in the fields after used.
+const MASTER_SIZE = 88
+
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
 		// empty file, the master page will be created on the first write.
 		db.page.flushed = 1 // reserved for the master page
-		return nil
+		db.head = DEFAULT_BRANCH
+		if db.Hashes {
+			db.tree.flags |= TREE_HASHES
+		}
+		if db.Counts {
+			db.tree.flags |= TREE_COUNTS
+		}
+		if db.Prefix {
+			db.tree.flags |= TREE_PREFIX
+		}
+		order, err := findComparator(db.Comparator)
+		db.tree.order = order
+		return err
 	}
 	data := db.mmap.chunks[0]
 	root := binary.LittleEndian.Uint64(data[16:])
 	used := binary.LittleEndian.Uint64(data[24:])
+	seq := binary.LittleEndian.Uint64(data[32:])
+	free := binary.LittleEndian.Uint64(data[40:])
+	hist := binary.LittleEndian.Uint64(data[48:])
+	refs := binary.LittleEndian.Uint64(data[56:])
+	flags := binary.LittleEndian.Uint64(data[64:])
+	catalog := binary.LittleEndian.Uint64(data[72:])
+	cmp := binary.LittleEndian.Uint64(data[80:])
 	// verify the page
 	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
 		return errors.New("Bad signature.")
 	}
 	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
 	bad = bad || !(0 <= root && root < used)
+	bad = bad || !(free < used && hist < used && refs < used && catalog < used)
 	if bad {
 		return errors.New("Bad master page.")
 	}
+	if cmp != db.Comparator {
+		return fmt.Errorf("the database uses the comparator %d, not %d", cmp, db.Comparator)
+	}
+	order, err := findComparator(cmp)
+	if err != nil {
+		return err
+	}
+	db.tree.order = order
 	db.tree.root = root
+	db.seq = seq
 	db.page.flushed = used
-	return nil
+	db.meta.free = free
+	db.meta.hist = hist
+	db.refs.root = refs
+	db.tree.flags = flags
+	if db.Prefix {
+		db.tree.flags |= TREE_PREFIX
+	}
+	db.catalog.root = catalog
+	if err := historyLoad(db); err != nil {
+		return err
+	}
+	refsLoad(db)
+	return freeListLoad(db)
 }
 
 // update the master page. it must be atomic.
 func masterStore(db *KV) error {
-	var data [32]byte
+	var data [MASTER_SIZE]byte
 	copy(data[:16], []byte(DB_SIG))
 	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
 	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.seq)
+	binary.LittleEndian.PutUint64(data[40:], db.meta.free)
+	binary.LittleEndian.PutUint64(data[48:], db.meta.hist)
+	binary.LittleEndian.PutUint64(data[56:], db.refs.root)
+	binary.LittleEndian.PutUint64(data[64:], db.tree.flags)
+	binary.LittleEndian.PutUint64(data[72:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[80:], db.tree.order.id())
 	// NOTE: Updating the page via mmap is not atomic.
 	// Use the pwrite() syscall instead.
 	_, err := db.fp.WriteAt(data[:], 0)
@@ -123,54 +227,44 @@ func masterStore(db *KV) error {
 	return nil
 }
 
+// callback for BTree, allocate a new page.
 func (db *KV) pageNew(node BNode) uint64 {
-	// TODO: reuse deallocated pages
+	if db.tree.flags&TREE_PREFIX != 0 {
+		node = nodeCompress(node)
+	} else {
+		node = nodeTrim(node)
+	}
 	if len(node.data) > BTREE_PAGE_SIZE {
 		panic("node data exceeds BTREE_PAGE_SIZE") // Déclenche une panique avec un message d'erreur
 	}
+	ptr := db.pageAlloc()
+	db.page.updates[ptr] = node.data
+	return ptr
+}
 
-	// Try to reuse a freed page if available
-	if len(db.page.freed) > 0 {
-		ptr := db.page.freed[len(db.page.freed)-1]           // Get last freed page
-		db.page.freed = db.page.freed[:len(db.page.freed)-1] // Remove it from freed list
-
-		// Add the node to temp pages at the specific position
-		for len(db.page.temp) <= int(ptr-db.page.flushed) {
-			db.page.temp = append(db.page.temp, nil)
-		}
-		db.page.temp[ptr-db.page.flushed] = node.data
+// reuse a deallocated page or reserve one at the end of the file
+func (db *KV) pageAlloc() uint64 {
+	if n := len(db.page.ready); n > 0 {
+		ptr := db.page.ready[n-1]
+		db.page.ready = db.page.ready[:n-1]
 		return ptr
 	}
-
-	// If no freed pages available, allocate new one
-	ptr := db.page.flushed + uint64(len(db.page.temp))
-	db.page.temp = append(db.page.temp, node.data)
+	ptr := db.page.flushed + db.page.nappend
+	db.page.nappend++
 	return ptr
 }
 
 // callback for BTree, deallocate a page.
 func (db *KV) pageDel(ptr uint64) {
-	// Case 1: Page is in the temporary buffer
-	if ptr >= db.page.flushed {
-		tempIndex := ptr - db.page.flushed
-		if tempIndex < uint64(len(db.page.temp)) {
-			// Mark the temporary page as nil to free it
-			db.page.temp[tempIndex] = nil
-			return
-		}
-		panic("Invalid temporary page pointer")
-	}
-
-	// Case 2: Page is on disk
-	// Verify that the page isn't already in the freed list
-	for _, freedPtr := range db.page.freed {
-		if freedPtr == ptr {
-			panic("Page already freed")
-		}
-	}
-
-	// Add to freed list for future reuse
-	db.page.freed = append(db.page.freed, ptr)
+	if _, ok := db.page.updates[ptr]; ok {
+		// allocated by the pending update, no root can point to it.
+		delete(db.page.updates, ptr)
+		db.page.ready = append(db.page.ready, ptr)
+		return
+	}
+	// the page is still used by the current root until the next commit,
+	// and by the older roots in the history.
+	db.page.held = append(db.page.held, freeEntry{ptr: ptr, seq: db.seq + 1})
 }
 
 // extend the file to at least npages .
@@ -212,10 +306,27 @@ func (db *KV) Open() error {
 	db.mmap.file = sz
 	db.mmap.total = len(chunk)
 	db.mmap.chunks = [][]byte{chunk}
+	db.page.updates = map[uint64][]byte{}
 	// btree callbacks
 	db.tree.get = db.pageGet
 	db.tree.new = db.pageNew
-	db.tree.del = db.pageDel
+	db.tree.del = db.pageDelShared
+	db.refs.get = db.pageGet
+	db.refs.new = db.pageNew
+	db.refs.del = db.pageDel
+	db.catalog.get = db.pageGet
+	db.catalog.new = db.pageNew
+	db.catalog.del = db.pageDel
+	db.buckets = map[string]*bucketState{}
+	if db.KeepRoots > HIST_CAP {
+		err = fmt.Errorf("bad KeepRoots %d, the history holds %d roots", db.KeepRoots, HIST_CAP)
+		goto fail
+	}
+	if !(0 <= db.MinFill && db.MinFill <= 0.5) {
+		err = fmt.Errorf("bad min fill %v", db.MinFill)
+		goto fail
+	}
+	db.tree.minFill = int(db.MinFill * BTREE_PAGE_SIZE)
 	// read the master page
 	err = masterLoad(db)
 	if err != nil {
@@ -245,16 +356,30 @@ func (db *KV) Get(key []byte) ([]byte, bool) {
 }
 
 func (db *KV) Set(key []byte, val []byte) error {
+	db.checkNoTx()
 	db.tree.Insert(key, val)
 	return flushPages(db)
 }
 func (db *KV) Del(key []byte) (bool, error) {
+	db.checkNoTx()
 	deleted := db.tree.Delete(key)
 	return deleted, flushPages(db)
 }
 
+// the average fraction of a page used by the main tree, see MinFill
+func (db *KV) Utilization() float64 {
+	return db.tree.Utilization()
+}
+
 // persist the newly allocated pages after updates
 func flushPages(db *KV) error {
+	bucketsStore(db)
+	if len(db.page.updates) == 0 && !db.page.dirty {
+		return nil // nothing changed
+	}
+	if n := len(db.page.shared); n >= 1024 && n >= 2*db.page.gcBase {
+		gc(db)
+	}
 	if err := writePages(db); err != nil {
 		return err
 	}
@@ -262,8 +387,12 @@ func flushPages(db *KV) error {
 }
 
 func writePages(db *KV) error {
+	// the root history and the free list are rewritten for each commit
+	if err := metaWrite(db); err != nil {
+		return err
+	}
 	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + len(db.page.temp)
+	npages := int(db.page.flushed + db.page.nappend)
 	if err := extendFile(db, npages); err != nil {
 		return err
 	}
@@ -271,9 +400,8 @@ func writePages(db *KV) error {
 		return err
 	}
 	// copy data to the file
-	for i, page := range db.page.temp {
-		ptr := db.page.flushed + uint64(i)
-		copy(db.pageGet(ptr).data, page)
+	for ptr, page := range db.page.updates {
+		copy(db.pageRead(ptr).data, page)
 	}
 	return nil
 }
@@ -283,8 +411,11 @@ func syncPages(db *KV) error {
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
-	db.page.flushed += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
+	db.page.flushed += db.page.nappend
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+	db.page.dirty = false
+	db.seq++
 	// update & flush the master page
 	if err := masterStore(db); err != nil {
 		return err
@@ -292,5 +423,7 @@ func syncPages(db *KV) error {
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
+	// the new root is durable, the old pages can be released.
+	freeListRelease(db)
 	return nil
 }
@@ -0,0 +1,176 @@
+package b_tree
+
+import "encoding/binary"
+
+// prefix compression of the pages. the common prefix of the keys of a
+// node is stored once after the offsets, each key only keeps its suffix:
+// | type | nkeys | pointers | offsets | plen | prefix | KV suffixes |
+// |  2B  |  2B   | nkeys*8B | nkeys*2B|  2B  | plen B |    ...      |
+// the format is in the high byte of the node type, so the pages of both
+// formats can be in the same file. the pages are decompressed when read,
+// the tree code only sees the plain format. a decompressed node can be
+// larger than a page, up to BTREE_NODE_MAX.
+
+const (
+	BNODE_FORMAT_PLAIN  = 0 << 8
+	BNODE_FORMAT_PREFIX = 1 << 8
+	BNODE_FORMAT_MASK   = 0xff00
+)
+
+// the max size of a node in the plain format with TREE_PREFIX
+const BTREE_NODE_MAX = 4 * BTREE_PAGE_SIZE
+
+func commonPrefix(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// the size of a node of the plain format and its page size
+func nodeSize(plain int, nkeys int, plen int, prefix bool) (int, int) {
+	if !prefix || nkeys < 2 {
+		return plain, plain
+	}
+	size := plain + 2 + plen - nkeys*plen
+	if size >= plain {
+		return plain, plain // not compressed
+	}
+	return plain, size
+}
+
+// the common prefix of the keys [from, to). in the bytes.Compare order
+// it's the prefix of the first and the last key.
+func rangePrefix(node BNode, from uint16, to uint16, sorted bool) int {
+	plen := commonPrefix(node.getKey(from), node.getKey(to-1))
+	for i := from + 1; !sorted && plen > 0 && i < to-1; i++ {
+		plen = commonPrefix(node.getKey(from)[:plen], node.getKey(i))
+	}
+	return plen
+}
+
+// the sizes of a node with the keys [from, to)
+func (tree *BTree) rangeSize(node BNode, from uint16, to uint16) (int, int) {
+	n := to - from
+	plain := HEADER + 10*int(n) + int(node.getOffset(to)-node.getOffset(from))
+	prefix := tree.flags&TREE_PREFIX != 0
+	plen := 0
+	if prefix && n >= 2 {
+		plen = rangePrefix(node, from, to, tree.order == nil)
+	}
+	return nodeSize(plain, int(n), plen, prefix)
+}
+
+// whether a node of the sizes fits on a page
+func (tree *BTree) sizeFits(plain int, size int) bool {
+	if tree.flags&TREE_PREFIX == 0 {
+		return plain <= BTREE_PAGE_SIZE
+	}
+	return plain <= BTREE_NODE_MAX && size <= BTREE_PAGE_SIZE
+}
+
+func (tree *BTree) fits(node BNode) bool {
+	return tree.rangeFits(node, 0, node.nkeys())
+}
+
+func (tree *BTree) rangeFits(node BNode, from uint16, to uint16) bool {
+	return tree.sizeFits(tree.rangeSize(node, from, to))
+}
+
+// the page size of a node
+func (tree *BTree) nodeBytes(node BNode) int {
+	_, size := tree.rangeSize(node, 0, node.nkeys())
+	return size
+}
+
+// whether 2 nodes fit on a page after merging, see nodeMerge
+func (tree *BTree) mergeFits(left BNode, right BNode, sep []byte) bool {
+	if left.nkeys() == 0 || right.nkeys() == 0 {
+		return tree.fits(left) && tree.fits(right) // one of them is empty
+	}
+	plain := int(left.nbytes()) + int(right.nbytes()) - HEADER
+	if right.btype() == BNODE_NODE {
+		plain += len(sep) - len(right.getKey(0))
+	}
+	nkeys := int(left.nkeys()) + int(right.nkeys())
+	prefix := tree.flags&TREE_PREFIX != 0
+	plen := 0
+	if prefix {
+		sorted := tree.order == nil
+		first := left.getKey(0)
+		plen = rangePrefix(left, 0, left.nkeys(), sorted)
+		from := uint16(0)
+		if right.btype() == BNODE_NODE {
+			plen = commonPrefix(first[:plen], sep)
+			from = 1
+		}
+		if from < right.nkeys() {
+			rplen := rangePrefix(right, from, right.nkeys(), sorted)
+			plen = commonPrefix(first[:plen], right.getKey(from)[:rplen])
+		}
+	}
+	return tree.sizeFits(nodeSize(plain, nkeys, plen, prefix))
+}
+
+// the page of a node, compressed if it's smaller
+func nodeCompress(node BNode) BNode {
+	nkeys := node.nkeys()
+	plen := 0
+	if nkeys >= 2 {
+		plen = rangePrefix(node, 0, nkeys, false)
+	}
+	plain, size := nodeSize(int(node.nbytes()), int(nkeys), plen, true)
+	if size > BTREE_PAGE_SIZE && plain > BTREE_PAGE_SIZE {
+		panic("node bigger than page")
+	}
+	page := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	if size == plain {
+		copy(page.data, node.data[:plain])
+		return page
+	}
+	prefix := node.getKey(0)[:plen]
+	page.setHeader(node.btype()|BNODE_FORMAT_PREFIX, nkeys)
+	pos := HEADER + 10*nkeys
+	binary.LittleEndian.PutUint16(page.data[pos:], uint16(len(prefix)))
+	copy(page.data[pos+2:], prefix)
+	// the KVs with the offsets after the prefix
+	base := pos + 2 + uint16(len(prefix))
+	offset := uint16(0)
+	for i := uint16(0); i < nkeys; i++ {
+		key, val := node.getKey(i)[len(prefix):], node.getVal(i)
+		page.setPtr(i, node.getPtr(i))
+		kv := page.data[base+offset:]
+		binary.LittleEndian.PutUint16(kv[0:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(kv[2:], uint16(len(val)))
+		copy(kv[4:], key)
+		copy(kv[4+len(key):], val)
+		offset += 4 + uint16(len(key)+len(val))
+		page.setOffset(i+1, offset)
+	}
+	return page
+}
+
+// the plain node of a page
+func nodeDecompress(page BNode) BNode {
+	if page.btype()&BNODE_FORMAT_MASK == BNODE_FORMAT_PLAIN {
+		return page
+	}
+	nkeys := page.nkeys()
+	pos := HEADER + 10*nkeys
+	plen := binary.LittleEndian.Uint16(page.data[pos:])
+	prefix := page.data[pos+2:][:plen]
+	base := pos + 2 + plen
+	size := int(base) + int(page.getOffset(nkeys)) - 2 + int(nkeys-1)*int(plen)
+	node := BNode{data: make([]byte, size)}
+	node.setHeader(page.btype()&^BNODE_FORMAT_MASK, nkeys)
+	key := append([]byte(nil), prefix...)
+	for i := uint16(0); i < nkeys; i++ {
+		kv := page.data[base+page.getOffset(i):]
+		klen := binary.LittleEndian.Uint16(kv[0:])
+		vlen := binary.LittleEndian.Uint16(kv[2:])
+		key = append(key[:plen], kv[4:][:klen]...)
+		nodeAppendKV(node, i, page.getPtr(i), key, kv[4+klen:][:vlen])
+	}
+	return node
+}
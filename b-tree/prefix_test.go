@@ -0,0 +1,102 @@
+package b_tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// a plain node of the keys, with a pointer and a value for each
+func testNode(btype uint16, keys []string) BNode {
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(btype, uint16(len(keys)))
+	for i, key := range keys {
+		nodeAppendKV(node, uint16(i), uint64(i+1), []byte(key), []byte(fmt.Sprint("v", i)))
+	}
+	return node
+}
+
+func TestPrefixCompress(t *testing.T) {
+	cases := []struct {
+		keys       []string
+		compressed bool
+	}{
+		{[]string{"", "user:1", "user:2"}, false}, // the dummy key
+		{[]string{"user:1"}, false},
+		{[]string{"ab", "ac"}, false}, // the prefix is not worth it
+		{[]string{"user:", "user:1", "user:10", "user:2"}, true},
+		{[]string{"item/000/a", "item/000/b", "item/001/", "item/999/zzz"}, true},
+		{[]string{"same-prefix-\x00", "same-prefix-\x00\x01", "same-prefix-\xff"}, true},
+	}
+	for _, c := range cases {
+		for _, btype := range []uint16{BNODE_LEAF, BNODE_NODE} {
+			node := testNode(btype, c.keys)
+			page := nodeCompress(node)
+			format := page.btype() & BNODE_FORMAT_MASK
+			if (format == BNODE_FORMAT_PREFIX) != c.compressed {
+				t.Fatalf("%q: page format %x", c.keys, format)
+			}
+			got := nodeDecompress(page)
+			if got.btype() != btype ||
+				!bytes.Equal(got.data[:got.nbytes()], node.data[:node.nbytes()]) {
+				t.Fatalf("%q: the node is changed by the page format", c.keys)
+			}
+		}
+	}
+}
+
+func TestPrefixReopen(t *testing.T) {
+	path := t.TempDir() + "/prefix.db"
+	db := testOpen(t, &KV{Path: path, Prefix: true})
+	rng := rand.New(rand.NewSource(1))
+	kvs := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("tenant/%02d/user/%08d", rng.Intn(3), rng.Intn(50000))
+		if rng.Intn(4) == 0 {
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(kvs, key)
+		} else {
+			if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = "v" + key
+		}
+	}
+	keys := []string{}
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// the flag is kept by the file, the option is only used to enable it
+	for _, prefix := range []bool{true, false} {
+		db.Close()
+		db = testOpen(t, &KV{Path: path, Prefix: prefix})
+		if db.tree.flags&TREE_PREFIX == 0 {
+			t.Fatal("prefix compression is disabled by reopening")
+		}
+		checkTree(t, &db.tree)
+		checkKeys(t, db, keys)
+	}
+	// the pages are compressed in the file
+	key, _, _ := db.Last() // the first pages have the dummy key
+	compressed := 0
+	for ptr := db.tree.root; ptr != 0; {
+		page := db.pageRead(ptr)
+		if page.btype()&BNODE_FORMAT_MASK == BNODE_FORMAT_PREFIX {
+			compressed++
+		}
+		node := nodeDecompress(page)
+		ptr = 0
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(nodeLookupLE(node, key, db.tree.compare))
+		}
+	}
+	if compressed == 0 {
+		t.Fatal("no compressed page on the path to the last key")
+	}
+	db.Close()
+}
@@ -0,0 +1,283 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// named snapshots and branches.
+// they are kept in a separate B-tree whose root is in the master page.
+// the key is the name, the value is:
+// | kind | root | seq | time |
+// |  1B  |  8B  | 8B  |  8B  |
+// the checked out branch is marked as REF_HEAD, its root is the master root.
+//
+// the data trees share pages with each other while a ref exists,
+// so the pages freed by the data tree are only reused after a GC
+// has proven that no other ref reaches them.
+
+const (
+	REF_SNAPSHOT = 1 // read-only, pinned forever
+	REF_BRANCH   = 2 // writable after checking it out
+	REF_HEAD     = 3 // the checked out branch
+)
+
+const DEFAULT_BRANCH = "main"
+
+type refEntry struct {
+	kind byte
+	root uint64
+	seq  uint64
+	time int64
+}
+
+func refDecode(val []byte) refEntry {
+	return refEntry{
+		kind: val[0],
+		root: binary.LittleEndian.Uint64(val[1:]),
+		seq:  binary.LittleEndian.Uint64(val[9:]),
+		time: int64(binary.LittleEndian.Uint64(val[17:])),
+	}
+}
+
+func refEncode(ref refEntry) []byte {
+	val := make([]byte, 25)
+	val[0] = ref.kind
+	binary.LittleEndian.PutUint64(val[1:], ref.root)
+	binary.LittleEndian.PutUint64(val[9:], ref.seq)
+	binary.LittleEndian.PutUint64(val[17:], uint64(ref.time))
+	return val
+}
+
+// find the checked out branch and count the other refs
+func refsLoad(db *KV) {
+	db.head = DEFAULT_BRANCH
+	db.nrefs = 0
+	for iter := db.refs.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if refDecode(val).kind == REF_HEAD {
+			db.head = string(key)
+		} else {
+			db.nrefs++
+		}
+	}
+}
+
+func (db *KV) refGet(name string) (refEntry, bool) {
+	val, ok := db.refs.Get([]byte(name))
+	if !ok {
+		return refEntry{}, false
+	}
+	return refDecode(val), true
+}
+
+func (db *KV) refSet(name string, kind byte, root uint64) {
+	ref := refEntry{kind: kind, root: root, seq: db.seq, time: time.Now().UnixNano()}
+	db.refs.Insert([]byte(name), refEncode(ref))
+}
+
+func checkRefName(db *KV, name string) error {
+	if len(name) == 0 || len(name) > BTREE_MAX_KEY_SIZE {
+		return errors.New("bad ref name")
+	}
+	if _, ok := db.refGet(name); ok || name == db.head {
+		return fmt.Errorf("ref %q already exists", name)
+	}
+	return nil
+}
+
+// the name of the checked out branch
+func (db *KV) Head() string {
+	return db.head
+}
+
+// pin the current root under a new name
+func (db *KV) Snapshot(name string) error {
+	db.checkNoTx()
+	if err := checkRefName(db, name); err != nil {
+		return err
+	}
+	db.refSet(name, REF_SNAPSHOT, db.tree.root)
+	db.nrefs++
+	return flushPages(db)
+}
+
+// create a branch from a snapshot or another branch
+func (db *KV) Branch(from string, name string) error {
+	db.checkNoTx()
+	root := db.tree.root
+	if from != db.head {
+		ref, ok := db.refGet(from)
+		if !ok {
+			return fmt.Errorf("ref %q not found", from)
+		}
+		root = ref.root
+	}
+	if err := checkRefName(db, name); err != nil {
+		return err
+	}
+	db.refSet(name, REF_BRANCH, root)
+	db.nrefs++
+	return flushPages(db)
+}
+
+// make a branch the target of the updates
+func (db *KV) Checkout(name string) error {
+	db.checkNoTx()
+	if name == db.head {
+		return nil
+	}
+	ref, ok := db.refGet(name)
+	if !ok || ref.kind != REF_BRANCH {
+		return fmt.Errorf("branch %q not found", name)
+	}
+	db.refSet(db.head, REF_BRANCH, db.tree.root)
+	db.refSet(name, REF_HEAD, 0)
+	db.tree.root = ref.root
+	db.head = name
+	return flushPages(db)
+}
+
+func (db *KV) DropSnapshot(name string) error {
+	return refDrop(db, name, REF_SNAPSHOT)
+}
+
+// the checked out branch cannot be dropped
+func (db *KV) DropBranch(name string) error {
+	return refDrop(db, name, REF_BRANCH)
+}
+
+func refDrop(db *KV, name string, kind byte) error {
+	db.checkNoTx()
+	ref, ok := db.refGet(name)
+	if !ok || ref.kind != kind {
+		return fmt.Errorf("ref %q not found", name)
+	}
+	db.refs.Delete([]byte(name))
+	db.nrefs--
+	gc(db)
+	return flushPages(db)
+}
+
+// read a snapshot or a branch
+func (db *KV) View(name string) (*KVView, bool) {
+	if name == db.head {
+		return db.view(rootEntry{seq: db.seq, root: db.tree.root}), true
+	}
+	ref, ok := db.refGet(name)
+	if !ok {
+		return nil, false
+	}
+	return db.view(rootEntry{seq: ref.seq, time: ref.time, root: ref.root}), true
+}
+
+// callback for the data tree, deallocate a page.
+func (db *KV) pageDelShared(ptr uint64) {
+	if _, ok := db.page.updates[ptr]; ok || db.nrefs == 0 {
+		db.pageDel(ptr)
+		return
+	}
+	// the page may be used by a ref
+	db.page.shared = append(db.page.shared, freeEntry{ptr: ptr, seq: db.seq + 1})
+}
+
+// mark the pages reachable from a root
+func gcMark(db *KV, root uint64, marks []bool) {
+	stack := []uint64{root}
+	for len(stack) > 0 {
+		ptr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ptr == 0 || marks[ptr] {
+			continue
+		}
+		marks[ptr] = true
+		node := db.pageGet(ptr)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				stack = append(stack, node.getPtr(i))
+			}
+		}
+	}
+}
+
+// find the pages that are no longer reachable from the master page,
+// the refs or the root history, and make them reusable.
+func gc(db *KV) {
+	npages := db.page.flushed + db.page.nappend
+	live := make([]bool, npages) // used by the latest roots
+	gcMark(db, db.tree.root, live)
+	gcMark(db, db.refs.root, live)
+	gcMark(db, db.catalog.root, live)
+	for iter := db.catalog.Seek(nil); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		gcMark(db, binary.LittleEndian.Uint64(val), live)
+	}
+	for _, b := range db.buckets {
+		gcMark(db, b.tree.root, live)
+	}
+	for iter := db.refs.Seek(nil); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		gcMark(db, refDecode(val).root, live)
+	}
+	for _, ptr := range db.meta.pages {
+		live[ptr] = true
+	}
+	old := make([]bool, npages) // used by the root history
+	for _, e := range db.history {
+		gcMark(db, e.root, old)
+	}
+
+	// a page of several branches is freed by each of them, only the
+	// last free is kept. the pages that are not live are only used by
+	// the history. without refs, the live pages are only used by the
+	// data tree, which frees them itself.
+	freed := map[uint64]uint64{}
+	for _, e := range db.page.shared {
+		if e.seq > freed[e.ptr] {
+			freed[e.ptr] = e.seq
+		}
+	}
+	busy := make([]bool, npages)
+	shared := db.page.shared[:0]
+	for _, e := range db.page.shared {
+		if busy[e.ptr] {
+			continue // a duplicate
+		}
+		e.seq = freed[e.ptr]
+		if live[e.ptr] {
+			if db.nrefs > 0 {
+				shared = append(shared, e)
+			}
+		} else {
+			db.page.held = append(db.page.held, e)
+		}
+		busy[e.ptr] = true
+	}
+	db.page.shared = shared
+	for _, e := range db.page.held {
+		busy[e.ptr] = true
+	}
+	for ptr := range db.page.updates {
+		busy[ptr] = true
+	}
+	// everything else is free
+	db.page.ready = db.page.ready[:0]
+	for ptr := uint64(1); ptr < npages; ptr++ {
+		if !live[ptr] && !old[ptr] && !busy[ptr] {
+			db.page.ready = append(db.page.ready, ptr)
+		}
+	}
+	// held must stay ordered by seq
+	sortFreeEntries(db.page.held)
+	db.page.gcBase = len(db.page.shared)
+	db.page.dirty = true
+}
+
+// collect the pages freed while refs exist
+func (db *KV) GC() error {
+	db.checkNoTx()
+	gc(db)
+	return flushPages(db)
+}
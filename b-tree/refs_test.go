@@ -0,0 +1,166 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// the KVs of a ref and its updates
+type refData map[string]string
+
+func (d refData) clone() refData {
+	out := refData{}
+	for k, v := range d {
+		out[k] = v
+	}
+	return out
+}
+
+func checkRef(t *testing.T, db *KV, name string, kvs refData) {
+	t.Helper()
+	view, ok := db.View(name)
+	if !ok {
+		t.Fatalf("ref %q not found", name)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		got, ok := view.Get([]byte(key))
+		want, exists := kvs[key]
+		if ok != exists || string(got) != want {
+			t.Fatalf("ref %q: %s = %q, want %q", name, key, got, want)
+		}
+	}
+}
+
+// random updates of the checked out branch
+func updateRef(t *testing.T, db *KV, rng *rand.Rand, kvs refData, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(300))
+		if rng.Intn(3) == 0 {
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(kvs, key)
+		} else {
+			val := fmt.Sprintf("%s-%d", db.Head(), rng.Int())
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = val
+		}
+	}
+}
+
+func TestRefsGC(t *testing.T) {
+	path := t.TempDir() + "/refs.db"
+	db := testOpen(t, &KV{Path: path})
+	rng := rand.New(rand.NewSource(1))
+	refs := map[string]refData{DEFAULT_BRANCH: {}}
+	check := func() {
+		t.Helper()
+		checkPages(t, db)
+		for name, kvs := range refs {
+			checkRef(t, db, name, kvs)
+		}
+	}
+	reopen := func() {
+		t.Helper()
+		db.Close()
+		db = testOpen(t, &KV{Path: path})
+		check()
+	}
+
+	updateRef(t, db, rng, refs[DEFAULT_BRANCH], 500)
+	if err := db.Snapshot("snap1"); err != nil {
+		t.Fatal(err)
+	}
+	refs["snap1"] = refs[DEFAULT_BRANCH].clone()
+	if err := db.Branch(DEFAULT_BRANCH, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	refs["dev"] = refs[DEFAULT_BRANCH].clone()
+	updateRef(t, db, rng, refs[DEFAULT_BRANCH], 500)
+	check()
+
+	if err := db.Checkout("dev"); err != nil {
+		t.Fatal(err)
+	}
+	updateRef(t, db, rng, refs["dev"], 500)
+	if err := db.Snapshot("snap2"); err != nil {
+		t.Fatal(err)
+	}
+	refs["snap2"] = refs["dev"].clone()
+	updateRef(t, db, rng, refs["dev"], 500)
+	if err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	seen := map[uint64]bool{}
+	for _, e := range db.page.shared {
+		if seen[e.ptr] {
+			t.Fatalf("shared page %d is kept twice by the GC", e.ptr)
+		}
+		seen[e.ptr] = true
+	}
+	reopen()
+	if db.Head() != "dev" {
+		t.Fatalf("checked out %q after reopening", db.Head())
+	}
+
+	// dropping the refs frees the pages only they use
+	for _, name := range []string{"snap1", "snap2"} {
+		if err := db.DropSnapshot(name); err != nil {
+			t.Fatal(err)
+		}
+		delete(refs, name)
+		updateRef(t, db, rng, refs["dev"], 200)
+		check()
+	}
+	if err := db.Checkout(DEFAULT_BRANCH); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBranch("dev"); err != nil {
+		t.Fatal(err)
+	}
+	delete(refs, "dev")
+	reopen()
+	if err := db.GC(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if len(db.page.shared) != 0 {
+		t.Fatalf("%d shared pages without refs", len(db.page.shared))
+	}
+	// the pages of the dropped refs are reused
+	size := db.page.flushed
+	updateRef(t, db, rng, refs[DEFAULT_BRANCH], 500)
+	check()
+	if db.page.flushed > size {
+		t.Fatalf("the file grows from %d to %d pages", size, db.page.flushed)
+	}
+
+	// the pages freed by a branch are still used by the checked out
+	// branch after the last ref is dropped
+	if err := db.Branch(DEFAULT_BRANCH, "dev2"); err != nil {
+		t.Fatal(err)
+	}
+	refs["dev2"] = refs[DEFAULT_BRANCH].clone()
+	if err := db.Checkout("dev2"); err != nil {
+		t.Fatal(err)
+	}
+	updateRef(t, db, rng, refs["dev2"], 200)
+	if err := db.Checkout(DEFAULT_BRANCH); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBranch("dev2"); err != nil {
+		t.Fatal(err)
+	}
+	delete(refs, "dev2")
+	check()
+	updateRef(t, db, rng, refs[DEFAULT_BRANCH], 500)
+	check()
+	reopen()
+	db.Close()
+}
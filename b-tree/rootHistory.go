@@ -0,0 +1,173 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// each commit creates a new root, the older roots are kept in the
+// root history page according to KV.KeepRoots and KV.KeepFor.
+// their pages are not reused until they leave the history.
+//
+// the root history page format, from the oldest to the latest root.
+// | type | count | unused | seq-time-root triples |
+// |  2B  |  2B   |   4B   |      count * 24B      |
+
+const BNODE_HIST = 4
+
+const HIST_HEADER = 8
+const HIST_CAP = (BTREE_PAGE_SIZE - HIST_HEADER) / 24
+
+type rootEntry struct {
+	seq  uint64
+	time int64 // unix nanoseconds
+	root uint64
+}
+
+func historyLoad(db *KV) error {
+	if db.meta.hist == 0 {
+		// the latest root is always in the history
+		db.history = []rootEntry{{seq: db.seq, root: db.tree.root}}
+		return nil
+	}
+	node := db.pageRead(db.meta.hist)
+	if binary.LittleEndian.Uint16(node.data) != BNODE_HIST {
+		return errors.New("Bad root history page.")
+	}
+	count := int(binary.LittleEndian.Uint16(node.data[2:]))
+	if count == 0 || count > HIST_CAP {
+		return errors.New("Bad root history page.")
+	}
+	db.history = make([]rootEntry, count)
+	for i := range db.history {
+		pos := HIST_HEADER + 24*i
+		db.history[i] = rootEntry{
+			seq:  binary.LittleEndian.Uint64(node.data[pos:]),
+			time: int64(binary.LittleEndian.Uint64(node.data[pos+8:])),
+			root: binary.LittleEndian.Uint64(node.data[pos+16:]),
+		}
+	}
+	last := db.history[count-1]
+	if last.seq != db.seq || last.root != db.tree.root {
+		return errors.New("Root history does not match the master page.")
+	}
+	db.meta.pages = append(db.meta.pages, db.meta.hist)
+	return nil
+}
+
+// add the root of the pending commit and drop the expired roots
+func historyAdd(db *KV, now time.Time) {
+	db.history = append(db.history, rootEntry{
+		seq: db.seq + 1, time: now.UnixNano(), root: db.tree.root,
+	})
+	keep := db.KeepRoots
+	if keep < 1 {
+		keep = 1
+	}
+	n := len(db.history)
+	start := 0
+	for ; start < n-1; start++ {
+		if n-start > HIST_CAP {
+			continue // no room in the page
+		}
+		age := now.Sub(time.Unix(0, db.history[start].time))
+		if n-start <= keep || (db.KeepFor > 0 && age < db.KeepFor) {
+			break
+		}
+	}
+	db.history = append([]rootEntry(nil), db.history[start:]...)
+}
+
+func historyStore(db *KV) {
+	data := make([]byte, BTREE_PAGE_SIZE)
+	binary.LittleEndian.PutUint16(data[0:], BNODE_HIST)
+	binary.LittleEndian.PutUint16(data[2:], uint16(len(db.history)))
+	for i, e := range db.history {
+		pos := HIST_HEADER + 24*i
+		binary.LittleEndian.PutUint64(data[pos:], e.seq)
+		binary.LittleEndian.PutUint64(data[pos+8:], uint64(e.time))
+		binary.LittleEndian.PutUint64(data[pos+16:], e.root)
+	}
+	db.meta.hist = db.pageAlloc()
+	db.page.updates[db.meta.hist] = data
+	db.meta.pages = append(db.meta.pages, db.meta.hist)
+}
+
+// the sequence number of the oldest root that is still readable
+func historyOldest(db *KV) uint64 {
+	if len(db.history) == 0 {
+		return db.seq
+	}
+	return db.history[0].seq
+}
+
+// write the root history and the free list for the pending commit
+func metaWrite(db *KV) error {
+	if len(db.history) > 0 && db.history[len(db.history)-1].seq != db.seq {
+		return errors.New("root history is out of sync")
+	}
+	// the previous meta pages are only read by the previous master page
+	db.page.retired = append(db.page.retired, db.meta.pages...)
+	db.meta.pages = db.meta.pages[:0]
+	historyAdd(db, time.Now())
+	historyStore(db)
+	freeListStore(db)
+	return nil
+}
+
+// KVView is a read-only view of a version kept in the root history.
+// it is only valid while the version is in the history.
+type KVView struct {
+	db   *KV
+	tree BTree
+	seq  uint64
+	time time.Time
+}
+
+func (db *KV) view(e rootEntry) *KVView {
+	view := &KVView{db: db, seq: e.seq, time: time.Unix(0, e.time)}
+	view.tree.root = e.root
+	view.tree.get = db.pageGet
+	view.tree.flags = db.tree.flags
+	view.tree.order = db.tree.order
+	view.tree.minFill = db.tree.minFill
+	return view
+}
+
+// the version created by the commit seq
+func (db *KV) At(seq uint64) (*KVView, bool) {
+	for _, e := range db.history {
+		if e.seq == seq {
+			return db.view(e), true
+		}
+	}
+	return nil, false
+}
+
+// the latest version committed at or before t
+func (db *KV) AsOf(t time.Time) (*KVView, bool) {
+	for i := len(db.history) - 1; i >= 0; i-- {
+		if db.history[i].time <= t.UnixNano() {
+			return db.view(db.history[i]), true
+		}
+	}
+	return nil, false
+}
+
+// the sequence number of the last commit
+func (db *KV) Seq() uint64 {
+	return db.seq
+}
+
+func (view *KVView) Get(key []byte) ([]byte, bool) {
+	return view.tree.Get(key)
+}
+
+func (view *KVView) Seq() uint64 {
+	return view.seq
+}
+
+func (view *KVView) Time() time.Time {
+	return view.time
+}
@@ -0,0 +1,188 @@
+package b_tree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// check the free pages against the pages reachable from the master page.
+// the pages that can be reused right away must not be reachable from
+// any root, the held pages can only be reachable from the root history.
+func checkPages(t *testing.T, db *KV) {
+	t.Helper()
+	npages := db.page.flushed + db.page.nappend
+	walk := func(marks map[uint64]bool, root uint64) {
+		stack := []uint64{root}
+		for len(stack) > 0 {
+			ptr := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if ptr == 0 || marks[ptr] {
+				continue
+			}
+			if ptr >= npages {
+				t.Fatalf("page %d is past the end %d", ptr, npages)
+			}
+			marks[ptr] = true
+			node := db.pageGet(ptr)
+			if node.btype() == BNODE_NODE {
+				for i := uint16(0); i < node.nkeys(); i++ {
+					stack = append(stack, node.getPtr(i))
+				}
+			}
+		}
+	}
+	live := map[uint64]bool{}
+	walk(live, db.tree.root)
+	walk(live, db.refs.root)
+	walk(live, db.catalog.root)
+	for iter := db.catalog.Seek(nil); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		walk(live, binary.LittleEndian.Uint64(val))
+	}
+	for _, b := range db.buckets {
+		walk(live, b.tree.root)
+	}
+	for iter := db.refs.Seek(nil); iter.Valid(); iter.Next() {
+		_, val := iter.Deref()
+		walk(live, refDecode(val).root)
+	}
+	for _, ptr := range db.meta.pages {
+		live[ptr] = true
+	}
+	old := map[uint64]bool{}
+	for _, e := range db.history {
+		walk(old, e.root)
+	}
+
+	free := map[uint64]bool{}
+	add := func(ptr uint64, what string) {
+		if free[ptr] {
+			t.Fatalf("page %d is freed twice", ptr)
+		}
+		free[ptr] = true
+		if ptr == 0 || ptr >= npages {
+			t.Fatalf("bad %s page %d", what, ptr)
+		}
+	}
+	for _, ptr := range append(append([]uint64(nil), db.page.ready...), db.page.retired...) {
+		add(ptr, "free")
+		if live[ptr] || old[ptr] {
+			t.Fatalf("reachable page %d is free", ptr)
+		}
+	}
+	for _, e := range db.page.held {
+		add(e.ptr, "held")
+		if live[e.ptr] {
+			t.Fatalf("live page %d is held", e.ptr)
+		}
+	}
+	// a page of several branches can be freed by each of them, the
+	// duplicates are removed by the GC
+	shared := map[uint64]bool{}
+	for _, e := range db.page.shared {
+		if !shared[e.ptr] {
+			add(e.ptr, "shared")
+		}
+		shared[e.ptr] = true
+	}
+}
+
+func TestHistoryReopen(t *testing.T) {
+	const keep = 5
+	path := t.TempDir() + "/history.db"
+	db := testOpen(t, &KV{Path: path, KeepRoots: keep})
+	rng := rand.New(rand.NewSource(1))
+	kvs := map[string]string{}
+	versions := map[uint64]map[string]string{}
+	check := func() {
+		t.Helper()
+		checkPages(t, db)
+		seq := db.Seq()
+		for s := seq; s > 0 && s+keep > seq; s-- {
+			view, ok := db.At(s)
+			if !ok {
+				t.Fatalf("version %d of %d is not kept", s, seq)
+			}
+			for k, v := range versions[s] {
+				if got, ok := view.Get([]byte(k)); !ok || string(got) != v {
+					t.Fatalf("version %d: %s = %q, want %q", s, k, got, v)
+				}
+			}
+		}
+		if _, ok := db.At(seq - keep); ok && seq > keep {
+			t.Fatalf("version %d of %d is kept", seq-keep, seq)
+		}
+	}
+	size := uint64(0)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(200))
+		if rng.Intn(3) == 0 {
+			if _, err := db.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(kvs, key)
+		} else {
+			val := fmt.Sprintf("val%d", i)
+			if err := db.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+			kvs[key] = val
+		}
+		version := map[string]string{}
+		for k, v := range kvs {
+			version[k] = v
+		}
+		versions[db.Seq()] = version
+		if i%100 == 99 {
+			check()
+			db.Close()
+			db = testOpen(t, &KV{Path: path, KeepRoots: keep})
+			check()
+		}
+		if i == 999 {
+			size = db.page.flushed
+		}
+	}
+	// the freed pages are reused
+	if db.page.flushed > 2*size {
+		t.Fatalf("the file grows from %d to %d pages", size, db.page.flushed)
+	}
+	db.Close()
+}
+
+// the history page holds HIST_CAP roots
+func TestHistoryCap(t *testing.T) {
+	db := &KV{Path: t.TempDir() + "/history.db", KeepRoots: HIST_CAP + 1}
+	if err := db.Open(); err == nil {
+		db.Close()
+		t.Fatalf("opened with KeepRoots %d", db.KeepRoots)
+	}
+	for _, config := range []KV{{KeepRoots: HIST_CAP}, {KeepFor: time.Hour}} {
+		path := t.TempDir() + "/history.db"
+		config.Path = path
+		db := testOpen(t, &config)
+		for i := 0; i < HIST_CAP+10; i++ {
+			if err := db.Set([]byte("k"), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check := func() {
+			t.Helper()
+			seq := db.Seq()
+			if _, ok := db.At(seq - HIST_CAP + 1); !ok {
+				t.Fatalf("version %d of %d is not kept", seq-HIST_CAP+1, seq)
+			}
+			if _, ok := db.At(seq - HIST_CAP); ok {
+				t.Fatalf("version %d of %d is kept", seq-HIST_CAP, seq)
+			}
+		}
+		check()
+		db.Close()
+		db = testOpen(t, &KV{Path: path, KeepRoots: config.KeepRoots, KeepFor: config.KeepFor})
+		check()
+		db.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package b_tree
+
+import "math/rand"
+
+// random keys from a tree without reading all of it.
+// with TREE_COUNTS, a random position is found with BTree.SeekIndex, so
+// each key has the same chance. otherwise a random path from the root is
+// taken and rejected with a chance of 1 - fan-out/max fan-out at each
+// node below the root (Olken's method), so that the keys under the nodes
+// of a small fan-out are not favored. the max fan-out is the most keys
+// that fit on a page, so each key has the same chance, but most paths
+// are rejected if the pages are far from full.
+
+// the most keys of a node that fit on a page, an entry takes at least
+// the pointer, the offset and the lengths
+func (tree *BTree) maxFanout(btype uint16) int {
+	entry := 8 + 2 + 4
+	if btype == BNODE_NODE && tree.flags&TREE_HASHES != 0 {
+		entry += HASH_SIZE
+	}
+	return (BTREE_PAGE_SIZE - HEADER) / entry
+}
+
+// n random keys, a key can be returned more than once.
+// fewer keys are returned only if the tree is empty.
+func (tree *BTree) Sample(n int, rng *rand.Rand) [][]byte {
+	if tree.root == 0 || n <= 0 {
+		return nil
+	}
+	keys := [][]byte{}
+	if tree.flags&TREE_COUNTS != 0 {
+		total := tree.Count(nil, nil)
+		for total > 0 && len(keys) < n {
+			iter := tree.SeekIndex(rng.Intn(total))
+			key, _ := iter.Deref()
+			keys = append(keys, append([]byte(nil), key...))
+		}
+		return keys
+	}
+	if root := tree.get(tree.root); root.btype() == BNODE_LEAF && root.nkeys() == 1 {
+		return nil // only the dummy key
+	}
+	for len(keys) < n {
+		key, ok := tree.samplePath(rng)
+		if ok {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	return keys
+}
+
+// a random path from the root to a key, false if it is rejected
+func (tree *BTree) samplePath(rng *rand.Rand) ([]byte, bool) {
+	node := tree.get(tree.root)
+	for level := 0; ; level++ {
+		nkeys := int(node.nkeys())
+		// the root is the only node of its level
+		if level > 0 && rng.Intn(tree.maxFanout(node.btype())) >= nkeys {
+			return nil, false
+		}
+		idx := uint16(rng.Intn(nkeys))
+		switch node.btype() {
+		case BNODE_LEAF:
+			key := node.getKey(idx)
+			return key, len(key) > 0 // not the dummy key
+		case BNODE_NODE:
+			node = tree.get(node.getPtr(idx))
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+// n random keys of the main tree, see BTree.Sample
+func (db *KV) Sample(n int, rng *rand.Rand) [][]byte {
+	return db.tree.Sample(n, rng)
+}
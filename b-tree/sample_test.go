@@ -0,0 +1,73 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// the keys of the first half have small values and are packed into
+// fewer leaves than the keys of the second half
+func TestSample(t *testing.T) {
+	for _, config := range []KV{{}, {Hashes: true}, {Prefix: true}, {Counts: true}} {
+		config.Path = t.TempDir() + "/sample.db"
+		db := testOpen(t, &config)
+		rng := rand.New(rand.NewSource(1))
+		if keys := db.Sample(10, rng); len(keys) != 0 {
+			t.Fatalf("sampled %q from an empty tree", keys)
+		}
+		if err := db.Set([]byte("a"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if keys := db.Sample(3, rng); len(keys) != 3 || string(keys[0]) != "a" {
+			t.Fatalf("sampled %q from a single key", keys)
+		}
+		if _, err := db.Del([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if keys := db.Sample(10, rng); len(keys) != 0 {
+			t.Fatalf("sampled %q from a tree without keys", keys)
+		}
+
+		const n = 10000
+		ops := []BatchOp{}
+		keys := []string{}
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			val := []byte{}
+			if i >= n/2 {
+				val = make([]byte, 200)
+			}
+			ops = append(ops, BatchOp{Key: []byte(key), Val: val})
+			keys = append(keys, key)
+		}
+		if err := db.WriteBatch(ops); err != nil {
+			t.Fatal(err)
+		}
+		// a new Sample for each key, then all the keys at once
+		samples := [][]byte{}
+		for i := 0; i < 10000; i++ {
+			samples = append(samples, db.Sample(1, rng)...)
+		}
+		samples = append(samples, db.Sample(10000, rng)...)
+		// the keys of each tenth of the keys
+		const parts = 10
+		hist := make([]int, parts)
+		for _, key := range samples {
+			i := sort.SearchStrings(keys, string(key))
+			if i == len(keys) || keys[i] != string(key) {
+				t.Fatalf("sampled %q, not a key", key)
+			}
+			hist[i*parts/n]++
+		}
+		// about 5 standard deviations
+		want := len(samples) / parts
+		for i, got := range hist {
+			if got < want-300 || got > want+300 {
+				t.Fatalf("flags %x: %d samples of part %d, want %d: %v", db.tree.flags, got, i, want, hist)
+			}
+		}
+		db.Close()
+	}
+}
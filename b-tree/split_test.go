@@ -0,0 +1,103 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// a node of n keys of the same size, larger than a page
+func bigLeaf(n int) BNode {
+	node := nodeAlloc(BTREE_NODE_MAX)
+	node.setHeader(BNODE_LEAF, uint16(n))
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		nodeAppendKV(node, uint16(i), 0, []byte(key), make([]byte, 100))
+	}
+	return node
+}
+
+func TestSplitHint(t *testing.T) {
+	tree := &BTree{}
+	old := bigLeaf(50)
+	sizes := map[int][2]int{}
+	for _, hint := range []int{SPLIT_EVEN, SPLIT_APPEND, SPLIT_PREPEND} {
+		left, right := nodeAlloc(BTREE_NODE_MAX), nodeAlloc(BTREE_NODE_MAX)
+		nodeSplit2(tree, left, right, old, hint)
+		if !tree.fits(left) || !tree.fits(right) || left.nkeys()+right.nkeys() != old.nkeys() {
+			t.Fatalf("hint %d: split into %d and %d keys", hint, left.nkeys(), right.nkeys())
+		}
+		sizes[hint] = [2]int{int(left.nkeys()), int(right.nkeys())}
+		// the filled node can't take another key
+		switch hint {
+		case SPLIT_APPEND:
+			if tree.rangeFits(old, 0, left.nkeys()+1) {
+				t.Fatalf("the left node of %d keys is not full", left.nkeys())
+			}
+		case SPLIT_PREPEND:
+			if tree.rangeFits(old, left.nkeys()-1, old.nkeys()) {
+				t.Fatalf("the right node of %d keys is not full", right.nkeys())
+			}
+		}
+	}
+	if even := sizes[SPLIT_EVEN]; even[0]-even[1] > 1 || even[1]-even[0] > 1 {
+		t.Fatalf("uneven split %v", even)
+	}
+}
+
+// the set of the keys
+func setOf(keys []string) map[string]bool {
+	set := map[string]bool{}
+	for _, key := range keys {
+		set[key] = true
+	}
+	return set
+}
+
+// the leaves of sequential inserts are nearly full, in a transaction too
+func TestSequentialInserts(t *testing.T) {
+	const n = 5000
+	orders := map[string]func(i int) int{
+		"ascending":  func(i int) int { return i },
+		"descending": func(i int) int { return n - i },
+		"random":     nil,
+	}
+	for name, order := range orders {
+		for _, inTx := range []bool{false, true} {
+			db := testOpen(t, &KV{Path: t.TempDir() + "/split.db"})
+			rng := rand.New(rand.NewSource(1))
+			tx := KVTX{}
+			if inTx {
+				db.Begin(&tx)
+			}
+			perm := rng.Perm(n)
+			keys := []string{}
+			for i := 0; i < n; i++ {
+				pos := perm[i]
+				if order != nil {
+					pos = order(i)
+				}
+				key := fmt.Sprintf("key%05d", pos)
+				keys = append(keys, key)
+				if inTx {
+					tx.Set([]byte(key), []byte("v"+key))
+				} else if err := db.Set([]byte(key), []byte("v"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if inTx {
+				if err := db.Commit(&tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkTree(t, &db.tree)
+			checkKeys(t, db, sortedKeys(setOf(keys)))
+			stats := db.Stats().Tree
+			fill := stats.Levels[stats.Height-1].AvgFill
+			if (order != nil && fill < 0.9) || (order == nil && fill > 0.85) {
+				t.Fatalf("%s, tx %v: the leaves are %.2f full", name, inTx, fill)
+			}
+			db.Close()
+		}
+	}
+}
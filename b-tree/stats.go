@@ -0,0 +1,101 @@
+package b_tree
+
+// space usage of a tree and of the database file.
+// the stats are computed by reading every page of the tree.
+
+// the pages of a level of the tree. the fill is the fraction of
+// BTREE_PAGE_SIZE used by a page, as stored with TREE_PREFIX.
+type LevelStats struct {
+	Pages   int
+	AvgFill float64
+	MinFill float64
+}
+
+type TreeStats struct {
+	Height        int // 0 for an empty tree
+	InternalPages int
+	LeafPages     int
+	Keys          int // without the dummy key
+	KeyBytes      int // of the keys in the leaves
+	ValBytes      int
+	Levels        []LevelStats // from the root to the leaves
+}
+
+type FileStats struct {
+	Size       int    // in bytes, including the space not yet used
+	UsedPages  uint64 // the pages of the database, see KV.page.flushed
+	FreePages  int    // the pages that can be reused now
+	FreeList   int    // the pages in the free list, including the held ones
+	MmapChunks int
+	MmapSize   int // the mapped address space in bytes
+}
+
+type KVStats struct {
+	Tree TreeStats // the main tree
+	File FileStats
+}
+
+func (tree *BTree) Stats() TreeStats {
+	stats := TreeStats{}
+	if tree.root == 0 {
+		return stats
+	}
+	fills := [][]float64{}
+	tree.nodeStats(&stats, &fills, tree.get(tree.root), 0)
+	stats.Height = len(fills)
+	for _, level := range fills {
+		lv := LevelStats{Pages: len(level), MinFill: level[0]}
+		for _, fill := range level {
+			lv.AvgFill += fill
+			if fill < lv.MinFill {
+				lv.MinFill = fill
+			}
+		}
+		lv.AvgFill /= float64(len(level))
+		stats.Levels = append(stats.Levels, lv)
+	}
+	return stats
+}
+
+// add the pages of a subtree to the stats and the fill of each page
+func (tree *BTree) nodeStats(stats *TreeStats, fills *[][]float64, node BNode, depth int) {
+	if depth == len(*fills) {
+		*fills = append(*fills, nil)
+	}
+	fill := float64(tree.nodeBytes(node)) / BTREE_PAGE_SIZE
+	(*fills)[depth] = append((*fills)[depth], fill)
+	switch node.btype() {
+	case BNODE_LEAF:
+		stats.LeafPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			stats.Keys++
+			stats.KeyBytes += len(key)
+			stats.ValBytes += len(node.getVal(i))
+		}
+	case BNODE_NODE:
+		stats.InternalPages++
+		for i := uint16(0); i < node.nkeys(); i++ {
+			tree.nodeStats(stats, fills, tree.get(node.getPtr(i)), depth+1)
+		}
+	default:
+		panic("bad node!")
+	}
+}
+
+// the stats of the main tree and the file
+func (db *KV) Stats() KVStats {
+	stats := KVStats{Tree: db.tree.Stats()}
+	file := &stats.File
+	file.Size = db.mmap.file
+	file.UsedPages = db.page.flushed
+	file.FreePages = len(db.page.ready)
+	file.FreeList = len(db.page.ready) + len(db.page.retired) +
+		len(db.page.held) + len(db.page.shared)
+	file.MmapChunks = len(db.mmap.chunks)
+	file.MmapSize = db.mmap.total
+	return stats
+}
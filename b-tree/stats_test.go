@@ -0,0 +1,123 @@
+package b_tree
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// the stats of the tree from a walk of its pages
+func checkStats(t *testing.T, tree *BTree, kvs map[string]string) {
+	t.Helper()
+	stats := tree.Stats()
+	if height := checkTree(t, tree); stats.Height != height || len(stats.Levels) != height {
+		t.Fatalf("height %d with %d levels, want %d", stats.Height, len(stats.Levels), height)
+	}
+	keyBytes, valBytes := 0, 0
+	for key, val := range kvs {
+		keyBytes, valBytes = keyBytes+len(key), valBytes+len(val)
+	}
+	if stats.Keys != len(kvs) || stats.KeyBytes != keyBytes || stats.ValBytes != valBytes {
+		t.Fatalf("%d keys of %d + %d bytes, want %d of %d + %d",
+			stats.Keys, stats.KeyBytes, stats.ValBytes, len(kvs), keyBytes, valBytes)
+	}
+	// the pages of each level
+	pages := []int{}
+	fills := []float64{}
+	minFills := []float64{}
+	var walk func(node BNode, depth int)
+	walk = func(node BNode, depth int) {
+		if depth == len(pages) {
+			pages, fills, minFills = append(pages, 0), append(fills, 0), append(minFills, 1)
+		}
+		fill := float64(tree.nodeBytes(node)) / BTREE_PAGE_SIZE
+		pages[depth]++
+		fills[depth] += fill
+		minFills[depth] = math.Min(minFills[depth], fill)
+		if node.btype() == BNODE_NODE {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				walk(tree.get(node.getPtr(i)), depth+1)
+			}
+		}
+	}
+	if tree.root != 0 {
+		walk(tree.get(tree.root), 0)
+	}
+	total, used := 0, 0.0
+	for i, lv := range stats.Levels {
+		if lv.Pages != pages[i] || math.Abs(lv.AvgFill-fills[i]/float64(pages[i])) > 1e-9 || lv.MinFill != minFills[i] {
+			t.Fatalf("level %d: %+v, want %d pages, %v avg fill, %v min fill",
+				i, lv, pages[i], fills[i]/float64(pages[i]), minFills[i])
+		}
+		if lv.MinFill > lv.AvgFill || lv.AvgFill > 1 {
+			t.Fatalf("level %d: %+v", i, lv)
+		}
+		total += lv.Pages
+		used += fills[i]
+	}
+	if stats.Height > 0 && (stats.Levels[0].Pages != 1 || stats.LeafPages != stats.Levels[stats.Height-1].Pages) {
+		t.Fatalf("%d roots, %d leaves", stats.Levels[0].Pages, stats.LeafPages)
+	}
+	if stats.InternalPages+stats.LeafPages != total {
+		t.Fatalf("%d + %d pages, want %d", stats.InternalPages, stats.LeafPages, total)
+	}
+	// the utilization is the average fill of all the pages
+	util := 0.0
+	if total > 0 {
+		util = used / float64(total)
+	}
+	if got := tree.Utilization(); math.Abs(got-util) > 1e-9 {
+		t.Fatalf("utilization %v, want %v", got, util)
+	}
+}
+
+// the file stats are consistent, the file is empty before the first commit
+func checkFileStats(t *testing.T, db *KV) {
+	t.Helper()
+	file := db.Stats().File
+	if file.UsedPages != db.page.flushed || (file.Size > 0 && int(file.UsedPages)*BTREE_PAGE_SIZE > file.Size) {
+		t.Fatalf("%d used pages in %d bytes", file.UsedPages, file.Size)
+	}
+	if file.Size > file.MmapSize || file.MmapChunks < 1 {
+		t.Fatalf("%d bytes mapped in %d chunks of %d bytes", file.Size, file.MmapChunks, file.MmapSize)
+	}
+	if file.FreePages > file.FreeList || uint64(file.FreeList) >= file.UsedPages {
+		t.Fatalf("%d free pages, %d in the free list of %d", file.FreePages, file.FreeList, file.UsedPages)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, config := range []KV{{}, {Prefix: true}, {Counts: true, Hashes: true}, {KeepRoots: 10}} {
+		rng := rand.New(rand.NewSource(1))
+		db, keys, kvs := randomTree(t, config, 0, -1, rng)
+		checkStats(t, &db.tree, kvs)
+		if stats := db.Stats().Tree; stats.Height != 0 || stats.Keys != 0 || len(stats.Levels) != 0 {
+			t.Fatalf("the stats of an empty tree: %+v", stats)
+		}
+		checkFileStats(t, db)
+		db.Close()
+
+		db, keys, kvs = randomTree(t, config, 20000, -1, rng)
+		checkStats(t, &db.tree, kvs)
+		checkFileStats(t, db)
+		// the freed pages are in the free list
+		for i := 0; i < 20; i++ {
+			ops := []BatchOp{}
+			for _, key := range keys[i*500 : i*500+250] {
+				ops = append(ops, BatchOp{Key: []byte(key), Del: true})
+				delete(kvs, key)
+			}
+			if err := db.WriteBatch(ops); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkStats(t, &db.tree, kvs)
+		checkFileStats(t, db)
+		file := db.Stats().File
+		// the pages of the last roots are held back
+		if file.FreePages == 0 || (config.KeepRoots > 0 && file.FreeList == file.FreePages) {
+			t.Fatalf("%d free pages, %d in the free list", file.FreePages, file.FreeList)
+		}
+		db.Close()
+	}
+}
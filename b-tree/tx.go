@@ -0,0 +1,94 @@
+package b_tree
+
+// a transaction groups updates into a single commit.
+// the KV methods that commit on their own, such as KV.Set,
+// panic while a transaction is open.
+type KVTX struct {
+	db *KV
+	// the state before the transaction, for rollbacks
+	root    uint64
+	catalog uint64
+	buckets map[string]bucketState
+	nappend uint64
+	ready   []uint64
+	held    []freeEntry
+	shared  []freeEntry
+	dirty   bool
+	// the split hint of the main tree, see splitHint
+	last []byte
+	dir  int
+}
+
+// begin a transaction
+func (db *KV) Begin(tx *KVTX) {
+	if db.tx != nil {
+		panic("nested transaction")
+	}
+	*tx = KVTX{db: db, root: db.tree.root, catalog: db.catalog.root}
+	tx.buckets = map[string]bucketState{}
+	for name, b := range db.buckets {
+		saved := *b
+		saved.tree.last = append([]byte(nil), b.tree.last...)
+		tx.buckets[name] = saved
+	}
+	tx.nappend = db.page.nappend
+	tx.ready = append([]uint64(nil), db.page.ready...)
+	tx.held = append([]freeEntry(nil), db.page.held...)
+	tx.shared = append([]freeEntry(nil), db.page.shared...)
+	tx.dirty = db.page.dirty
+	tx.last = append([]byte(nil), db.tree.last...)
+	tx.dir = db.tree.dir
+	db.tx = tx
+}
+
+// the KV methods that commit on their own would also commit the
+// updates of the open transaction, which could no longer be aborted.
+func (db *KV) checkNoTx() {
+	if db.tx != nil {
+		panic("KV update inside a transaction")
+	}
+}
+
+// end a transaction: commit updates
+func (db *KV) Commit(tx *KVTX) error {
+	if db.tx != tx {
+		panic("not the current transaction")
+	}
+	db.tx = nil
+	return flushPages(db)
+}
+
+// end a transaction: rollback
+func (db *KV) Abort(tx *KVTX) {
+	if db.tx != tx {
+		panic("not the current transaction")
+	}
+	db.tx = nil
+	db.tree.root = tx.root
+	db.catalog.root = tx.catalog
+	db.buckets = map[string]*bucketState{}
+	for name, b := range tx.buckets {
+		b := b
+		db.buckets[name] = &b
+	}
+	db.page.updates = map[uint64][]byte{}
+	db.page.nappend = tx.nappend
+	db.page.ready = tx.ready
+	db.page.held = tx.held
+	db.page.shared = tx.shared
+	db.page.dirty = tx.dirty
+	db.tree.last = tx.last
+	db.tree.dir = tx.dir
+}
+
+func (tx *KVTX) Get(key []byte) ([]byte, bool) {
+	return tx.db.tree.Get(key)
+}
+
+func (tx *KVTX) Set(key []byte, val []byte) {
+	tx.db.tree.Insert(key, val)
+}
+
+func (tx *KVTX) Del(key []byte) bool {
+	return tx.db.tree.Delete(key)
+}
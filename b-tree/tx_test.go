@@ -0,0 +1,137 @@
+package b_tree
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAbortRestoresState(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/tx.db"})
+	defer db.Close()
+	if err := db.Snapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq, last, dir := db.Seq(), string(db.tree.last), db.tree.dir
+
+	tx := KVTX{}
+	db.Begin(&tx)
+	for i := 1000; i > 900; i-- {
+		tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+	}
+	gc(db) // the free list state changed without a commit
+	db.Abort(&tx)
+	if db.page.dirty {
+		t.Fatal("the free list change of the aborted transaction is kept")
+	}
+	if string(db.tree.last) != last || db.tree.dir != dir {
+		t.Fatalf("split hint %q %d, want %q %d", db.tree.last, db.tree.dir, last, dir)
+	}
+	// nothing to commit
+	db.Begin(&tx)
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if db.Seq() != seq {
+		t.Fatalf("empty commit after the rollback, seq %d, want %d", db.Seq(), seq)
+	}
+	if _, ok := db.Get([]byte("k0950")); ok {
+		t.Fatal("aborted insert is visible")
+	}
+}
+
+func TestAbortRestoresBucketHint(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/tx.db"})
+	defer db.Close()
+	bucket, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Set([]byte("a"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	tx := KVTX{}
+	db.Begin(&tx)
+	tb, err := tx.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Set([]byte("z"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	db.Abort(&tx)
+	if last := string(db.buckets["b"].tree.last); last != "a" {
+		t.Fatalf("bucket split hint %q, want %q", last, "a")
+	}
+}
+
+func TestSelfCommitInTx(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/tx.db"})
+	defer db.Close()
+	bucket, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Branch(DEFAULT_BRANCH, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	seq := db.Seq()
+	key, val := []byte("k"), []byte("v")
+	ops := map[string]func(){
+		"Set":          func() { db.Set(key, val) },
+		"Del":          func() { db.Del(key) },
+		"Update":       func() { db.Update(&UpdateReq{Key: key, Val: val}) },
+		"DeleteEx":     func() { db.DeleteEx(&DeleteReq{Key: key}) },
+		"DeleteRange":  func() { db.DeleteRange(nil, nil) },
+		"WriteBatch":   func() { db.WriteBatch([]BatchOp{{Key: key, Val: val}}) },
+		"CreateBucket": func() { db.CreateBucket("c") },
+		"DeleteBucket": func() { db.DeleteBucket("b") },
+		"Bucket.Set":   func() { bucket.Set(key, val) },
+		"Bucket.Del":   func() { bucket.Del(key) },
+		"Snapshot":     func() { db.Snapshot("snap") },
+		"Branch":       func() { db.Branch(DEFAULT_BRANCH, "dev2") },
+		"Checkout":     func() { db.Checkout("dev") },
+		"DropBranch":   func() { db.DropBranch("dev") },
+		"GC":           func() { db.GC() },
+	}
+	for name, op := range ops {
+		tx := KVTX{}
+		db.Begin(&tx)
+		tx.Set([]byte("tx"), val)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s in a transaction", name)
+				}
+			}()
+			op()
+		}()
+		db.Abort(&tx)
+		if db.Seq() != seq {
+			t.Fatalf("%s committed the transaction", name)
+		}
+		if _, ok := db.Get([]byte("tx")); ok {
+			t.Fatalf("%s kept the aborted update", name)
+		}
+	}
+	// the bucket handles of a transaction do not commit
+	tx := KVTX{}
+	db.Begin(&tx)
+	tb, err := tx.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tb.Set(key, val); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := bucket.Get(key); !ok || string(got) != "v" {
+		t.Fatalf("bucket key %q %v", got, ok)
+	}
+}
@@ -0,0 +1,85 @@
+package b_tree
+
+import "bytes"
+
+// conditional writes. the current value is looked up before the write,
+// so the caller learns whether the key existed and what its value was.
+// the old value is copied, the pages it was on can be reused.
+
+const (
+	MODE_UPSERT      = 0 // insert or replace
+	MODE_UPDATE_ONLY = 1 // update existing keys
+	MODE_INSERT_ONLY = 2 // only add new keys
+	MODE_CAS         = 3 // update a key whose value is Expect
+)
+
+type UpdateReq struct {
+	// in
+	Key    []byte
+	Val    []byte
+	Mode   int
+	Expect []byte // the current value for MODE_CAS
+	// out
+	Old     []byte // the value before the update
+	Existed bool   // the key was in the tree
+	Updated bool   // the value was written
+}
+
+type DeleteReq struct {
+	// in
+	Key []byte
+	// out
+	Old []byte // the deleted value
+}
+
+// write the value if the condition of the mode holds, see UpdateReq
+func (tree *BTree) Update(req *UpdateReq) bool {
+	old, exists := tree.Get(req.Key)
+	req.Old, req.Existed, req.Updated = nil, exists, false
+	if exists {
+		req.Old = append([]byte{}, old...)
+	}
+	switch req.Mode {
+	case MODE_UPSERT:
+	case MODE_UPDATE_ONLY:
+		if !exists {
+			return false
+		}
+	case MODE_INSERT_ONLY:
+		if exists {
+			return false
+		}
+	case MODE_CAS:
+		if !exists || !bytes.Equal(req.Old, req.Expect) {
+			return false
+		}
+	default:
+		panic("bad update mode")
+	}
+	tree.Insert(req.Key, req.Val)
+	req.Updated = true
+	return true
+}
+
+// delete a key and return its value in the request
+func (tree *BTree) DeleteEx(req *DeleteReq) bool {
+	old, exists := tree.Get(req.Key)
+	req.Old = nil
+	if !exists {
+		return false
+	}
+	req.Old = append([]byte{}, old...)
+	return tree.Delete(req.Key)
+}
+
+func (db *KV) Update(req *UpdateReq) (bool, error) {
+	db.checkNoTx()
+	updated := db.tree.Update(req)
+	return updated, flushPages(db)
+}
+
+func (db *KV) DeleteEx(req *DeleteReq) (bool, error) {
+	db.checkNoTx()
+	deleted := db.tree.DeleteEx(req)
+	return deleted, flushPages(db)
+}
@@ -0,0 +1,126 @@
+package b_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestUpdateModes(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/update.db"})
+	defer db.Close()
+	if err := db.Set([]byte("k"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key     string
+		mode    int
+		expect  string
+		updated bool
+		existed bool
+		old     string
+	}{
+		{"k", MODE_UPSERT, "", true, true, "1"},
+		{"new1", MODE_UPSERT, "", true, false, ""},
+		{"k", MODE_UPDATE_ONLY, "", true, true, "v"},
+		{"new2", MODE_UPDATE_ONLY, "", false, false, ""},
+		{"k", MODE_INSERT_ONLY, "", false, true, "v"},
+		{"new3", MODE_INSERT_ONLY, "", true, false, ""},
+		{"k", MODE_CAS, "v", true, true, "v"},
+		{"k", MODE_CAS, "x", false, true, "v"},
+		{"new4", MODE_CAS, "", false, false, ""},
+		// an empty value exists
+		{"empty", MODE_INSERT_ONLY, "", false, true, ""},
+		{"empty", MODE_CAS, "", true, true, ""},
+	}
+	for _, c := range cases {
+		before, had := db.Get([]byte(c.key))
+		before = append([]byte(nil), before...)
+		req := &UpdateReq{Key: []byte(c.key), Val: []byte("v"), Mode: c.mode, Expect: []byte(c.expect)}
+		updated, err := db.Update(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != c.updated || req.Updated != c.updated || req.Existed != c.existed ||
+			string(req.Old) != c.old || (req.Old != nil) != c.existed {
+			t.Fatalf("%+v: %v %+v", c, updated, req)
+		}
+		val, ok := db.Get([]byte(c.key))
+		if c.updated && (!ok || string(val) != "v") {
+			t.Fatalf("%+v: the value is %q %v", c, val, ok)
+		}
+		if !c.updated && (ok != had || string(val) != string(before)) {
+			t.Fatalf("%+v: the value is changed to %q %v", c, val, ok)
+		}
+	}
+
+	req := &DeleteReq{Key: []byte("k")}
+	if deleted, err := db.DeleteEx(req); err != nil || !deleted || string(req.Old) != "v" {
+		t.Fatalf("DeleteEx = %v %v %q", deleted, err, req.Old)
+	}
+	if _, ok := db.Get([]byte("k")); ok {
+		t.Fatal("the deleted key is found")
+	}
+	if deleted, err := db.DeleteEx(req); err != nil || deleted || req.Old != nil {
+		t.Fatalf("DeleteEx of a missing key = %v %v %q", deleted, err, req.Old)
+	}
+}
+
+// random conditional writes against a map
+func TestUpdateRandom(t *testing.T) {
+	db := testOpen(t, &KV{Path: t.TempDir() + "/update.db"})
+	defer db.Close()
+	rng := rand.New(rand.NewSource(1))
+	kvs := map[string]string{}
+	olds := map[*UpdateReq]string{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(300))
+		cur, exists := kvs[key]
+		if rng.Intn(5) == 0 {
+			req := &DeleteReq{Key: []byte(key)}
+			deleted, err := db.DeleteEx(req)
+			if err != nil || deleted != exists || string(req.Old) != cur {
+				t.Fatalf("DeleteEx(%q) = %v %v %q, want %v %q", key, deleted, err, req.Old, exists, cur)
+			}
+			delete(kvs, key)
+			continue
+		}
+		// a long value, so the old one is not on the same page
+		val := fmt.Sprintf("%0*d", rng.Intn(1000), i)
+		req := &UpdateReq{Key: []byte(key), Val: []byte(val), Mode: rng.Intn(4)}
+		if rng.Intn(2) == 0 {
+			req.Expect = []byte(cur)
+		}
+		want := false
+		switch req.Mode {
+		case MODE_UPSERT:
+			want = true
+		case MODE_UPDATE_ONLY:
+			want = exists
+		case MODE_INSERT_ONLY:
+			want = !exists
+		case MODE_CAS:
+			want = exists && string(req.Expect) == cur
+		}
+		updated, err := db.Update(req)
+		if err != nil || updated != want || req.Updated != want || req.Existed != exists || string(req.Old) != cur {
+			t.Fatalf("mode %d of %q: %v %v %+v, want %v %v %q", req.Mode, key, updated, err, req, want, exists, cur)
+		}
+		if want {
+			kvs[key] = val
+		}
+		if exists && rng.Intn(10) == 0 {
+			olds[req] = cur
+		}
+	}
+	checkMap(t, db, kvs)
+	// the old values are copies
+	for req, old := range olds {
+		if string(req.Old) != old {
+			t.Fatalf("the old value of %q is changed", req.Key)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"strings"
+)
+
+// aggregates over the groups of rows of GROUP BY, or over all the rows.
+// the rows are consumed in one pass. if they come grouped, from the
+// order of the scan, one group is kept at a time; otherwise every group
+// is kept until the end. either way the memory is bounded by the number
+// of groups and not by the number of rows.
+
+var aggFuncs = map[string]bool{"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true}
+
+// collect the aggregate calls of an expression
+func findAggs(e *Expr, out []*Expr) ([]*Expr, error) {
+	if e == nil {
+		return out, nil
+	}
+	if e.Op == EXPR_FUNC {
+		if !aggFuncs[e.Name] {
+			return nil, fmt.Errorf("unknown function: %s", e.Name)
+		}
+		if len(e.Kids) != 1 && !(e.Name == "COUNT" && len(e.Kids) == 0) {
+			return nil, fmt.Errorf("%s takes 1 argument", e.Name)
+		}
+		for _, kid := range e.Kids {
+			nested, err := findAggs(kid, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(nested) > 0 {
+				return nil, fmt.Errorf("nested aggregate in %s", e.Name)
+			}
+		}
+		return append(out, e), nil
+	}
+	for _, kid := range e.Kids {
+		var err error
+		if out, err = findAggs(kid, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// the running state of an aggregate
+type aggState struct {
+	count int64
+	sum   table.Value // SUM, AVG
+	val   table.Value // MIN, MAX
+}
+
+func (st *aggState) add(call *Expr, row *env) error {
+	if len(call.Kids) == 0 {
+		st.count++ // COUNT(*)
+		return nil
+	}
+	v, err := eval(call.Kids[0], row)
+	if err != nil || isNull(v) {
+		return err
+	}
+	st.count++
+	switch call.Name {
+	case "SUM", "AVG":
+		if !isNumber(v) {
+			return fmt.Errorf("%s of a non-number", call.Name)
+		}
+		if st.count == 1 {
+			st.sum = v
+		} else {
+			st.sum, err = arith(EXPR_ADD, st.sum, v)
+		}
+	case "MIN", "MAX":
+		if st.count == 1 {
+			st.val = v
+			break
+		}
+		r, err := compareValues(v, st.val)
+		if err != nil {
+			return err
+		}
+		if (call.Name == "MIN" && r < 0) || (call.Name == "MAX" && r > 0) {
+			st.val = v
+		}
+	}
+	return err
+}
+
+// the result of an aggregate, NULL if there is no value except for COUNT
+func (st *aggState) result(call *Expr) table.Value {
+	switch call.Name {
+	case "COUNT":
+		return intValue(st.count)
+	case "SUM":
+		return st.sum
+	case "AVG":
+		if st.count == 0 {
+			return table.Value{}
+		}
+		return table.Value{Type: table.TYPE_FLOAT64, F64: toFloat(st.sum) / float64(st.count)}
+	}
+	return st.val
+}
+
+type group struct {
+	key  []table.Value
+	row  *env // the first row, for the columns outside of the aggregates
+	aggs []aggState
+}
+
+func (g *group) add(calls []*Expr, row *env) error {
+	if g.row == nil {
+		g.row = row
+	}
+	for i, call := range calls {
+		if err := g.aggs[i].add(call, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the columns of the first row and the aggregates
+func (g *group) env(calls []*Expr) *env {
+	out := &env{aggs: map[*Expr]table.Value{}}
+	if g.row != nil {
+		out.tables, out.cols, out.vals = g.row.tables, g.row.cols, g.row.vals
+	}
+	for i, call := range calls {
+		out.aggs[call] = g.aggs[i].result(call)
+	}
+	return out
+}
+
+// the key of a group as a map key
+func groupKey(key []table.Value) string {
+	strs := make([]string, len(key))
+	for i, v := range key {
+		strs[i] = fmt.Sprintf("%d:%s", v.Type, valueString(v))
+	}
+	return strings.Join(strs, ",")
+}
+
+// group the rows and call fn for each group, stop if fn returns false.
+// without GROUP BY there is exactly one group.
+func aggregate(in rowIter, groupBy []*Expr, calls []*Expr, grouped bool, fn func(*env) (bool, error)) error {
+	var cur *group // the group of the grouped rows
+	groups := map[string]*group{}
+	order := []*group{} // in the order of the first rows
+	err := each(in, func(row *env) (bool, error) {
+		key, err := evalAll(groupBy, row)
+		if err != nil {
+			return false, err
+		}
+		if grouped {
+			if cur != nil {
+				r, err := compareKeys(key, cur.key)
+				if err != nil {
+					return false, err
+				}
+				if r != 0 {
+					if more, err := fn(cur.env(calls)); err != nil || !more {
+						cur = nil
+						return false, err
+					}
+					cur = nil
+				}
+			}
+			if cur == nil {
+				cur = &group{key: key, aggs: make([]aggState, len(calls))}
+			}
+			return true, cur.add(calls, row)
+		}
+		g, ok := groups[groupKey(key)]
+		if !ok {
+			g = &group{key: key, aggs: make([]aggState, len(calls))}
+			groups[groupKey(key)] = g
+			order = append(order, g)
+		}
+		return true, g.add(calls, row)
+	})
+	if err != nil {
+		return err
+	}
+	if grouped && cur != nil {
+		order = append(order, cur)
+	}
+	if len(groupBy) == 0 && len(order) == 0 {
+		order = append(order, &group{aggs: make([]aggState, len(calls))})
+	}
+	for _, g := range order {
+		if more, err := fn(g.env(calls)); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package sql
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	db := testCompany(t)
+	defer db.Close()
+	expectRows(t, db, "SELECT COUNT(*), SUM(salary), MIN(salary), MAX(name), AVG(salary) FROM emp", "7,545,50,'gus',77.85714285714286")
+	expectRows(t, db, "SELECT dept, COUNT(*), SUM(salary), MIN(name), MAX(salary), AVG(salary) FROM emp GROUP BY dept",
+		"1,3,285,'ann',100,95", "2,2,150,'cy',80,75", "3,1,60,'ed',60,60", "99,1,50,'fay',50,50")
+	expectRows(t, db, "SELECT dept, SUM(salary) AS s FROM emp GROUP BY dept HAVING COUNT(*) > 1 ORDER BY s DESC", "1,285", "2,150")
+	expectRows(t, db, "SELECT salary > 75, COUNT(*) FROM emp GROUP BY salary > 75", "1,4", "0,3")
+	expectRows(t, db, "SELECT MAX(salary) - MIN(salary) FROM emp WHERE dept = 1", "10")
+	// the NULLs of a LEFT JOIN are not counted
+	expectRows(t, db, "SELECT d.name, COUNT(*), COUNT(e.id), SUM(e.salary), AVG(e.salary) FROM dept d LEFT JOIN emp e ON e.dept = d.id GROUP BY d.name",
+		"'eng',3,3,285,95", "'ops',2,2,150,75", "'hr',1,1,60,60", "'empty',1,0,NULL,NULL")
+	// no rows is one group without GROUP BY
+	expectRows(t, db, "SELECT COUNT(*), COUNT(id), SUM(salary), MIN(name), AVG(salary) FROM emp WHERE id > 100", "0,0,NULL,NULL,NULL")
+	expectRows(t, db, "SELECT dept, COUNT(*) FROM emp WHERE id > 100 GROUP BY dept")
+
+	for _, q := range []string{
+		"SELECT COUNT(*) FROM emp WHERE COUNT(*) > 1",
+		"SELECT dept FROM emp GROUP BY COUNT(*)",
+		"SELECT SUM(MAX(salary)) FROM emp",
+		"SELECT SUM(name) FROM emp",
+		"SELECT SUM(salary, id) FROM emp",
+		"SELECT NOPE(salary) FROM emp",
+		"SELECT name FROM emp HAVING name = 'ann'",
+	} {
+		if _, err := Exec(db, q); err == nil {
+			t.Fatalf("%s: no error", q)
+		}
+	}
+}
+
+// the stream and the hash grouping against the groups of all the rows
+func TestAggregateGroups(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (a INT, b INT, c INT, PRIMARY KEY (a, b), INDEX by_c (c))")
+	rng := rand.New(rand.NewSource(1))
+	type group struct{ count, sum, min, max int64 }
+	byA, byC, byC3 := map[int64]*group{}, map[int64]*group{}, map[int64]*group{}
+	add := func(groups map[int64]*group, key int64, val int64) {
+		g := groups[key]
+		if g == nil {
+			g = &group{min: val, max: val}
+			groups[key] = g
+		}
+		g.count++
+		g.sum += val
+		if val < g.min {
+			g.min = val
+		}
+		if val > g.max {
+			g.max = val
+		}
+	}
+	values := []string{}
+	for i := 0; i < 1000; i++ {
+		a, b, c := int64(rng.Intn(20)), int64(i), int64(rng.Intn(30))
+		values = append(values, fmt.Sprintf("(%d, %d, %d)", a, b, c))
+		add(byA, a, c)
+		add(byC, c, b)
+		if c == 3 {
+			add(byC3, c, b)
+		}
+	}
+	testExec(t, db, "INSERT INTO t VALUES "+strings.Join(values, ", "))
+
+	cases := []struct {
+		query  string
+		step   string
+		groups map[int64]*group
+	}{
+		{"SELECT a, COUNT(*), SUM(c), MIN(c), MAX(c) FROM t GROUP BY a", "stream group", byA},
+		{"SELECT c, COUNT(*), SUM(b), MIN(b), MAX(b) FROM t GROUP BY c", "hash group", byC},
+		{"SELECT c, COUNT(*), SUM(b), MIN(b), MAX(b) FROM t WHERE c = 3 GROUP BY c", "stream group", byC3},
+	}
+	for _, c := range cases {
+		plan := testExec(t, db, "EXPLAIN "+c.query).Rows
+		if step := string(plan[len(plan)-1][2].Str); step != c.step {
+			t.Fatalf("%s: %s, want %s", c.query, step, c.step)
+		}
+		want := map[string]bool{}
+		for key, g := range c.groups {
+			want[fmt.Sprintf("%d,%d,%d,%d,%d", key, g.count, g.sum, g.min, g.max)] = true
+		}
+		got := map[string]bool{}
+		for _, row := range resultRows(testExec(t, db, c.query)) {
+			if got[row] {
+				t.Fatalf("%s: duplicate group %s", c.query, row)
+			}
+			got[row] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %d groups, want %d", c.query, len(got), len(want))
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"errors"
+	"fmt"
+)
+
+// the output of a statement
+type Result struct {
+	Cols     []string
+	Rows     [][]table.Value
+	Affected int // the number of rows inserted, updated or deleted
+}
+
+// run the statements, the result is from the last one
+func Exec(db *table.DB, query string) (*Result, error) {
+	stmts, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, stmt := range stmts {
+		if res, err = execStmt(db, stmt); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func execStmt(db *table.DB, stmt interface{}) (*Result, error) {
+	switch stmt := stmt.(type) {
+	case *CreateTable:
+		return &Result{}, db.TableNew(&stmt.Def)
+	case *CreateIndex:
+		return &Result{}, db.IndexNew(stmt.Table, stmt.Index)
+	case *Insert:
+		return execInsert(db, stmt)
+	case *Select:
+		return execSelect(db, stmt)
+	case *Update:
+		return execUpdate(db, stmt)
+	case *Delete:
+		return execDelete(db, stmt)
+	case *Explain:
+		return execExplain(db, stmt)
+	case *Analyze:
+		stats, err := db.Analyze(stmt.Table)
+		if err != nil {
+			return nil, err
+		}
+		row := []table.Value{strValue(stmt.Table), intValue(stats.Rows)}
+		return &Result{Cols: []string{"table", "rows"}, Rows: [][]table.Value{row}}, nil
+	}
+	panic("unreachable")
+}
+
+// evaluate the expressions as the values of the columns
+func makeRecord(tdef *table.TableDef, cols []string, exprs []*Expr, row *env) (table.Record, error) {
+	rec := table.Record{}
+	for i, col := range cols {
+		j := indexOf(tdef.Cols, col)
+		if j < 0 {
+			return rec, fmt.Errorf("unknown column: %s", col)
+		}
+		if rec.Get(col) != nil {
+			return rec, fmt.Errorf("duplicate column: %s", col)
+		}
+		v, err := eval(exprs[i], row)
+		if err != nil {
+			return rec, err
+		}
+		v, ok := coerce(v, tdef.Types[j])
+		if !ok {
+			return rec, fmt.Errorf("bad type for column: %s", col)
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// run the updates in a transaction
+func update(db *table.DB, fn func(tx *table.TX) (int, error)) (*Result, error) {
+	var tx table.TX
+	db.Begin(&tx)
+	n, err := fn(&tx)
+	if err != nil {
+		db.Abort(&tx)
+		return nil, err
+	}
+	return &Result{Affected: n}, db.Commit(&tx)
+}
+
+func execInsert(db *table.DB, stmt *Insert) (*Result, error) {
+	tdef, err := db.TableDef(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	cols := stmt.Cols
+	if len(cols) == 0 {
+		cols = tdef.Cols
+	}
+	return update(db, func(tx *table.TX) (int, error) {
+		for _, exprs := range stmt.Rows {
+			if len(exprs) != len(cols) {
+				return 0, fmt.Errorf("expect %d values", len(cols))
+			}
+			rec, err := makeRecord(tdef, cols, exprs, nil)
+			if err != nil {
+				return 0, err
+			}
+			added, err := tx.Insert(tdef.Name, rec)
+			if err != nil {
+				return 0, err
+			}
+			if !added {
+				return 0, errors.New("duplicate primary key")
+			}
+		}
+		return len(stmt.Rows), nil
+	})
+}
+
+// collect the matching rows before updating the table
+func matchRows(db *table.DB, name string, where *Expr) (*table.TableDef, []*env, error) {
+	sc, err := newScan(db, name, name, where)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows := []*env{}
+	err = each(sc.iter(db), func(row *env) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	return sc.tdef, rows, err
+}
+
+func primaryKey(tdef *table.TableDef, vals []table.Value) table.Record {
+	return table.Record{Cols: tdef.Cols[:tdef.PKeys], Vals: vals[:tdef.PKeys]}
+}
+
+func execUpdate(db *table.DB, stmt *Update) (*Result, error) {
+	tdef, rows, err := matchRows(db, stmt.Table, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	return update(db, func(tx *table.TX) (int, error) {
+		// the rows with a new primary key are deleted before
+		// the inserts, so the keys can be shifted.
+		moved := []table.Record{}
+		for _, row := range rows {
+			set, err := makeRecord(tdef, stmt.Cols, stmt.Vals, row)
+			if err != nil {
+				return 0, err
+			}
+			rec := table.Record{Cols: tdef.Cols, Vals: append([]table.Value(nil), row.vals...)}
+			pkChanged := false
+			for i, col := range set.Cols {
+				j := indexOf(tdef.Cols, col)
+				pkChanged = pkChanged || (j < tdef.PKeys && !sameValue(rec.Vals[j], set.Vals[i]))
+				rec.Vals[j] = set.Vals[i]
+			}
+			if pkChanged {
+				_, err = tx.Delete(tdef.Name, primaryKey(tdef, row.vals))
+				moved = append(moved, rec)
+			} else {
+				_, err = tx.Update(tdef.Name, rec)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		for _, rec := range moved {
+			added, err := tx.Insert(tdef.Name, rec)
+			if err != nil {
+				return 0, err
+			}
+			if !added {
+				return 0, errors.New("duplicate primary key")
+			}
+		}
+		return len(rows), nil
+	})
+}
+
+func sameValue(a, b table.Value) bool {
+	r, err := compareValues(a, b)
+	return err == nil && r == 0
+}
+
+func execDelete(db *table.DB, stmt *Delete) (*Result, error) {
+	tdef, rows, err := matchRows(db, stmt.Table, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	return update(db, func(tx *table.TX) (int, error) {
+		for _, row := range rows {
+			if _, err := tx.Delete(tdef.Name, primaryKey(tdef, row.vals)); err != nil {
+				return 0, err
+			}
+		}
+		return len(rows), nil
+	})
+}
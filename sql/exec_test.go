@@ -0,0 +1,279 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testOpen(t *testing.T) *table.DB {
+	t.Helper()
+	db := &table.DB{Path: t.TempDir() + "/sql.db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func testExec(t *testing.T, db *table.DB, query string) *Result {
+	t.Helper()
+	res, err := Exec(db, query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return res
+}
+
+// the rows of the result, the values are separated by commas
+func resultRows(res *Result) []string {
+	rows := []string{}
+	for _, row := range res.Rows {
+		vals := []string{}
+		for _, v := range row {
+			vals = append(vals, valueString(v))
+		}
+		rows = append(rows, strings.Join(vals, ","))
+	}
+	return rows
+}
+
+func expectRows(t *testing.T, db *table.DB, query string, want ...string) {
+	t.Helper()
+	got := resultRows(testExec(t, db, query))
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%s:\ngot  %q\nwant %q", query, got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	good := []string{
+		"CREATE TABLE t (a INT, b STRING, c FLOAT, d BYTES, PRIMARY KEY (a), UNIQUE INDEX i (b))",
+		"CREATE INDEX j ON t (c, d)",
+		"INSERT INTO t (a, b) VALUES (1, 'x'), (-2, 'it''s')",
+		"SELECT * FROM t",
+		"SELECT a AS x, -a, b FROM t AS u WHERE NOT (a > 1 OR b = 'x') AND c IS NULL ORDER BY x DESC, b LIMIT 3 OFFSET 1",
+		"UPDATE t SET a = a + 1, b = 'y' WHERE a % 2 = 0",
+		"DELETE FROM t WHERE a != 3",
+		"EXPLAIN SELECT * FROM t WHERE a = 1",
+		"ANALYZE t",
+		"SELECT 1 FROM t; SELECT 2 FROM t;",
+	}
+	for _, q := range good {
+		if _, err := Parse(q); err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+	}
+	bad := []string{
+		"SELEC * FROM t",
+		"SELECT FROM t",
+		"SELECT * FROM",
+		"SELECT * FROM t WHERE",
+		"SELECT * FROM t LIMIT x",
+		"INSERT INTO t VALUES (1, 'x'",
+		"CREATE TABLE t (a INT)",
+		"SELECT 'unterminated FROM t",
+		"SELECT a FROM t WHERE a = 9223372036854775808",
+		"SELECT a FROM t WHERE a = -9223372036854775809",
+	}
+	for _, q := range bad {
+		if _, err := Parse(q); err == nil {
+			t.Fatalf("%s: parsed", q)
+		}
+	}
+	// the smallest int64 is a literal
+	stmts, err := Parse("SELECT a FROM t WHERE a = -9223372036854775808")
+	if err != nil {
+		t.Fatal(err)
+	}
+	where := stmts[0].(*Select).Where
+	if lit := where.Kids[1]; lit.Op != EXPR_CONST || lit.Val.I64 != -1<<63 {
+		t.Fatalf("literal %s", lit)
+	}
+}
+
+func TestExecStatements(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE emp (id INT, name STRING, dept STRING, salary FLOAT, PRIMARY KEY (id), INDEX by_dept (dept, salary))")
+	res := testExec(t, db, "INSERT INTO emp VALUES (1, 'ann', 'eng', 100), (2, 'bob', 'eng', 90.5), (3, 'cy', 'ops', 70), (4, 'di''x', 'ops', 80), (5, 'ed', 'hr', 60)")
+	if res.Affected != 5 {
+		t.Fatalf("inserted %d rows", res.Affected)
+	}
+	expectRows(t, db, "SELECT * FROM emp WHERE id = 4", "4,'di''x','ops',80")
+	expectRows(t, db, "SELECT name, salary * 2 AS s FROM emp WHERE id >= 2 AND id < 4", "'bob',181", "'cy',140")
+	expectRows(t, db, "SELECT name FROM emp WHERE dept = 'eng' AND salary > 95", "'ann'")
+	expectRows(t, db, "SELECT id FROM emp WHERE salary > 75 OR NOT dept = 'eng'", "1", "2", "3", "4", "5")
+	expectRows(t, db, "SELECT id FROM emp WHERE salary > 75 AND NOT dept = 'eng'", "4")
+
+	res = testExec(t, db, "UPDATE emp SET salary = salary + 1 WHERE dept = 'ops'")
+	if res.Affected != 2 {
+		t.Fatalf("updated %d rows", res.Affected)
+	}
+	expectRows(t, db, "SELECT id, salary FROM emp WHERE dept = 'ops'", "3,71", "4,81")
+	// a new primary key for every row, the keys are shifted
+	testExec(t, db, "UPDATE emp SET id = id + 1")
+	expectRows(t, db, "SELECT id, name FROM emp", "2,'ann'", "3,'bob'", "4,'cy'", "5,'di''x'", "6,'ed'")
+	expectRows(t, db, "SELECT id FROM emp WHERE dept = 'eng' ORDER BY id", "2", "3")
+
+	res = testExec(t, db, "DELETE FROM emp WHERE dept = 'ops'")
+	if res.Affected != 2 {
+		t.Fatalf("deleted %d rows", res.Affected)
+	}
+	expectRows(t, db, "SELECT id FROM emp", "2", "3", "6")
+	expectRows(t, db, "SELECT id FROM emp WHERE dept = 'ops'")
+	testExec(t, db, "DELETE FROM emp")
+	expectRows(t, db, "SELECT id FROM emp")
+}
+
+func TestExecOrderLimit(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (a INT, b STRING, PRIMARY KEY (a))")
+	testExec(t, db, "INSERT INTO t VALUES (1, 'c'), (2, 'a'), (3, 'b'), (4, 'a'), (5, 'c')")
+	expectRows(t, db, "SELECT a FROM t ORDER BY b, a DESC", "4", "2", "3", "5", "1")
+	expectRows(t, db, "SELECT a FROM t ORDER BY a DESC LIMIT 2", "5", "4")
+	expectRows(t, db, "SELECT a FROM t ORDER BY b LIMIT 2 OFFSET 2", "3", "1")
+	expectRows(t, db, "SELECT a FROM t LIMIT 2 OFFSET 4", "5")
+	expectRows(t, db, "SELECT a FROM t LIMIT 0")
+	expectRows(t, db, "SELECT a FROM t LIMIT 2 OFFSET 9")
+	// the output names can be used in ORDER BY
+	expectRows(t, db, "SELECT a, -a AS n FROM t ORDER BY n LIMIT 2", "5,-5", "4,-4")
+}
+
+// the LIMIT cuts the sort buffer, the rows are the same as a full sort
+func TestExecOrderBuffer(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (a INT, b INT, PRIMARY KEY (a))")
+	rng := rand.New(rand.NewSource(1))
+	values := []string{}
+	for i := 0; i < 1000; i++ {
+		values = append(values, fmt.Sprintf("(%d, %d)", i, rng.Intn(50)))
+	}
+	testExec(t, db, "INSERT INTO t VALUES "+strings.Join(values, ", "))
+	for _, order := range []string{"b", "b DESC", "b, a DESC", "a % 7, b"} {
+		all := resultRows(testExec(t, db, "SELECT a, b FROM t ORDER BY "+order))
+		for _, lim := range [][2]int{{0, 0}, {1, 0}, {10, 0}, {10, 5}, {3, 997}, {100, 950}, {1000, 0}, {5, 2000}} {
+			query := fmt.Sprintf("SELECT a, b FROM t ORDER BY %s LIMIT %d OFFSET %d", order, lim[0], lim[1])
+			want := []string{}
+			if lim[1] < len(all) {
+				want = all[lim[1]:]
+			}
+			if lim[0] < len(want) {
+				want = want[:lim[0]]
+			}
+			if got := resultRows(testExec(t, db, query)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s:\ngot  %q\nwant %q", query, got, want)
+			}
+		}
+	}
+}
+
+// the WHERE ranges against a filter of all the rows
+func TestExecWhereRange(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (a INT, b INT, c STRING, PRIMARY KEY (a, b), INDEX by_c (c, b))")
+	type row struct {
+		a, b int64
+		c    string
+	}
+	rows := []row{}
+	rng := rand.New(rand.NewSource(1))
+	values := []string{}
+	for i := 0; i < 300; i++ {
+		r := row{int64(rng.Intn(10) - 5), int64(i), fmt.Sprint("c", rng.Intn(5))}
+		if i == 0 {
+			r.a = -1 << 63
+		}
+		if i == 1 {
+			r.a = 1<<63 - 1
+		}
+		rows = append(rows, r)
+		values = append(values, fmt.Sprintf("(%d, %d, '%s')", r.a, r.b, r.c))
+	}
+	testExec(t, db, "INSERT INTO t VALUES "+strings.Join(values, ", "))
+
+	conds := []struct {
+		where string
+		match func(r row) bool
+	}{
+		{"a = 3", func(r row) bool { return r.a == 3 }},
+		{"a > 3", func(r row) bool { return r.a > 3 }},
+		{"a >= 3", func(r row) bool { return r.a >= 3 }},
+		{"a < -3", func(r row) bool { return r.a < -3 }},
+		{"a <= -3", func(r row) bool { return r.a <= -3 }},
+		{"a > -2 AND a < 2", func(r row) bool { return r.a > -2 && r.a < 2 }},
+		{"-2 < a AND 2 >= a", func(r row) bool { return r.a > -2 && r.a <= 2 }},
+		{"a = 1 AND b > 100", func(r row) bool { return r.a == 1 && r.b > 100 }},
+		{"a = 1 AND b >= 100 AND b <= 200", func(r row) bool { return r.a == 1 && r.b >= 100 && r.b <= 200 }},
+		{"a = -9223372036854775808", func(r row) bool { return r.a == -1<<63 }},
+		{"a = 9223372036854775807", func(r row) bool { return r.a == 1<<63-1 }},
+		{"a > 9223372036854775806", func(r row) bool { return r.a > 1<<63-2 }},
+		{"a < -9223372036854775807", func(r row) bool { return r.a < -1<<63+1 }},
+		{"a > 5 AND a < 5", func(r row) bool { return false }},
+		{"c = 'c2'", func(r row) bool { return r.c == "c2" }},
+		{"c = 'c2' AND b < 50", func(r row) bool { return r.c == "c2" && r.b < 50 }},
+		{"c >= 'c3'", func(r row) bool { return r.c >= "c3" }},
+		{"c = 'c1' OR a = 2", func(r row) bool { return r.c == "c1" || r.a == 2 }},
+		{"b = 7", func(r row) bool { return r.b == 7 }},
+	}
+	for _, cond := range conds {
+		want := map[string]bool{}
+		for _, r := range rows {
+			if cond.match(r) {
+				want[fmt.Sprintf("%d,%d", r.a, r.b)] = true
+			}
+		}
+		got := map[string]bool{}
+		for _, key := range resultRows(testExec(t, db, "SELECT a, b FROM t WHERE "+cond.where)) {
+			if got[key] {
+				t.Fatalf("%s: duplicate row %s", cond.where, key)
+			}
+			got[key] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %d rows, want %d", cond.where, len(got), len(want))
+		}
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (a INT, b STRING, PRIMARY KEY (a), UNIQUE INDEX by_b (b))")
+	testExec(t, db, "INSERT INTO t VALUES (1, 'x'), (2, 'y')")
+	bad := []string{
+		"SELECT * FROM nope",
+		"SELECT nope FROM t",
+		"SELECT 'a' + 1 FROM t",
+		"INSERT INTO t VALUES (3)",
+		"INSERT INTO t VALUES ('x', 'z')",
+		"INSERT INTO t VALUES (1, 'z')",
+		"INSERT INTO t VALUES (3, 'x')",
+		"INSERT INTO t (a, a) VALUES (3, 4)",
+		"UPDATE t SET b = 'y' WHERE a = 1",
+		"UPDATE t SET nope = 1",
+		"CREATE TABLE t (a INT, PRIMARY KEY (a))",
+		// the statements before an error are run
+		"INSERT INTO t VALUES (5, 'v'); SELECT nope FROM t",
+	}
+	for _, q := range bad {
+		if _, err := Exec(db, q); err == nil {
+			t.Fatalf("%s: no error", q)
+		}
+	}
+	// the failed statements change nothing
+	expectRows(t, db, "SELECT * FROM t", "1,'x'", "2,'y'", "5,'v'")
+	testExec(t, db, "INSERT INTO t VALUES (3, 'x2'), (4, 'x3')")
+	if _, err := Exec(db, "INSERT INTO t VALUES (6, 'a'), (7, 'x')"); err == nil {
+		t.Fatal("duplicate value in a unique index")
+	}
+	expectRows(t, db, "SELECT a FROM t", "1", "2", "3", "4", "5")
+}
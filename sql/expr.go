@@ -0,0 +1,368 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the columns visible to an expression
+type env struct {
+	tables []string // the table alias of each column
+	cols   []string
+	vals   []table.Value
+	aggs   map[*Expr]table.Value // the aggregates of a group
+}
+
+func newEnv(alias string, cols []string, vals []table.Value) *env {
+	tables := make([]string, len(cols))
+	for i := range tables {
+		tables[i] = alias
+	}
+	return &env{tables: tables, cols: cols, vals: vals}
+}
+
+// the columns of 2 tables side by side
+func joinEnv(a *env, b *env) *env {
+	return &env{
+		tables: append(append([]string(nil), a.tables...), b.tables...),
+		cols:   append(append([]string(nil), a.cols...), b.cols...),
+		vals:   append(append([]table.Value(nil), a.vals...), b.vals...),
+	}
+}
+
+// split a column name qualified by the table
+func splitName(name string) (alias string, col string) {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// find a column by its name
+func (e *env) lookup(name string) (*table.Value, error) {
+	alias, col := splitName(name)
+	found := -1
+	if e != nil {
+		for i := range e.cols {
+			if e.cols[i] == col && (alias == "" || e.tables[i] == alias) {
+				if found >= 0 {
+					return nil, fmt.Errorf("ambiguous column: %s", name)
+				}
+				found = i
+			}
+		}
+	}
+	if found < 0 {
+		return nil, fmt.Errorf("unknown column: %s", name)
+	}
+	return &e.vals[found], nil
+}
+
+func boolValue(b bool) table.Value {
+	v := table.Value{Type: table.TYPE_INT64}
+	if b {
+		v.I64 = 1
+	}
+	return v
+}
+
+func isNull(v table.Value) bool {
+	return v.Type == table.TYPE_ERROR
+}
+
+func isTrue(v table.Value) bool {
+	switch v.Type {
+	case table.TYPE_ERROR:
+		return false
+	case table.TYPE_INT64:
+		return v.I64 != 0
+	case table.TYPE_FLOAT64:
+		return v.F64 != 0
+	default:
+		return len(v.Str) > 0
+	}
+}
+
+func isNumber(v table.Value) bool {
+	return v.Type == table.TYPE_INT64 || v.Type == table.TYPE_FLOAT64
+}
+
+func toFloat(v table.Value) float64 {
+	if v.Type == table.TYPE_INT64 {
+		return float64(v.I64)
+	}
+	return v.F64
+}
+
+// compare 2 values, the integers are compared to the floats as numbers,
+// the strings are compared to the bytes. NULL is the smallest.
+func compareValues(a, b table.Value) (int, error) {
+	switch {
+	case isNull(a) || isNull(b):
+		return cmpInt(boolValue(!isNull(a)).I64, boolValue(!isNull(b)).I64), nil
+	case a.Type == table.TYPE_INT64 && b.Type == table.TYPE_INT64:
+		return cmpInt(a.I64, b.I64), nil
+	case isNumber(a) && isNumber(b):
+		return cmpFloat(toFloat(a), toFloat(b)), nil
+	case !isNumber(a) && !isNumber(b):
+		return bytes.Compare(a.Str, b.Str), nil
+	}
+	return 0, errors.New("comparing a number with a string")
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return +1
+	}
+	return 0
+}
+
+// convert a value to a column type, the result must be exact
+func coerce(v table.Value, typ uint32) (table.Value, bool) {
+	switch {
+	case v.Type == typ:
+		return v, true
+	case v.Type == table.TYPE_INT64 && typ == table.TYPE_FLOAT64:
+		return table.Value{Type: typ, F64: float64(v.I64)}, true
+	case v.Type == table.TYPE_FLOAT64 && typ == table.TYPE_INT64:
+		i := int64(v.F64)
+		return table.Value{Type: typ, I64: i}, float64(i) == v.F64
+	case !isNumber(v) && (typ == table.TYPE_STRING || typ == table.TYPE_BYTES):
+		return table.Value{Type: typ, Str: v.Str}, true
+	}
+	return v, false
+}
+
+func arith(op int, a, b table.Value) (table.Value, error) {
+	if !isNumber(a) || !isNumber(b) {
+		if op == EXPR_ADD && !isNumber(a) && !isNumber(b) {
+			// string concatenation
+			str := append(append([]byte(nil), a.Str...), b.Str...)
+			return table.Value{Type: a.Type, Str: str}, nil
+		}
+		return table.Value{}, errors.New("arithmetic on a non-number")
+	}
+	if a.Type == table.TYPE_INT64 && b.Type == table.TYPE_INT64 {
+		x, y := a.I64, b.I64
+		r := int64(0)
+		switch op {
+		case EXPR_ADD:
+			r = x + y
+		case EXPR_SUB:
+			r = x - y
+		case EXPR_MUL:
+			r = x * y
+		case EXPR_DIV, EXPR_MOD:
+			if y == 0 {
+				return table.Value{}, errors.New("division by zero")
+			}
+			if op == EXPR_DIV {
+				r = x / y
+			} else {
+				r = x % y
+			}
+		}
+		return table.Value{Type: table.TYPE_INT64, I64: r}, nil
+	}
+	x, y := toFloat(a), toFloat(b)
+	r := 0.0
+	switch op {
+	case EXPR_ADD:
+		r = x + y
+	case EXPR_SUB:
+		r = x - y
+	case EXPR_MUL:
+		r = x * y
+	case EXPR_DIV:
+		r = x / y
+	case EXPR_MOD:
+		return table.Value{}, errors.New("modulo on a float")
+	}
+	return table.Value{Type: table.TYPE_FLOAT64, F64: r}, nil
+}
+
+// AND and OR with NULL as unknown
+func logic(op int, a, b table.Value) table.Value {
+	switch {
+	case op == EXPR_AND && ((!isNull(a) && !isTrue(a)) || (!isNull(b) && !isTrue(b))):
+		return boolValue(false)
+	case op == EXPR_OR && (isTrue(a) || isTrue(b)):
+		return boolValue(true)
+	case isNull(a) || isNull(b):
+		return table.Value{}
+	}
+	return boolValue(op == EXPR_AND)
+}
+
+func eval(e *Expr, row *env) (table.Value, error) {
+	switch e.Op {
+	case EXPR_CONST:
+		return e.Val, nil
+	case EXPR_COL:
+		v, err := row.lookup(e.Name)
+		if err != nil {
+			return table.Value{}, err
+		}
+		return *v, nil
+	case EXPR_FUNC:
+		if row != nil && row.aggs != nil {
+			if v, ok := row.aggs[e]; ok {
+				return v, nil
+			}
+		}
+		if aggFuncs[e.Name] {
+			return table.Value{}, fmt.Errorf("aggregate %s is not allowed here", e.Name)
+		}
+		return table.Value{}, fmt.Errorf("unknown function: %s", e.Name)
+	case EXPR_NEG:
+		v, err := eval(e.Kids[0], row)
+		if err != nil {
+			return v, err
+		}
+		switch v.Type {
+		case table.TYPE_ERROR:
+		case table.TYPE_INT64:
+			v.I64 = -v.I64
+		case table.TYPE_FLOAT64:
+			v.F64 = -v.F64
+		default:
+			return v, errors.New("negating a non-number")
+		}
+		return v, nil
+	case EXPR_NOT:
+		v, err := eval(e.Kids[0], row)
+		if err != nil || isNull(v) {
+			return v, err
+		}
+		return boolValue(!isTrue(v)), nil
+	case EXPR_NULL:
+		v, err := eval(e.Kids[0], row)
+		return boolValue(isNull(v)), err
+	case EXPR_AND, EXPR_OR:
+		// short circuit
+		a, err := eval(e.Kids[0], row)
+		if err != nil {
+			return a, err
+		}
+		if !isNull(a) && isTrue(a) == (e.Op == EXPR_OR) {
+			return boolValue(isTrue(a)), nil
+		}
+		b, err := eval(e.Kids[1], row)
+		return logic(e.Op, a, b), err
+	}
+
+	a, err := eval(e.Kids[0], row)
+	if err != nil {
+		return a, err
+	}
+	b, err := eval(e.Kids[1], row)
+	if err != nil {
+		return b, err
+	}
+	if isNull(a) || isNull(b) {
+		return table.Value{}, nil
+	}
+	switch e.Op {
+	case EXPR_ADD, EXPR_SUB, EXPR_MUL, EXPR_DIV, EXPR_MOD:
+		return arith(e.Op, a, b)
+	}
+	r, err := compareValues(a, b)
+	if err != nil {
+		return table.Value{}, err
+	}
+	switch e.Op {
+	case EXPR_EQ:
+		return boolValue(r == 0), nil
+	case EXPR_NE:
+		return boolValue(r != 0), nil
+	case EXPR_LT:
+		return boolValue(r < 0), nil
+	case EXPR_LE:
+		return boolValue(r <= 0), nil
+	case EXPR_GT:
+		return boolValue(r > 0), nil
+	case EXPR_GE:
+		return boolValue(r >= 0), nil
+	}
+	panic("unreachable")
+}
+
+// whether the expression only has constants
+func isConst(e *Expr) bool {
+	if e.Op == EXPR_COL {
+		return false
+	}
+	for _, kid := range e.Kids {
+		if !isConst(kid) {
+			return false
+		}
+	}
+	return true
+}
+
+var opNames = map[int]string{
+	EXPR_ADD: "+", EXPR_SUB: "-", EXPR_MUL: "*", EXPR_DIV: "/", EXPR_MOD: "%",
+	EXPR_EQ: "=", EXPR_NE: "!=", EXPR_LT: "<", EXPR_LE: "<=", EXPR_GT: ">", EXPR_GE: ">=",
+	EXPR_AND: "AND", EXPR_OR: "OR",
+}
+
+func valueString(v table.Value) string {
+	switch v.Type {
+	case table.TYPE_ERROR:
+		return "NULL"
+	case table.TYPE_INT64:
+		return strconv.FormatInt(v.I64, 10)
+	case table.TYPE_FLOAT64:
+		return strconv.FormatFloat(v.F64, 'g', -1, 64)
+	}
+	return "'" + strings.ReplaceAll(string(v.Str), "'", "''") + "'"
+}
+
+// format the expression as SQL, the nested operators are in parentheses
+func (e *Expr) String() string {
+	kid := func(k *Expr) string {
+		if len(k.Kids) == 2 {
+			return "(" + k.String() + ")"
+		}
+		return k.String()
+	}
+	switch e.Op {
+	case EXPR_CONST:
+		return valueString(e.Val)
+	case EXPR_COL:
+		return e.Name
+	case EXPR_NEG:
+		return "-" + kid(e.Kids[0])
+	case EXPR_NOT:
+		return "NOT " + kid(e.Kids[0])
+	case EXPR_NULL:
+		return kid(e.Kids[0]) + " IS NULL"
+	case EXPR_FUNC:
+		args := []string{}
+		for _, k := range e.Kids {
+			args = append(args, k.String())
+		}
+		if e.Name == "COUNT" && len(args) == 0 {
+			args = append(args, "*")
+		}
+		return e.Name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return kid(e.Kids[0]) + " " + opNames[e.Op] + " " + kid(e.Kids[1])
+}
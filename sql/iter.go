@@ -0,0 +1,89 @@
+package sql
+
+import "build_your_own_db/table"
+
+// the rows of a query are pulled one at a time through a chain of
+// iterators, so only the current rows are in memory.
+type rowIter interface {
+	next() (*env, error) // nil at the end
+}
+
+// whether the row passes the filter, NULL is false
+func test(filter *Expr, row *env) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	v, err := eval(filter, row)
+	return isTrue(v), err
+}
+
+// the rows of a table scan
+type scanIter struct {
+	db      *table.DB
+	sc      *scan
+	req     *table.Scanner
+	started bool
+}
+
+func (sc *scan) iter(db *table.DB) *scanIter {
+	return &scanIter{db: db, sc: sc, req: &sc.req}
+}
+
+func (it *scanIter) next() (*env, error) {
+	if !it.started {
+		it.started = true
+		if err := it.db.Scan(it.sc.tdef.Name, it.req); err != nil {
+			return nil, err
+		}
+	} else {
+		it.req.Next()
+	}
+	for ; it.req.Valid(); it.req.Next() {
+		rec := table.Record{}
+		if err := it.req.Deref(&rec); err != nil {
+			return nil, err
+		}
+		row := newEnv(it.sc.alias, rec.Cols, rec.Vals)
+		ok, err := test(it.sc.filter, row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return row, nil
+		}
+	}
+	return nil, nil
+}
+
+// the rows that pass a filter
+type filterIter struct {
+	in     rowIter
+	filter *Expr
+}
+
+func (it *filterIter) next() (*env, error) {
+	for {
+		row, err := it.in.next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		ok, err := test(it.filter, row)
+		if err != nil || ok {
+			return row, err
+		}
+	}
+}
+
+// iterate the rows, stop if fn returns false
+func each(it rowIter, fn func(row *env) (bool, error)) error {
+	for {
+		row, err := it.next()
+		if err != nil || row == nil {
+			return err
+		}
+		more, err := fn(row)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"math"
+)
+
+// joins in the order of the FROM clause, the rows so far are the outer
+// rows and the joined table is the inner table. for each outer row,
+// the inner rows are found by one of:
+//   - a range on the primary key or an index of the inner table, from
+//     the equalities of the ON between the inner and the outer columns;
+//   - a merge with a scan of the inner table, when both sides are in
+//     the order of the joined columns;
+//   - a full scan of the inner table.
+// the order of the outer rows is kept. a LEFT JOIN also outputs the
+// outer rows without a match, the inner columns are NULL.
+
+const (
+	JOIN_LOOP   = 0 // a full scan of the inner table for each outer row
+	JOIN_LOOKUP = 1 // a range on an inner key for each outer row
+	JOIN_MERGE  = 2 // a scan of the inner table along the outer rows
+)
+
+var joinNames = []string{"nested loop", "index nested loop", "merge"}
+
+type joinPlan struct {
+	join   *Join
+	method int
+	inner  *scan   // the scan for each outer row, or the merged scan
+	outer  []*Expr // the outer values of the inner key columns
+	rows   float64 // the estimated output rows
+	pages  float64 // the estimated pages read by the join
+}
+
+// a table of the FROM clause
+type source struct {
+	alias string
+	tdef  *table.TableDef
+}
+
+// find the table of a column, -1 if not found or ambiguous
+func resolve(name string, srcs []source) (int, string) {
+	alias, col := splitName(name)
+	found := -1
+	for i, src := range srcs {
+		if (alias == "" || alias == src.alias) && indexOf(src.tdef.Cols, col) >= 0 {
+			if found >= 0 {
+				return -1, ""
+			}
+			found = i
+		}
+	}
+	return found, col
+}
+
+// whether the expression only uses the columns of the first n tables
+func usesOnly(e *Expr, srcs []source, n int) bool {
+	switch e.Op {
+	case EXPR_COL:
+		i, _ := resolve(e.Name, srcs)
+		return 0 <= i && i < n
+	case EXPR_FUNC:
+		return false
+	}
+	for _, kid := range e.Kids {
+		if !usesOnly(kid, srcs, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// an equality of the ON between an inner column and the outer rows
+type joinCond struct {
+	col   string // the column of the table n
+	outer *Expr
+}
+
+func joinConds(on *Expr, srcs []source, n int, out []joinCond) []joinCond {
+	if on == nil {
+		return out
+	}
+	if on.Op == EXPR_AND {
+		out = joinConds(on.Kids[0], srcs, n, out)
+		return joinConds(on.Kids[1], srcs, n, out)
+	}
+	if on.Op != EXPR_EQ {
+		return out
+	}
+	for side := 0; side < 2; side++ {
+		col, other := on.Kids[side], on.Kids[1-side]
+		if col.Op != EXPR_COL {
+			continue
+		}
+		if i, name := resolve(col.Name, srcs); i == n && usesOnly(other, srcs, n) {
+			return append(out, joinCond{col: name, outer: other})
+		}
+	}
+	return out
+}
+
+func findJoinCond(conds []joinCond, col string) *joinCond {
+	for i := range conds {
+		if conds[i].col == col {
+			return &conds[i]
+		}
+	}
+	return nil
+}
+
+// the keys of a table: the primary key then the indexes
+func tableKeys(tdef *table.TableDef) (names []string, keys [][]string) {
+	names, keys = []string{""}, [][]string{tdef.Cols[:tdef.PKeys]}
+	for _, idx := range tdef.Indexes {
+		names = append(names, idx.Name)
+		keys = append(keys, append(append([]string(nil), idx.Cols...), tdef.Cols[:tdef.PKeys]...))
+	}
+	return names, keys
+}
+
+func newKeyScan(tdef *table.TableDef, alias string, index string, keyCols []string) *scan {
+	sc := &scan{tdef: tdef, alias: alias, access: PLAN_PK, keyCols: keyCols}
+	if index != "" {
+		sc.access = PLAN_INDEX
+		sc.req.Index = index
+	}
+	return sc
+}
+
+// pick the method of the join n of the query
+func planJoin(db *table.DB, q *query, n int) (*joinPlan, error) {
+	join := &q.stmt.Joins[n-1]
+	src := q.srcs[n]
+	stats, err := db.TableStats(src.tdef.Name)
+	if err != nil {
+		return nil, err
+	}
+	conds := joinConds(join.On, q.srcs[:n+1], n, nil)
+	outerRows := q.scan.rows
+	if n > 1 {
+		outerRows = q.joins[n-2].rows
+	}
+
+	// a full scan for each outer row
+	full := &scan{tdef: src.tdef, alias: src.alias, access: PLAN_FULL, keyCols: src.tdef.Cols[:src.tdef.PKeys]}
+	estimate(full, stats)
+	best := &joinPlan{join: join, method: JOIN_LOOP, inner: full, pages: outerRows * full.pages}
+	perRow := full.rows
+
+	names, keys := tableKeys(src.tdef)
+	for k := range keys {
+		// a range for each outer row from the equalities on a key prefix
+		sc := newKeyScan(src.tdef, src.alias, names[k], keys[k])
+		outer := []*Expr{}
+		for _, col := range sc.keyCols {
+			cond := findJoinCond(conds, col)
+			if cond == nil {
+				break
+			}
+			outer = append(outer, cond.outer)
+			sc.bounds = append(sc.bounds, src.alias+"."+col+" = "+cond.outer.String())
+			sc.neq++
+		}
+		if sc.neq == 0 {
+			continue
+		}
+		estimate(sc, stats)
+		if pages := outerRows * sc.pages; pages < best.pages {
+			best = &joinPlan{join: join, method: JOIN_LOOKUP, inner: sc, outer: outer, pages: pages}
+			perRow = sc.rows
+		}
+
+		// a merge if the outer rows are in the order of the key prefix
+		merge := q.mergeKeys(src, sc.keyCols, conds)
+		if len(merge) == 0 {
+			continue
+		}
+		ms := newKeyScan(src.tdef, src.alias, names[k], keys[k])
+		if ms.access == PLAN_PK {
+			ms.access = PLAN_FULL
+		}
+		ms.bounds = sc.bounds[:len(merge)]
+		estimate(ms, stats)
+		if ms.pages < best.pages {
+			best = &joinPlan{join: join, method: JOIN_MERGE, inner: ms, outer: merge, pages: ms.pages}
+			// the matches of each outer row
+			tmp := newKeyScan(src.tdef, src.alias, names[k], keys[k])
+			tmp.neq = len(merge)
+			tmp.bounds = ms.bounds
+			estimate(tmp, stats)
+			perRow = tmp.rows
+		}
+	}
+
+	best.rows = outerRows * perRow
+	if join.Kind == JOIN_LEFT {
+		best.rows = math.Max(best.rows, outerRows)
+	}
+	return best, nil
+}
+
+// the outer columns that can be merged with the inner key columns:
+// the driving scan must be in the order of these columns.
+func (q *query) mergeKeys(src source, keyCols []string, conds []joinCond) []*Expr {
+	drive := q.scan
+	for skip := 0; skip <= drive.neq; skip++ {
+		merge := []*Expr{}
+		for i, col := range keyCols {
+			cond := findJoinCond(conds, col)
+			if cond == nil || skip+i >= len(drive.keyCols) {
+				break
+			}
+			outer := drive.colName(cond.outer)
+			if outer == "" || outer != drive.keyCols[skip+i] {
+				break
+			}
+			if drive.tdef.Types[indexOf(drive.tdef.Cols, outer)] != src.tdef.Types[indexOf(src.tdef.Cols, col)] {
+				break
+			}
+			merge = append(merge, cond.outer)
+		}
+		if len(merge) > 0 {
+			return merge
+		}
+	}
+	return nil
+}
+
+// the inner rows for an outer row, nil if nothing can match
+func (p *joinPlan) lookup(db *table.DB, row *env) (*scanIter, error) {
+	sc := *p.inner
+	sc.req = table.Scanner{Index: p.inner.req.Index}
+	for i, e := range p.outer {
+		v, err := eval(e, row)
+		if err != nil {
+			return nil, err
+		}
+		col := sc.keyCols[i]
+		v, ok := coerce(v, sc.tdef.Types[indexOf(sc.tdef.Cols, col)])
+		if !ok || isNull(v) {
+			return nil, nil
+		}
+		sc.req.Key1.Cols = append(sc.req.Key1.Cols, col)
+		sc.req.Key1.Vals = append(sc.req.Key1.Vals, v)
+		sc.req.Key2.Cols = append(sc.req.Key2.Cols, col)
+		sc.req.Key2.Vals = append(sc.req.Key2.Vals, v)
+	}
+	return sc.iter(db), nil
+}
+
+// the inner columns of an outer row without a match
+func (p *joinPlan) nulls() *env {
+	tdef := p.inner.tdef
+	return newEnv(p.inner.alias, tdef.Cols, make([]table.Value, len(tdef.Cols)))
+}
+
+// a nested loop join, with a full scan or a key range for each outer row
+type loopJoinIter struct {
+	db      *table.DB
+	plan    *joinPlan
+	outer   rowIter
+	cur     *env // the outer row
+	inner   *scanIter
+	matched bool
+}
+
+func (it *loopJoinIter) next() (*env, error) {
+	for {
+		if it.cur == nil {
+			row, err := it.outer.next()
+			if err != nil || row == nil {
+				return nil, err
+			}
+			it.cur, it.matched = row, false
+			if it.inner, err = it.plan.lookup(it.db, row); err != nil {
+				return nil, err
+			}
+		}
+		if it.inner != nil {
+			row, err := it.inner.next()
+			if err != nil {
+				return nil, err
+			}
+			if row != nil {
+				joined := joinEnv(it.cur, row)
+				ok, err := test(it.plan.join.On, joined)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					it.matched = true
+					return joined, nil
+				}
+				continue
+			}
+		}
+		cur := it.cur
+		it.cur = nil
+		if it.plan.join.Kind == JOIN_LEFT && !it.matched {
+			return joinEnv(cur, it.plan.nulls()), nil
+		}
+	}
+}
+
+// a merge join, both sides are sorted by the joined columns.
+// the inner rows with the same key are kept for the outer rows
+// with the same key.
+type mergeJoinIter struct {
+	plan    *joinPlan
+	outer   rowIter
+	inner   *scanIter
+	keys    []*Expr // the inner key columns
+	peek    *env    // the next inner row
+	done    bool    // no more inner rows
+	group   []*env  // the inner rows of the key
+	gkey    []table.Value
+	cur     *env // the outer row
+	pos     int  // in the group
+	matched bool
+}
+
+func newMergeJoin(db *table.DB, plan *joinPlan, outer rowIter) *mergeJoinIter {
+	sc := *plan.inner
+	sc.req = table.Scanner{Index: plan.inner.req.Index}
+	it := &mergeJoinIter{plan: plan, outer: outer, inner: sc.iter(db)}
+	for _, col := range sc.keyCols[:len(plan.outer)] {
+		it.keys = append(it.keys, &Expr{Op: EXPR_COL, Name: sc.alias + "." + col})
+	}
+	return it
+}
+
+func evalAll(exprs []*Expr, row *env) ([]table.Value, error) {
+	vals := make([]table.Value, len(exprs))
+	for i, e := range exprs {
+		v, err := eval(e, row)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func compareKeys(a []table.Value, b []table.Value) (int, error) {
+	for i := range a {
+		if r, err := compareValues(a[i], b[i]); err != nil || r != 0 {
+			return r, err
+		}
+	}
+	return 0, nil
+}
+
+// collect the inner rows of a key, the smaller keys are skipped
+func (it *mergeJoinIter) fill(key []table.Value) error {
+	it.group, it.gkey = it.group[:0], key
+	for _, v := range key {
+		if isNull(v) {
+			return nil
+		}
+	}
+	for {
+		if it.peek == nil && !it.done {
+			row, err := it.inner.next()
+			if err != nil {
+				return err
+			}
+			it.peek, it.done = row, row == nil
+		}
+		if it.peek == nil {
+			return nil
+		}
+		ikey, err := evalAll(it.keys, it.peek)
+		if err != nil {
+			return err
+		}
+		r, err := compareKeys(ikey, key)
+		if err != nil || r > 0 {
+			return err
+		}
+		if r == 0 {
+			it.group = append(it.group, it.peek)
+		}
+		it.peek = nil
+	}
+}
+
+func (it *mergeJoinIter) next() (*env, error) {
+	for {
+		if it.cur == nil {
+			row, err := it.outer.next()
+			if err != nil || row == nil {
+				return nil, err
+			}
+			key, err := evalAll(it.plan.outer, row)
+			if err != nil {
+				return nil, err
+			}
+			same := it.gkey != nil
+			if same {
+				r, err := compareKeys(key, it.gkey)
+				if err != nil {
+					return nil, err
+				}
+				same = r == 0
+			}
+			if !same {
+				if err := it.fill(key); err != nil {
+					return nil, err
+				}
+			}
+			it.cur, it.pos, it.matched = row, 0, false
+		}
+		for it.pos < len(it.group) {
+			joined := joinEnv(it.cur, it.group[it.pos])
+			it.pos++
+			ok, err := test(it.plan.join.On, joined)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				it.matched = true
+				return joined, nil
+			}
+		}
+		cur := it.cur
+		it.cur = nil
+		if it.plan.join.Kind == JOIN_LEFT && !it.matched {
+			return joinEnv(cur, it.plan.nulls()), nil
+		}
+	}
+}
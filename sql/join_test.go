@@ -0,0 +1,192 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// the departments and the employees, "empty" has no employee and
+// "fay" has no department
+func testCompany(t *testing.T) *table.DB {
+	t.Helper()
+	db := testOpen(t)
+	testExec(t, db, "CREATE TABLE dept (id INT, name STRING, PRIMARY KEY (id))")
+	testExec(t, db, "CREATE TABLE emp (id INT, name STRING, dept INT, salary INT, PRIMARY KEY (id), INDEX by_dept (dept))")
+	testExec(t, db, "INSERT INTO dept VALUES (1, 'eng'), (2, 'ops'), (3, 'hr'), (4, 'empty')")
+	testExec(t, db, "INSERT INTO emp VALUES (1, 'ann', 1, 100), (2, 'bob', 1, 90), (3, 'cy', 2, 70), (4, 'di', 2, 80), (5, 'ed', 3, 60), (6, 'fay', 99, 50), (7, 'gus', 1, 95)")
+	return db
+}
+
+// the join method of the joined table n in the EXPLAIN
+func expectJoin(t *testing.T, db *table.DB, query string, n int, join string) {
+	t.Helper()
+	row := testExec(t, db, "EXPLAIN "+query).Rows[n]
+	if got := string(row[1].Str); got != join {
+		t.Fatalf("%s: %s, want %s", query, got, join)
+	}
+}
+
+func TestJoinMethods(t *testing.T) {
+	db := testCompany(t)
+	defer db.Close()
+	cases := []struct {
+		query string
+		join  string
+		rows  []string
+	}{
+		{
+			"SELECT e.name, d.name FROM emp e JOIN dept d ON d.id = e.dept",
+			"inner index nested loop",
+			[]string{"'ann','eng'", "'bob','eng'", "'cy','ops'", "'di','ops'", "'ed','hr'", "'gus','eng'"},
+		},
+		{
+			"SELECT e.name, d.name FROM emp e LEFT JOIN dept d ON d.id = e.dept",
+			"left index nested loop",
+			[]string{"'ann','eng'", "'bob','eng'", "'cy','ops'", "'di','ops'", "'ed','hr'", "'fay',NULL", "'gus','eng'"},
+		},
+		{
+			"SELECT e.name, d.name FROM dept d JOIN emp e ON e.dept = d.id",
+			"inner merge",
+			[]string{"'ann','eng'", "'bob','eng'", "'gus','eng'", "'cy','ops'", "'di','ops'", "'ed','hr'"},
+		},
+		{
+			"SELECT e.name, d.name FROM dept d LEFT JOIN emp e ON e.dept = d.id",
+			"left merge",
+			[]string{"'ann','eng'", "'bob','eng'", "'gus','eng'", "'cy','ops'", "'di','ops'", "'ed','hr'", "NULL,'empty'"},
+		},
+		{
+			"SELECT e.name, d.name FROM emp e JOIN dept d ON d.id + 1 = e.dept",
+			"inner nested loop",
+			[]string{"'cy','eng'", "'di','eng'", "'ed','ops'"},
+		},
+		{
+			"SELECT e.name, d.name FROM emp e LEFT JOIN dept d ON d.id + 1 = e.dept",
+			"left nested loop",
+			[]string{"'ann',NULL", "'bob',NULL", "'cy','eng'", "'di','eng'", "'ed','ops'", "'fay',NULL", "'gus',NULL"},
+		},
+		{
+			// the ON is checked on the looked up rows
+			"SELECT e.name, d.name FROM emp e LEFT JOIN dept d ON d.id = e.dept AND e.salary > 85",
+			"left index nested loop",
+			[]string{"'ann','eng'", "'bob','eng'", "'cy',NULL", "'di',NULL", "'ed',NULL", "'fay',NULL", "'gus','eng'"},
+		},
+		{
+			// the WHERE is applied after the LEFT JOIN
+			"SELECT d.name FROM dept d LEFT JOIN emp e ON e.dept = d.id WHERE e.id IS NULL",
+			"left merge",
+			[]string{"'empty'"},
+		},
+		{
+			"SELECT a.name, b.name FROM emp a JOIN emp b ON b.dept = a.dept AND b.id > a.id WHERE a.dept = 1",
+			"inner index nested loop",
+			[]string{"'ann','bob'", "'ann','gus'", "'bob','gus'"},
+		},
+		{
+			"SELECT e.name, d.name, x.name FROM emp e JOIN dept d ON d.id = e.dept LEFT JOIN emp x ON x.dept = d.id AND x.salary > e.salary",
+			"left index nested loop",
+			[]string{
+				"'ann','eng',NULL", "'bob','eng','ann'", "'bob','eng','gus'", "'cy','ops','di'", "'di','ops',NULL",
+				"'ed','hr',NULL", "'gus','eng','ann'",
+			},
+		},
+	}
+	for _, c := range cases {
+		expectJoin(t, db, c.query, strings.Count(c.query, "JOIN"), c.join)
+		expectRows(t, db, c.query, c.rows...)
+	}
+	expectRows(t, db, "SELECT * FROM dept d JOIN emp e ON e.dept = d.id WHERE e.id = 5", "3,'hr',5,'ed',3,60")
+	for _, q := range []string{
+		"SELECT * FROM emp JOIN emp ON id = id",
+		"SELECT * FROM emp e JOIN nope n ON n.id = e.id",
+		"SELECT name FROM emp e JOIN dept d ON d.id = e.dept",
+		"SELECT * FROM emp e JOIN dept d ON COUNT(*) = 1",
+	} {
+		if _, err := Exec(db, q); err == nil {
+			t.Fatalf("%s: no error", q)
+		}
+	}
+}
+
+// the join methods against a join of all the pairs
+func TestJoinRandom(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE a (id INT, k INT, PRIMARY KEY (id), INDEX by_k (k))")
+	testExec(t, db, "CREATE TABLE b (k INT, n INT, PRIMARY KEY (k, n))")
+	rng := rand.New(rand.NewSource(1))
+	type row struct{ x, y int64 }
+	as, bs := []row{}, []row{}
+	values := []string{}
+	for i := 0; i < 200; i++ {
+		as = append(as, row{int64(i), int64(rng.Intn(50))})
+		values = append(values, fmt.Sprintf("(%d, %d)", i, as[i].y))
+	}
+	testExec(t, db, "INSERT INTO a VALUES "+strings.Join(values, ", "))
+	values = values[:0]
+	for k := int64(0); k < 60; k += 2 {
+		for n := int64(0); n < k%3; n++ {
+			bs = append(bs, row{k, n})
+			values = append(values, fmt.Sprintf("(%d, %d)", k, n))
+		}
+	}
+	testExec(t, db, "INSERT INTO b VALUES "+strings.Join(values, ", "))
+
+	for _, left := range []bool{false, true} {
+		kind, method := "JOIN", "inner "
+		if left {
+			kind, method = "LEFT JOIN", "left "
+		}
+		// the outer rows of a then b
+		for _, outerA := range []bool{true, false} {
+			want := []string{}
+			outer, inner := as, bs
+			if !outerA {
+				outer, inner = bs, as
+			}
+			for _, ro := range outer {
+				matched := false
+				for _, ri := range inner {
+					ra, rb := ro, ri
+					if !outerA {
+						ra, rb = ri, ro
+					}
+					if ra.y == rb.x {
+						want = append(want, fmt.Sprintf("%d,%d,%d", ra.x, rb.x, rb.y))
+						matched = true
+					}
+				}
+				if left && !matched && outerA {
+					want = append(want, fmt.Sprintf("%d,NULL,NULL", ro.x))
+				} else if left && !matched {
+					want = append(want, fmt.Sprintf("NULL,%d,%d", ro.x, ro.y))
+				}
+			}
+			sort.Strings(want)
+			joins := []struct{ from, join string }{
+				{"a %s b ON b.k = a.k", "index nested loop"},
+				{"a %s b ON b.k + 0 = a.k", "nested loop"},
+			}
+			if !outerA {
+				joins = []struct{ from, join string }{
+					{"b %s a ON a.k = b.k", "merge"},
+					{"b %s a ON a.k = b.k + 0", "index nested loop"},
+					{"b %s a ON a.k + 0 = b.k", "nested loop"},
+				}
+			}
+			for _, j := range joins {
+				query := "SELECT a.id, b.k, b.n FROM " + fmt.Sprintf(j.from, kind)
+				expectJoin(t, db, query, 1, method+j.join)
+				got := resultRows(testExec(t, db, query))
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: got %d rows, want %d", query, len(got), len(want))
+				}
+			}
+		}
+	}
+}
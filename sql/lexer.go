@@ -0,0 +1,112 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	TOK_EOF   = 0
+	TOK_IDENT = 1 // names and keywords
+	TOK_INT   = 2
+	TOK_FLOAT = 3
+	TOK_STR   = 4 // 'quoted'
+	TOK_SYM   = 5 // operators and punctuation
+)
+
+type token struct {
+	kind int
+	text string // the string value for TOK_STR
+	pos  int    // offset in the query
+}
+
+var symbols = []string{"<=", ">=", "!=", "<>", "(", ")", ",", ";", "*", "+", "-", "/", "%", "=", "<", ">", "."}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+func isAlpha(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
+
+// split the query into tokens
+func tokenize(query string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(query); {
+		ch := query[i]
+		start := i
+		switch {
+		case isSpace(ch):
+			i++
+			continue
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			// comment until the end of the line
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			continue
+		case isAlpha(ch):
+			for i < len(query) && (isAlpha(query[i]) || isDigit(query[i])) {
+				i++
+			}
+			toks = append(toks, token{kind: TOK_IDENT, text: query[start:i], pos: start})
+		case isDigit(ch):
+			kind := TOK_INT
+			for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+				if query[i] == '.' {
+					kind = TOK_FLOAT
+				}
+				i++
+			}
+			if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+				kind = TOK_FLOAT
+				i++
+				if i < len(query) && (query[i] == '+' || query[i] == '-') {
+					i++
+				}
+				for i < len(query) && isDigit(query[i]) {
+					i++
+				}
+			}
+			toks = append(toks, token{kind: kind, text: query[start:i], pos: start})
+		case ch == '\'':
+			// '' is an escaped quote
+			str := []byte{}
+			for i++; ; i++ {
+				if i >= len(query) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				str = append(str, query[i])
+			}
+			toks = append(toks, token{kind: TOK_STR, text: string(str), pos: start})
+		default:
+			sym := ""
+			for _, s := range symbols {
+				if strings.HasPrefix(query[i:], s) {
+					sym = s
+					break
+				}
+			}
+			if sym == "" {
+				return nil, fmt.Errorf("unexpected character %q at %d", ch, i)
+			}
+			i += len(sym)
+			toks = append(toks, token{kind: TOK_SYM, text: sym, pos: start})
+		}
+	}
+	toks = append(toks, token{kind: TOK_EOF, pos: len(query)})
+	return toks, nil
+}
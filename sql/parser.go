@@ -0,0 +1,759 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the statements:
+//
+//	CREATE TABLE t (a INT, b STRING, ..., PRIMARY KEY (a), [UNIQUE] INDEX i (b))
+//	CREATE [UNIQUE] INDEX i ON t (b, ...)
+//	INSERT INTO t [(a, b, ...)] VALUES (1, 'x', ...), ...
+//	SELECT * | expr [AS name], ... FROM t [AS a]
+//		[[INNER | LEFT [OUTER]] JOIN t2 [AS b] ON expr] ... [WHERE expr]
+//		[GROUP BY expr, ... [HAVING expr]]
+//		[ORDER BY expr [ASC|DESC], ...] [LIMIT n [OFFSET m]]
+//	UPDATE t SET a = expr, ... [WHERE expr]
+//	DELETE FROM t [WHERE expr]
+//	EXPLAIN SELECT ... | UPDATE ... | DELETE ...
+//	ANALYZE t
+
+const (
+	EXPR_CONST = 1 // Val
+	EXPR_COL   = 2 // Name
+	EXPR_NEG   = 3
+	EXPR_NOT   = 4
+	EXPR_ADD   = 5
+	EXPR_SUB   = 6
+	EXPR_MUL   = 7
+	EXPR_DIV   = 8
+	EXPR_MOD   = 9
+	EXPR_EQ    = 10
+	EXPR_NE    = 11
+	EXPR_LT    = 12
+	EXPR_LE    = 13
+	EXPR_GT    = 14
+	EXPR_GE    = 15
+	EXPR_AND   = 16
+	EXPR_OR    = 17
+	EXPR_FUNC  = 18 // Name(Kids), COUNT(*) has no kids
+	EXPR_NULL  = 19 // IS NULL
+)
+
+// expression tree, the booleans are INT64 0 or 1.
+// NULL is a value of the type TYPE_ERROR.
+type Expr struct {
+	Op   int
+	Val  table.Value // EXPR_CONST
+	Name string      // EXPR_COL, EXPR_FUNC
+	Kids []*Expr
+}
+
+type CreateTable struct {
+	Def table.TableDef
+}
+
+type CreateIndex struct {
+	Table string
+	Index table.IndexDef
+}
+
+type Insert struct {
+	Table string
+	Cols  []string // all columns if empty
+	Rows  [][]*Expr
+}
+
+type OrderBy struct {
+	Expr *Expr
+	Desc bool
+}
+
+const (
+	JOIN_INNER = 0
+	JOIN_LEFT  = 1
+)
+
+type Join struct {
+	Kind  int
+	Table string
+	Alias string // the table name if no alias
+	On    *Expr
+}
+
+type Select struct {
+	Table   string
+	Alias   string // the table name if no alias
+	Joins   []Join
+	Star    bool // SELECT *
+	Exprs   []*Expr
+	Names   []string // output column names
+	Where   *Expr    // nil if no WHERE
+	GroupBy []*Expr
+	Having  *Expr
+	Order   []OrderBy
+	Limit   int64 // -1 if no LIMIT
+	Offset  int64
+}
+
+type Update struct {
+	Table string
+	Cols  []string
+	Vals  []*Expr
+	Where *Expr
+}
+
+type Delete struct {
+	Table string
+	Where *Expr
+}
+
+// show the plan instead of running the statement
+type Explain struct {
+	Stmt interface{}
+}
+
+// collect the statistics of a table for the planner
+type Analyze struct {
+	Table string
+}
+
+type parser struct {
+	query string
+	toks  []token
+	pos   int
+}
+
+// parse the semicolon separated statements
+func Parse(query string) ([]interface{}, error) {
+	toks, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{query: query, toks: toks}
+	stmts := []interface{}{}
+	for {
+		for p.trySym(";") {
+		}
+		if p.peek().kind == TOK_EOF {
+			return stmts, nil
+		}
+		stmt, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+		if p.peek().kind != TOK_EOF && !p.trySym(";") {
+			return nil, p.errorf("expect ;")
+		}
+	}
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != TOK_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	tok := p.peek()
+	near := tok.text
+	if tok.kind == TOK_EOF {
+		near = "end of input"
+	}
+	return fmt.Errorf("syntax error at %d near %q: %s", tok.pos, near, fmt.Sprintf(format, args...))
+}
+
+// keywords are case insensitive
+func (p *parser) isKw(kw string) bool {
+	tok := p.peek()
+	return tok.kind == TOK_IDENT && strings.EqualFold(tok.text, kw)
+}
+
+func (p *parser) tryKw(kws ...string) bool {
+	start := p.pos
+	for _, kw := range kws {
+		if !p.isKw(kw) {
+			p.pos = start
+			return false
+		}
+		p.next()
+	}
+	return true
+}
+
+func (p *parser) expectKw(kws ...string) error {
+	if !p.tryKw(kws...) {
+		return p.errorf("expect %s", strings.Join(kws, " "))
+	}
+	return nil
+}
+
+func (p *parser) trySym(sym string) bool {
+	tok := p.peek()
+	if tok.kind == TOK_SYM && tok.text == sym {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSym(sym string) error {
+	if !p.trySym(sym) {
+		return p.errorf("expect %s", sym)
+	}
+	return nil
+}
+
+var keywords = map[string]bool{
+	"ALL": true, "ANALYZE": true, "AND": true, "AS": true, "ASC": true, "BY": true, "CREATE": true,
+	"DELETE": true, "DESC": true, "EXPLAIN": true, "FROM": true, "GROUP": true, "HAVING": true,
+	"INDEX": true, "INNER": true, "INSERT": true, "INTO": true, "IS": true, "JOIN": true,
+	"KEY": true, "LEFT": true, "LIMIT": true, "NOT": true, "NULL": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "OUTER": true, "PRIMARY": true, "SELECT": true, "SET": true,
+	"TABLE": true, "UNIQUE": true, "UPDATE": true, "VALUES": true, "WHERE": true,
+}
+
+func (p *parser) ident() (string, error) {
+	tok := p.peek()
+	if tok.kind != TOK_IDENT || keywords[strings.ToUpper(tok.text)] {
+		return "", p.errorf("expect a name")
+	}
+	p.next()
+	return tok.text, nil
+}
+
+// a comma separated list in parentheses
+func (p *parser) list(item func() error) error {
+	if err := p.expectSym("("); err != nil {
+		return err
+	}
+	for {
+		if err := item(); err != nil {
+			return err
+		}
+		if !p.trySym(",") {
+			break
+		}
+	}
+	return p.expectSym(")")
+}
+
+func (p *parser) identList() ([]string, error) {
+	names := []string{}
+	err := p.list(func() error {
+		name, err := p.ident()
+		names = append(names, name)
+		return err
+	})
+	return names, err
+}
+
+func (p *parser) parseStmt() (interface{}, error) {
+	switch {
+	case p.tryKw("CREATE", "TABLE"):
+		return p.parseCreateTable()
+	case p.tryKw("CREATE", "INDEX"):
+		return p.parseCreateIndex(false)
+	case p.tryKw("CREATE", "UNIQUE", "INDEX"):
+		return p.parseCreateIndex(true)
+	case p.tryKw("INSERT", "INTO"):
+		return p.parseInsert()
+	case p.tryKw("SELECT"):
+		return p.parseSelect()
+	case p.tryKw("UPDATE"):
+		return p.parseUpdate()
+	case p.tryKw("DELETE", "FROM"):
+		return p.parseDelete()
+	case p.tryKw("EXPLAIN"):
+		stmt, err := p.parseStmt()
+		return &Explain{Stmt: stmt}, err
+	case p.tryKw("ANALYZE"):
+		name, err := p.ident()
+		return &Analyze{Table: name}, err
+	}
+	return nil, p.errorf("unknown statement")
+}
+
+var typeNames = map[string]uint32{
+	"INT": table.TYPE_INT64, "INTEGER": table.TYPE_INT64, "INT64": table.TYPE_INT64, "BIGINT": table.TYPE_INT64,
+	"BYTES": table.TYPE_BYTES, "BLOB": table.TYPE_BYTES,
+	"STRING": table.TYPE_STRING, "TEXT": table.TYPE_STRING, "VARCHAR": table.TYPE_STRING,
+	"FLOAT": table.TYPE_FLOAT64, "DOUBLE": table.TYPE_FLOAT64, "FLOAT64": table.TYPE_FLOAT64, "REAL": table.TYPE_FLOAT64,
+}
+
+// the primary key columns are moved to the front of the table
+func (p *parser) parseCreateTable() (interface{}, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	cols, types, pkeys := []string{}, []uint32{}, []string(nil)
+	indexes := []table.IndexDef{}
+	err = p.list(func() error {
+		if p.tryKw("PRIMARY", "KEY") {
+			if pkeys != nil {
+				return p.errorf("duplicate primary key")
+			}
+			pkeys, err = p.identList()
+			return err
+		}
+		unique := p.tryKw("UNIQUE")
+		if p.tryKw("INDEX") {
+			idx := table.IndexDef{Unique: unique}
+			if idx.Name, err = p.ident(); err != nil {
+				return err
+			}
+			idx.Cols, err = p.identList()
+			indexes = append(indexes, idx)
+			return err
+		} else if unique {
+			return p.errorf("expect INDEX")
+		}
+		col, err := p.ident()
+		if err != nil {
+			return err
+		}
+		typ, ok := typeNames[strings.ToUpper(p.peek().text)]
+		if !ok || p.peek().kind != TOK_IDENT {
+			return p.errorf("expect a column type")
+		}
+		p.next()
+		cols, types = append(cols, col), append(types, typ)
+		if p.tryKw("PRIMARY", "KEY") {
+			if pkeys != nil {
+				return p.errorf("duplicate primary key")
+			}
+			pkeys = []string{col}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pkeys) == 0 {
+		return nil, fmt.Errorf("table %s has no primary key", name)
+	}
+
+	def := table.TableDef{Name: name, PKeys: len(pkeys), Indexes: indexes}
+	used := make([]bool, len(cols))
+	for _, pk := range pkeys {
+		i := indexOf(cols, pk)
+		if i < 0 || used[i] {
+			return nil, fmt.Errorf("bad primary key column: %s", pk)
+		}
+		used[i] = true
+		def.Cols, def.Types = append(def.Cols, cols[i]), append(def.Types, types[i])
+	}
+	for i := range cols {
+		if !used[i] {
+			def.Cols, def.Types = append(def.Cols, cols[i]), append(def.Types, types[i])
+		}
+	}
+	return &CreateTable{Def: def}, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *parser) parseCreateIndex(unique bool) (interface{}, error) {
+	stmt := &CreateIndex{Index: table.IndexDef{Unique: unique}}
+	var err error
+	if stmt.Index.Name, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err = p.expectKw("ON"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	stmt.Index.Cols, err = p.identList()
+	return stmt, err
+}
+
+func (p *parser) parseInsert() (interface{}, error) {
+	stmt := &Insert{}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == TOK_SYM && p.peek().text == "(" {
+		if stmt.Cols, err = p.identList(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectKw("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		row := []*Expr{}
+		err = p.list(func() error {
+			e, err := p.parseExpr()
+			row = append(row, e)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.trySym(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) parseSelect() (interface{}, error) {
+	stmt := &Select{Limit: -1}
+	if p.trySym("*") {
+		stmt.Star = true
+	} else {
+		for {
+			start := p.peek().pos
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			name := ""
+			if p.tryKw("AS") {
+				if name, err = p.ident(); err != nil {
+					return nil, err
+				}
+			} else if e.Op == EXPR_COL {
+				name = e.Name
+			} else {
+				name = strings.TrimSpace(p.query[start:p.peek().pos])
+			}
+			stmt.Exprs, stmt.Names = append(stmt.Exprs, e), append(stmt.Names, name)
+			if !p.trySym(",") {
+				break
+			}
+		}
+	}
+	var err error
+	if err = p.expectKw("FROM"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, stmt.Alias, err = p.tableAlias(); err != nil {
+		return nil, err
+	}
+joins:
+	for {
+		join := Join{Kind: JOIN_INNER}
+		switch {
+		case p.tryKw("JOIN"), p.tryKw("INNER", "JOIN"):
+		case p.tryKw("LEFT", "JOIN"), p.tryKw("LEFT", "OUTER", "JOIN"):
+			join.Kind = JOIN_LEFT
+		default:
+			break joins
+		}
+		if join.Table, join.Alias, err = p.tableAlias(); err != nil {
+			return nil, err
+		}
+		if err = p.expectKw("ON"); err != nil {
+			return nil, err
+		}
+		if join.On, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		stmt.Joins = append(stmt.Joins, join)
+	}
+	if stmt.Where, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	if p.tryKw("GROUP", "BY") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, e)
+			if !p.trySym(",") {
+				break
+			}
+		}
+		if p.tryKw("HAVING") {
+			if stmt.Having, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.tryKw("ORDER", "BY") {
+		for {
+			e, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			desc := p.tryKw("DESC")
+			if !desc {
+				p.tryKw("ASC")
+			}
+			stmt.Order = append(stmt.Order, OrderBy{Expr: e, Desc: desc})
+			if !p.trySym(",") {
+				break
+			}
+		}
+	}
+	if p.tryKw("LIMIT") {
+		if stmt.Limit, err = p.count(); err != nil {
+			return nil, err
+		}
+		if p.tryKw("OFFSET") {
+			if stmt.Offset, err = p.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stmt, nil
+}
+
+// a table name with an optional alias
+func (p *parser) tableAlias() (string, string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", "", err
+	}
+	alias := name
+	if p.tryKw("AS") || (p.peek().kind == TOK_IDENT && !keywords[strings.ToUpper(p.peek().text)]) {
+		alias, err = p.ident()
+	}
+	return name, alias, err
+}
+
+// a non-negative integer literal
+func (p *parser) count() (int64, error) {
+	tok := p.peek()
+	if tok.kind != TOK_INT {
+		return 0, p.errorf("expect a number")
+	}
+	n, err := strconv.ParseInt(tok.text, 10, 64)
+	if err != nil {
+		return 0, p.errorf("bad number")
+	}
+	p.next()
+	return n, nil
+}
+
+func (p *parser) parseWhere() (*Expr, error) {
+	if !p.tryKw("WHERE") {
+		return nil, nil
+	}
+	return p.parseExpr()
+}
+
+func (p *parser) parseUpdate() (interface{}, error) {
+	stmt := &Update{}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err = p.expectKw("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSym("="); err != nil {
+			return nil, err
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Cols, stmt.Vals = append(stmt.Cols, col), append(stmt.Vals, e)
+		if !p.trySym(",") {
+			break
+		}
+	}
+	stmt.Where, err = p.parseWhere()
+	return stmt, err
+}
+
+func (p *parser) parseDelete() (interface{}, error) {
+	stmt := &Delete{}
+	var err error
+	if stmt.Table, err = p.ident(); err != nil {
+		return nil, err
+	}
+	stmt.Where, err = p.parseWhere()
+	return stmt, err
+}
+
+// the binary operators from the lowest precedence
+var binaryOps = [][]struct {
+	sym string
+	op  int
+}{
+	{{"OR", EXPR_OR}},
+	{{"AND", EXPR_AND}},
+	{{"=", EXPR_EQ}, {"!=", EXPR_NE}, {"<>", EXPR_NE}, {"<", EXPR_LT}, {"<=", EXPR_LE}, {">", EXPR_GT}, {">=", EXPR_GE}},
+	{{"+", EXPR_ADD}, {"-", EXPR_SUB}},
+	{{"*", EXPR_MUL}, {"/", EXPR_DIV}, {"%", EXPR_MOD}},
+}
+
+func (p *parser) parseExpr() (*Expr, error) {
+	return p.parseBinary(0)
+}
+
+func (p *parser) parseBinary(level int) (*Expr, error) {
+	if level == len(binaryOps) {
+		return p.parseUnary()
+	}
+	parse := func() (*Expr, error) {
+		// NOT is between AND and the comparisons
+		if binaryOps[level][0].op == EXPR_EQ && p.tryKw("NOT") {
+			kid, err := p.parseBinary(level)
+			if err != nil {
+				return nil, err
+			}
+			return &Expr{Op: EXPR_NOT, Kids: []*Expr{kid}}, nil
+		}
+		return p.parseBinary(level + 1)
+	}
+	left, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := 0
+		for _, item := range binaryOps[level] {
+			if item.sym == "OR" || item.sym == "AND" {
+				if p.tryKw(item.sym) {
+					op = item.op
+				}
+			} else if p.trySym(item.sym) {
+				op = item.op
+			}
+			if op != 0 {
+				break
+			}
+		}
+		if op == 0 && binaryOps[level][0].op == EXPR_EQ && p.tryKw("IS") {
+			not := p.tryKw("NOT")
+			if err := p.expectKw("NULL"); err != nil {
+				return nil, err
+			}
+			left = &Expr{Op: EXPR_NULL, Kids: []*Expr{left}}
+			if not {
+				left = &Expr{Op: EXPR_NOT, Kids: []*Expr{left}}
+			}
+			continue
+		}
+		if op == 0 {
+			return left, nil
+		}
+		right, err := parse()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expr{Op: op, Kids: []*Expr{left, right}}
+	}
+}
+
+func (p *parser) parseUnary() (*Expr, error) {
+	if p.trySym("-") {
+		if tok := p.peek(); tok.kind == TOK_INT {
+			// a negative literal, the smallest int64 has no positive
+			p.next()
+			v, err := strconv.ParseInt("-"+tok.text, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad integer -%s", tok.text)
+			}
+			return &Expr{Op: EXPR_CONST, Val: table.Value{Type: table.TYPE_INT64, I64: v}}, nil
+		}
+		kid, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Op: EXPR_NEG, Kids: []*Expr{kid}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (*Expr, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case TOK_INT:
+		p.next()
+		v, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad integer %s", tok.text)
+		}
+		return &Expr{Op: EXPR_CONST, Val: table.Value{Type: table.TYPE_INT64, I64: v}}, nil
+	case TOK_FLOAT:
+		p.next()
+		v, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %s", tok.text)
+		}
+		return &Expr{Op: EXPR_CONST, Val: table.Value{Type: table.TYPE_FLOAT64, F64: v}}, nil
+	case TOK_STR:
+		p.next()
+		return &Expr{Op: EXPR_CONST, Val: table.Value{Type: table.TYPE_STRING, Str: []byte(tok.text)}}, nil
+	case TOK_IDENT:
+		if p.tryKw("NULL") {
+			return &Expr{Op: EXPR_CONST}, nil
+		}
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		// function call
+		if p.trySym("(") {
+			call := &Expr{Op: EXPR_FUNC, Name: strings.ToUpper(name)}
+			if p.trySym("*") {
+				if call.Name != "COUNT" {
+					return nil, p.errorf("* is only for COUNT")
+				}
+			} else {
+				for !(p.peek().kind == TOK_SYM && p.peek().text == ")") {
+					if len(call.Kids) > 0 {
+						if err := p.expectSym(","); err != nil {
+							return nil, err
+						}
+					}
+					kid, err := p.parseExpr()
+					if err != nil {
+						return nil, err
+					}
+					call.Kids = append(call.Kids, kid)
+				}
+			}
+			return call, p.expectSym(")")
+		}
+		// table.column
+		if p.trySym(".") {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			name += "." + col
+		}
+		return &Expr{Op: EXPR_COL, Name: name}, nil
+	}
+	if p.trySym("(") {
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expectSym(")")
+	}
+	return nil, p.errorf("expect an expression")
+}
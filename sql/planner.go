@@ -0,0 +1,415 @@
+package sql
+
+import (
+	"build_your_own_db/b-tree"
+	"build_your_own_db/table"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// the planner picks how to read a table for a WHERE clause:
+// a full scan, a range on the primary key, or a range on an index
+// followed by the row lookups. the conditions "column op constant"
+// of the top level AND on a prefix of a key become the range, the
+// WHERE is still applied to the scanned rows as a filter.
+// the cost of a plan is the estimated number of B-tree pages it reads,
+// from the statistics of ANALYZE, or from default guesses without them.
+// the rows within a range bound are estimated from the B-tree pages on
+// the paths to the 2 ends of the range, whether analyzed or not.
+
+const (
+	PLAN_FULL  = 0 // full table scan
+	PLAN_PK    = 1 // primary key range
+	PLAN_INDEX = 2 // index range, then the rows by the primary key
+)
+
+var planNames = []string{"full scan", "primary key range", "index range"}
+
+// the guesses for the tables that are not analyzed
+const (
+	DEFAULT_ROWS      = 1000
+	DEFAULT_ROW_BYTES = 100
+	DEFAULT_KEY_BYTES = 16
+	DEFAULT_DISTINCT  = 100 // the values of each column
+)
+
+const (
+	PAGE_FILL     = 0.7 // the average page utilization
+	PAGE_USABLE   = b_tree.BTREE_PAGE_SIZE * PAGE_FILL
+	PAIR_OVERHEAD = 14      // the pointer, the offset and the lengths of a KV pair
+	RANGE_SEL     = 1.0 / 3 // the fraction of rows within one range bound, without the tree
+)
+
+// the scan of a table and its plan
+type scan struct {
+	tdef   *table.TableDef
+	alias  string
+	req    table.Scanner
+	filter *Expr // nil if no filter
+	// the plan
+	access   int
+	keyCols  []string // the columns of the scanned key
+	neq      int      // the leading key columns bound by equalities
+	bounds   []string // the conditions that make the range
+	rows     float64  // the estimated rows read
+	pages    float64  // the estimated pages read
+	analyzed bool     // the estimates are from the statistics
+	ranged   bool     // the range is estimated from the tree
+	frac     float64  // the fraction of the rows within the range
+}
+
+// a condition "column op constant"
+type colCond struct {
+	col string
+	op  int
+	val table.Value
+}
+
+// split the top level AND of the WHERE into column conditions
+func colConds(tdef *table.TableDef, alias string, where *Expr, out []colCond) []colCond {
+	if where == nil {
+		return out
+	}
+	if where.Op == EXPR_AND {
+		out = colConds(tdef, alias, where.Kids[0], out)
+		return colConds(tdef, alias, where.Kids[1], out)
+	}
+	flip := map[int]int{EXPR_EQ: EXPR_EQ, EXPR_LT: EXPR_GT, EXPR_LE: EXPR_GE, EXPR_GT: EXPR_LT, EXPR_GE: EXPR_LE}
+	op, ok := flip[where.Op]
+	if !ok {
+		return out
+	}
+	col, val := where.Kids[0], where.Kids[1]
+	if col.Op != EXPR_COL {
+		col, val = val, col
+	} else {
+		op = where.Op
+	}
+	if col.Op != EXPR_COL || !isConst(val) {
+		return out
+	}
+	qual, name := splitName(col.Name)
+	i := indexOf(tdef.Cols, name)
+	if i < 0 || (qual != "" && qual != alias) {
+		return out
+	}
+	v, err := eval(val, nil)
+	if err != nil {
+		return out // reported by the filter
+	}
+	// only exact conversions can bound the key
+	if v, ok = coerce(v, tdef.Types[i]); !ok {
+		return out
+	}
+	return append(out, colCond{col: name, op: op, val: v})
+}
+
+// the range on the key columns from the conditions:
+// equalities on a prefix of the key then a range on the next column.
+func keyRange(sc *scan, conds []colCond) {
+	find := func(col string, ops ...int) *colCond {
+		for i := range conds {
+			for _, op := range ops {
+				if conds[i].col == col && conds[i].op == op {
+					return &conds[i]
+				}
+			}
+		}
+		return nil
+	}
+	req := &sc.req
+	for _, col := range sc.keyCols {
+		eq := find(col, EXPR_EQ)
+		if eq == nil {
+			if lo := find(col, EXPR_GT, EXPR_GE); lo != nil {
+				req.Key1.Cols = append(req.Key1.Cols, col)
+				req.Key1.Vals = append(req.Key1.Vals, lo.val)
+				req.Cmp1 = map[int]int{EXPR_GT: table.CMP_GT, EXPR_GE: table.CMP_GE}[lo.op]
+				sc.bounds = append(sc.bounds, condString(lo))
+			}
+			if hi := find(col, EXPR_LT, EXPR_LE); hi != nil {
+				req.Key2.Cols = append(req.Key2.Cols, col)
+				req.Key2.Vals = append(req.Key2.Vals, hi.val)
+				req.Cmp2 = map[int]int{EXPR_LT: table.CMP_LT, EXPR_LE: table.CMP_LE}[hi.op]
+				sc.bounds = append(sc.bounds, condString(hi))
+			}
+			break
+		}
+		req.Key1.Cols = append(req.Key1.Cols, col)
+		req.Key1.Vals = append(req.Key1.Vals, eq.val)
+		req.Key2.Cols = append(req.Key2.Cols, col)
+		req.Key2.Vals = append(req.Key2.Vals, eq.val)
+		sc.bounds = append(sc.bounds, condString(eq))
+		sc.neq++
+	}
+}
+
+func condString(cond *colCond) string {
+	e := Expr{Op: cond.op, Kids: []*Expr{{Op: EXPR_COL, Name: cond.col}, {Op: EXPR_CONST, Val: cond.val}}}
+	return e.String()
+}
+
+// the estimated height and leaf pages of a tree
+func treeShape(n int64, keyBytes int64, bytes int64) (height float64, leaves float64) {
+	leaves = math.Max(1, math.Ceil(float64(bytes+PAIR_OVERHEAD*n)/PAGE_USABLE))
+	fanout := 2.0
+	if n > 0 {
+		fanout = math.Max(fanout, PAGE_USABLE/(float64(keyBytes)/float64(n)+PAIR_OVERHEAD))
+	}
+	height = 1
+	for l := leaves; l > 1; l = math.Ceil(l / fanout) {
+		height++
+	}
+	return height, leaves
+}
+
+// the number of distinct values of the first k key columns
+func distinct(stats []int64, k int, rows int64, unique bool) float64 {
+	if k <= len(stats) && stats != nil {
+		return math.Max(1, float64(stats[k-1]))
+	}
+	if unique {
+		return math.Max(1, float64(rows))
+	}
+	return math.Max(1, math.Min(float64(rows), math.Pow(DEFAULT_DISTINCT, float64(k))))
+}
+
+// estimate the rows and the pages of a scan
+func estimate(sc *scan, stats *table.TableStats) {
+	rows, keyBytes, bytes := int64(DEFAULT_ROWS), int64(DEFAULT_ROWS*DEFAULT_KEY_BYTES), int64(DEFAULT_ROWS*DEFAULT_ROW_BYTES)
+	var pkDistinct []int64
+	if stats != nil {
+		rows, keyBytes, bytes, pkDistinct = stats.Rows, stats.KeyBytes, stats.Bytes, stats.Distinct
+	}
+	height, leaves := treeShape(rows, keyBytes, bytes)
+
+	sel := 1.0
+	if sc.ranged && len(sc.bounds) > sc.neq {
+		sel = sc.frac
+	} else if sc.neq > 0 {
+		if sc.access == PLAN_INDEX {
+			idx := indexDef(sc.tdef, sc.req.Index)
+			var stat []int64
+			if stats != nil && stats.Index(idx.Name) != nil {
+				stat = stats.Index(idx.Name).Distinct
+			}
+			sel = 1 / distinct(stat, sc.neq, rows, idx.Unique && sc.neq == len(idx.Cols))
+		} else {
+			sel = 1 / distinct(pkDistinct, sc.neq, rows, sc.neq == sc.tdef.PKeys)
+		}
+	}
+	for i := sc.neq; i < len(sc.bounds) && !sc.ranged; i++ {
+		sel *= RANGE_SEL
+	}
+	sc.rows = float64(rows) * sel
+	sc.analyzed = stats != nil
+
+	switch sc.access {
+	case PLAN_FULL:
+		sc.pages = height - 1 + leaves
+	case PLAN_PK:
+		sc.pages = height - 1 + math.Max(1, math.Ceil(leaves*sel))
+	case PLAN_INDEX:
+		// the index keys have the primary key and no values
+		ikeyBytes := 2 * keyBytes
+		if stats != nil && stats.Index(sc.req.Index) != nil {
+			ikeyBytes = stats.Index(sc.req.Index).KeyBytes
+		}
+		iheight, ileaves := treeShape(rows, ikeyBytes, ikeyBytes)
+		// each row is a lookup from the root of the table
+		sc.pages = iheight - 1 + math.Max(1, math.Ceil(ileaves*sel)) + math.Ceil(sc.rows)*height
+	}
+}
+
+// the fraction of the rows within a range bound, estimated from the tree
+func treeRange(db *table.DB, sc *scan, total int) error {
+	if len(sc.bounds) == sc.neq {
+		return nil // only equalities, see distinct()
+	}
+	rows, err := db.EstimateScan(sc.tdef.Name, &sc.req)
+	if err != nil {
+		return err
+	}
+	sc.ranged = true
+	if total > 0 {
+		sc.frac = math.Min(1, float64(rows)/float64(total))
+	}
+	return nil
+}
+
+func indexDef(tdef *table.TableDef, name string) *table.IndexDef {
+	for i := range tdef.Indexes {
+		if tdef.Indexes[i].Name == name {
+			return &tdef.Indexes[i]
+		}
+	}
+	return nil
+}
+
+// pick the cheapest plan for the WHERE
+func newScan(db *table.DB, name string, alias string, where *Expr) (*scan, error) {
+	tdef, err := db.TableDef(name)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := db.TableStats(name)
+	if err != nil {
+		return nil, err
+	}
+	conds := colConds(tdef, alias, where, nil)
+	total, err := db.EstimateScan(name, &table.Scanner{})
+	if err != nil {
+		return nil, err
+	}
+
+	best := &scan{tdef: tdef, alias: alias, filter: where, access: PLAN_PK, keyCols: tdef.Cols[:tdef.PKeys]}
+	keyRange(best, conds)
+	if len(best.bounds) == 0 {
+		best.access = PLAN_FULL
+	}
+	if err := treeRange(db, best, total); err != nil {
+		return nil, err
+	}
+	estimate(best, stats)
+	for _, idx := range tdef.Indexes {
+		sc := &scan{tdef: tdef, alias: alias, filter: where, access: PLAN_INDEX}
+		sc.req.Index = idx.Name
+		sc.keyCols = append(append([]string(nil), idx.Cols...), tdef.Cols[:tdef.PKeys]...)
+		keyRange(sc, conds)
+		if len(sc.bounds) == 0 {
+			continue
+		}
+		if err := treeRange(db, sc, total); err != nil {
+			return nil, err
+		}
+		estimate(sc, stats)
+		if sc.pages < best.pages {
+			best = sc
+		}
+	}
+	return best, nil
+}
+
+// the column name if the expression is a column of the scanned table
+func (sc *scan) colName(e *Expr) string {
+	if e.Op != EXPR_COL {
+		return ""
+	}
+	alias, col := splitName(e.Name)
+	if (alias != "" && alias != sc.alias) || indexOf(sc.tdef.Cols, col) < 0 {
+		return ""
+	}
+	return col
+}
+
+// whether the rows come in the ORDER BY order
+func (sc *scan) sorted(order []OrderBy) bool {
+	// the columns fixed by the equalities can be skipped
+	for skip := 0; skip <= sc.neq; skip++ {
+		ok := len(order) <= len(sc.keyCols)-skip
+		for i := 0; ok && i < len(order); i++ {
+			ok = !order[i].Desc && sc.colName(order[i].Expr) == sc.keyCols[skip+i]
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the rows with the same values of the expressions are together
+func (sc *scan) clustered(exprs []*Expr) bool {
+	cols := map[string]bool{}
+	for _, e := range exprs {
+		col := sc.colName(e)
+		if col == "" {
+			return false
+		}
+		cols[col] = true
+	}
+	// the rows are sorted by a prefix made of these columns and
+	// the columns fixed by the equalities.
+	n := 0
+	for i, col := range sc.keyCols {
+		if !cols[col] && i >= sc.neq {
+			break
+		}
+		if cols[col] {
+			n++
+		}
+	}
+	return n == len(cols)
+}
+
+func strValue(s string) table.Value {
+	return table.Value{Type: table.TYPE_STRING, Str: []byte(s)}
+}
+
+func intValue(i int64) table.Value {
+	return table.Value{Type: table.TYPE_INT64, I64: i}
+}
+
+var explainCols = []string{"table", "join", "access", "index", "range", "filter", "order", "rows", "pages", "stats"}
+
+func exprString(e *Expr) string {
+	if e == nil {
+		return ""
+	}
+	return e.String()
+}
+
+// describe a table access as a row of EXPLAIN
+func (sc *scan) explain(join string, filter *Expr, sorting string) []table.Value {
+	stats := "default"
+	if sc.analyzed {
+		stats = "analyzed"
+	}
+	return []table.Value{
+		strValue(sc.alias),
+		strValue(join),
+		strValue(planNames[sc.access]),
+		strValue(sc.req.Index),
+		strValue(strings.Join(sc.bounds, " AND ")),
+		strValue(exprString(filter)),
+		strValue(sorting),
+		intValue(int64(math.Ceil(sc.rows))),
+		intValue(int64(math.Ceil(sc.pages))),
+		strValue(stats),
+	}
+}
+
+// a step after the table accesses
+func explainStep(step string, filter *Expr, sorting string) []table.Value {
+	return []table.Value{
+		strValue(""), strValue(""), strValue(step), strValue(""), strValue(""),
+		strValue(exprString(filter)), strValue(sorting), {}, {}, strValue(""),
+	}
+}
+
+func execExplain(db *table.DB, stmt *Explain) (*Result, error) {
+	res := &Result{Cols: explainCols}
+	switch s := stmt.Stmt.(type) {
+	case *Select:
+		q, err := planSelect(db, s)
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = q.explain()
+	case *Update:
+		sc, err := newScan(db, s.Table, s.Table, s.Where)
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = append(res.Rows, sc.explain("", sc.filter, ""))
+	case *Delete:
+		sc, err := newScan(db, s.Table, s.Table, s.Where)
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = append(res.Rows, sc.explain("", sc.filter, ""))
+	default:
+		return nil, fmt.Errorf("EXPLAIN is for SELECT, UPDATE and DELETE")
+	}
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the access path of the first table of the EXPLAIN
+func explainAccess(t *testing.T, db *table.DB, query string) (access string, index string, rows int64) {
+	t.Helper()
+	row := testExec(t, db, "EXPLAIN "+query).Rows[0]
+	return string(row[2].Str), string(row[3].Str), row[7].I64
+}
+
+func expectAccess(t *testing.T, db *table.DB, query string, access string, index string) int64 {
+	t.Helper()
+	gotAccess, gotIndex, rows := explainAccess(t, db, query)
+	if gotAccess != access || gotIndex != index {
+		t.Fatalf("%s: %s %q, want %s %q", query, gotAccess, gotIndex, access, index)
+	}
+	return rows
+}
+
+func TestExplainAccess(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	testExec(t, db, "CREATE TABLE t (id INT, k INT, v STRING, PRIMARY KEY (id), INDEX by_k (k))")
+	for i := 0; i < 5000; i += 500 {
+		values := []string{}
+		for j := i; j < i+500; j++ {
+			values = append(values, fmt.Sprintf("(%d, %d, 'v%d')", j, j%1000, j))
+		}
+		testExec(t, db, "INSERT INTO t VALUES "+strings.Join(values, ", "))
+	}
+
+	for _, analyzed := range []bool{false, true} {
+		if analyzed {
+			testExec(t, db, "ANALYZE t")
+		}
+		expectAccess(t, db, "SELECT * FROM t", "full scan", "")
+		expectAccess(t, db, "SELECT * FROM t WHERE v = 'v7'", "full scan", "")
+		expectAccess(t, db, "SELECT * FROM t WHERE id = 7", "primary key range", "")
+		expectAccess(t, db, "SELECT * FROM t WHERE id >= 100 AND id < 200", "primary key range", "")
+		// an equality on an index wins without the statistics
+		expectAccess(t, db, "SELECT * FROM t WHERE k = 7", "index range", "by_k")
+		expectAccess(t, db, "SELECT * FROM t WHERE 7 = k AND v > 'v'", "index range", "by_k")
+		// the ranges are estimated from the tree, the rows of the
+		// table are a guess without the statistics
+		rows := expectAccess(t, db, "SELECT * FROM t WHERE k >= 7 AND k < 9", "index range", "by_k")
+		if analyzed && (rows < 5 || rows > 20) {
+			t.Fatalf("estimated %d rows for 10", rows)
+		}
+		expectAccess(t, db, "SELECT * FROM t WHERE k >= 7", "full scan", "")
+		expectAccess(t, db, "SELECT * FROM t WHERE k < 500", "full scan", "")
+		expectAccess(t, db, "SELECT * FROM t WHERE k > 997", "index range", "by_k")
+		rows = expectAccess(t, db, "SELECT * FROM t WHERE id > 4000", "primary key range", "")
+		if analyzed && (rows < 800 || rows > 1200) {
+			t.Fatalf("estimated %d rows for 999", rows)
+		}
+		expectAccess(t, db, "SELECT * FROM t WHERE k > 2000", "index range", "by_k")
+	}
+	// the chosen plans return the same rows
+	expectRows(t, db, "SELECT id FROM t WHERE k >= 7 AND k < 9 AND id < 2000 ORDER BY id", "7", "8", "1007", "1008")
+	expectRows(t, db, "SELECT id FROM t WHERE k > 997 AND id >= 3000 ORDER BY id", "3998", "3999", "4998", "4999")
+}
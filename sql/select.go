@@ -0,0 +1,312 @@
+package sql
+
+import (
+	"build_your_own_db/table"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// a planned SELECT
+type query struct {
+	stmt    *Select
+	srcs    []source // the tables of the FROM clause
+	scan    *scan    // the driving table
+	joins   []*joinPlan
+	calls   []*Expr // the aggregate calls
+	grouped bool    // the rows come in the order of GROUP BY
+	sorted  bool    // the rows come in the order of ORDER BY
+}
+
+func planSelect(db *table.DB, stmt *Select) (*query, error) {
+	sc, err := newScan(db, stmt.Table, stmt.Alias, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	q := &query{stmt: stmt, scan: sc}
+	q.srcs = append(q.srcs, source{alias: stmt.Alias, tdef: sc.tdef})
+	for _, join := range stmt.Joins {
+		tdef, err := db.TableDef(join.Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range q.srcs {
+			if src.alias == join.Alias {
+				return nil, fmt.Errorf("duplicate table name: %s", join.Alias)
+			}
+		}
+		q.srcs = append(q.srcs, source{alias: join.Alias, tdef: tdef})
+	}
+	if len(stmt.Joins) > 0 {
+		// the WHERE is applied after the joins
+		sc.filter = nil
+	}
+	for n := 1; n < len(q.srcs); n++ {
+		p, err := planJoin(db, q, n)
+		if err != nil {
+			return nil, err
+		}
+		q.joins = append(q.joins, p)
+	}
+
+	// the aggregates are only allowed after the grouping
+	noAggs := []*Expr{stmt.Where}
+	for _, join := range stmt.Joins {
+		noAggs = append(noAggs, join.On)
+	}
+	noAggs = append(noAggs, stmt.GroupBy...)
+	for _, e := range noAggs {
+		calls, err := findAggs(e, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(calls) > 0 {
+			return nil, fmt.Errorf("aggregate %s is not allowed here", calls[0].Name)
+		}
+	}
+	exprs := append([]*Expr{stmt.Having}, stmt.Exprs...)
+	for _, ob := range stmt.Order {
+		exprs = append(exprs, ob.Expr)
+	}
+	for _, e := range exprs {
+		if q.calls, err = findAggs(e, q.calls); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Having != nil && !q.aggregated() {
+		return nil, fmt.Errorf("HAVING without GROUP BY or aggregates")
+	}
+
+	// the order of the driving scan is kept by the joins
+	if q.aggregated() {
+		q.grouped = sc.clustered(stmt.GroupBy)
+	} else {
+		q.sorted = sc.sorted(stmt.Order) && !renamesOrder(stmt)
+	}
+	return q, nil
+}
+
+// whether the rows are grouped
+func (q *query) aggregated() bool {
+	return len(q.stmt.GroupBy) > 0 || len(q.calls) > 0
+}
+
+// the output column names
+func (q *query) cols() []string {
+	if !q.stmt.Star {
+		return q.stmt.Names
+	}
+	if len(q.srcs) == 1 {
+		return q.scan.tdef.Cols
+	}
+	cols := []string{}
+	for _, src := range q.srcs {
+		for _, col := range src.tdef.Cols {
+			cols = append(cols, src.alias+"."+col)
+		}
+	}
+	return cols
+}
+
+// the rows of the FROM and the WHERE
+func (q *query) rows(db *table.DB) rowIter {
+	var it rowIter = q.scan.iter(db)
+	for _, p := range q.joins {
+		if p.method == JOIN_MERGE {
+			it = newMergeJoin(db, p, it)
+		} else {
+			it = &loopJoinIter{db: db, plan: p, outer: it}
+		}
+	}
+	if len(q.joins) > 0 && q.stmt.Where != nil {
+		it = &filterIter{in: it, filter: q.stmt.Where}
+	}
+	return it
+}
+
+// describe the plan as the rows of EXPLAIN, the sorting is on the last step
+func (q *query) explain() [][]table.Value {
+	stmt := q.stmt
+	rows := [][]table.Value{q.scan.explain("", q.scan.filter, "")}
+	for _, p := range q.joins {
+		kind := "inner "
+		if p.join.Kind == JOIN_LEFT {
+			kind = "left "
+		}
+		join := p.inner.explain(kind+joinNames[p.method], p.join.On, "")
+		join[7] = intValue(int64(math.Ceil(p.rows)))
+		join[8] = intValue(int64(math.Ceil(p.pages)))
+		rows = append(rows, join)
+	}
+	if len(q.joins) > 0 && stmt.Where != nil {
+		rows = append(rows, explainStep("filter", stmt.Where, ""))
+	}
+	if q.aggregated() {
+		step := "hash group"
+		if q.grouped {
+			step = "stream group"
+		}
+		rows = append(rows, explainStep(step, stmt.Having, ""))
+	}
+	if len(stmt.Order) > 0 {
+		sorting := "sort"
+		if q.sorted {
+			sorting = "key order"
+		}
+		rows[len(rows)-1][6] = strValue(sorting)
+	}
+	return rows
+}
+
+// the rows are sorted in memory unless they come in the ORDER BY order.
+// with a LIMIT, the buffer is sorted and cut to OFFSET + LIMIT rows
+// whenever it doubles, so it is bounded by the LIMIT. without a LIMIT,
+// all the output rows are kept until the end.
+func execSelect(db *table.DB, stmt *Select) (*Result, error) {
+	q, err := planSelect(db, stmt)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Cols: q.cols()}
+	// no sorting if the rows are in the order
+	order := stmt.Order
+	if q.sorted {
+		order = nil
+	}
+	// the sort keys of each output row
+	keys := [][]table.Value{}
+	keep := stmt.Offset + stmt.Limit // the rows of the sorted output
+	skip := stmt.Offset
+	output := func(row *env) (bool, error) {
+		if len(order) == 0 {
+			if stmt.Limit >= 0 && int64(len(res.Rows)) >= stmt.Limit {
+				return false, nil
+			}
+			if skip > 0 {
+				skip--
+				return true, nil
+			}
+		}
+		out := row.vals
+		if !stmt.Star {
+			out = make([]table.Value, len(stmt.Exprs))
+			for i, e := range stmt.Exprs {
+				v, err := eval(e, row)
+				if err != nil {
+					return false, err
+				}
+				out[i] = v
+			}
+		}
+		res.Rows = append(res.Rows, out)
+		if len(order) == 0 {
+			return true, nil
+		}
+		key, err := orderKey(order, res.Cols, out, row)
+		if err != nil {
+			return false, err
+		}
+		keys = append(keys, key)
+		if stmt.Limit >= 0 && int64(len(res.Rows))-keep > keep {
+			// the sort is stable, the later rows of the same key come after
+			if err := sortRows(order, res.Rows, keys); err != nil {
+				return false, err
+			}
+			res.Rows, keys = res.Rows[:keep], keys[:keep]
+		}
+		return true, nil
+	}
+	if q.aggregated() {
+		err = aggregate(q.rows(db), stmt.GroupBy, q.calls, q.grouped, func(row *env) (bool, error) {
+			ok, err := test(stmt.Having, row)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			return output(row)
+		})
+	} else {
+		err = each(q.rows(db), output)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(order) > 0 {
+		if err := sortRows(order, res.Rows, keys); err != nil {
+			return nil, err
+		}
+		res.Rows = limitRows(res.Rows, stmt.Offset, stmt.Limit)
+	}
+	return res, nil
+}
+
+// whether the ORDER BY uses an output name for something else
+func renamesOrder(stmt *Select) bool {
+	for _, ob := range stmt.Order {
+		j := indexOf(stmt.Names, ob.Expr.Name)
+		if !stmt.Star && j >= 0 && stmt.Exprs[j].Name != ob.Expr.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate the ORDER BY, the output names can be used
+func orderKey(order []OrderBy, names []string, out []table.Value, row *env) ([]table.Value, error) {
+	key := make([]table.Value, len(order))
+	for i, ob := range order {
+		if ob.Expr.Op == EXPR_COL {
+			if j := indexOf(names, ob.Expr.Name); j >= 0 {
+				key[i] = out[j]
+				continue
+			}
+		}
+		v, err := eval(ob.Expr, row)
+		if err != nil {
+			return nil, err
+		}
+		key[i] = v
+	}
+	return key, nil
+}
+
+func sortRows(order []OrderBy, rows [][]table.Value, keys [][]table.Value) error {
+	idx := make([]int, len(rows))
+	for i := range idx {
+		idx[i] = i
+	}
+	var err error
+	sort.SliceStable(idx, func(a, b int) bool {
+		for i, ob := range order {
+			r, e := compareValues(keys[idx[a]][i], keys[idx[b]][i])
+			if e != nil {
+				err = e
+			}
+			if ob.Desc {
+				r = -r
+			}
+			if r != 0 {
+				return r < 0
+			}
+		}
+		return false
+	})
+	sorted := make([][]table.Value, len(rows))
+	sortedKeys := make([][]table.Value, len(rows))
+	for i, j := range idx {
+		sorted[i], sortedKeys[i] = rows[j], keys[j]
+	}
+	copy(rows, sorted)
+	copy(keys, sortedKeys)
+	return err
+}
+
+func limitRows(rows [][]table.Value, offset int64, limit int64) [][]table.Value {
+	if offset >= int64(len(rows)) {
+		return nil
+	}
+	rows = rows[offset:]
+	if limit >= 0 && limit < int64(len(rows)) {
+		rows = rows[:limit]
+	}
+	return rows
+}
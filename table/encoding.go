@@ -0,0 +1,79 @@
+package table
+
+import (
+	"build_your_own_db/tuple"
+	"errors"
+)
+
+// the keys and the values of the rows are encoded as tuples of the
+// column values, see the tuple package. the bytes.Compare order of the
+// encoded tuples is the order of the values, column by column, so the
+// B-tree keys are sorted by the primary key.
+
+func encodeValues(out []byte, vals []Value) []byte {
+	t := make(tuple.Tuple, len(vals))
+	for i, v := range vals {
+		switch v.Type {
+		case TYPE_INT64:
+			t[i] = v.I64
+		case TYPE_FLOAT64:
+			t[i] = v.F64
+		case TYPE_BYTES:
+			t[i] = v.Str
+		case TYPE_STRING:
+			t[i] = string(v.Str)
+		default:
+			panic("bad value type")
+		}
+	}
+	out, err := tuple.Append(out, t)
+	if err != nil {
+		panic(err) // only the types above
+	}
+	return out
+}
+
+var errBadEncoding = errors.New("bad value encoding")
+
+// decode the values whose types are already set
+func decodeValues(in []byte, out []Value) error {
+	t, err := tuple.Decode(in)
+	if err != nil || len(t) != len(out) {
+		return errBadEncoding
+	}
+	for i := range out {
+		ok := false
+		switch out[i].Type {
+		case TYPE_INT64:
+			out[i].I64, ok = t[i].(int64)
+		case TYPE_FLOAT64:
+			out[i].F64, ok = t[i].(float64)
+		case TYPE_BYTES:
+			out[i].Str, ok = t[i].([]byte)
+		case TYPE_STRING:
+			var str string
+			str, ok = t[i].(string)
+			out[i].Str = []byte(str)
+		default:
+			panic("bad value type")
+		}
+		if !ok {
+			return errBadEncoding
+		}
+	}
+	return nil
+}
+
+// the smallest key that is greater than all keys starting with the prefix.
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return nil
+	}
+	end[len(end)-1]++
+	return end
+}
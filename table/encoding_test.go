@@ -0,0 +1,43 @@
+package table
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEncodingOrder(t *testing.T) {
+	// sorted rows of (int64, float64, string)
+	rows := [][]Value{}
+	for _, i := range []int64{math.MinInt64, -1, 0, 1, math.MaxInt64} {
+		for _, f := range []float64{math.Inf(-1), -1.5, 0, 2.5, math.Inf(1)} {
+			for _, s := range []string{"", "\x00", "\x00\x00", "\x01", "a", "a\x00b", "ab"} {
+				rows = append(rows, []Value{
+					{Type: TYPE_INT64, I64: i},
+					{Type: TYPE_FLOAT64, F64: f},
+					{Type: TYPE_STRING, Str: []byte(s)},
+				})
+			}
+		}
+	}
+	var prev []byte
+	for _, row := range rows {
+		key := encodeValues(nil, row)
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			t.Fatalf("bad order at %v", row)
+		}
+		prev = key
+		out := []Value{{Type: TYPE_INT64}, {Type: TYPE_FLOAT64}, {Type: TYPE_STRING}}
+		if err := decodeValues(key, out); err != nil {
+			t.Fatal(err)
+		}
+		if out[0].I64 != row[0].I64 || out[1].F64 != row[1].F64 || !bytes.Equal(out[2].Str, row[2].Str) {
+			t.Fatalf("decoded %v, want %v", out, row)
+		}
+		// the types must match
+		bad := []Value{{Type: TYPE_INT64}, {Type: TYPE_FLOAT64}, {Type: TYPE_BYTES}}
+		if err := decodeValues(key, bad); err == nil {
+			t.Fatal("a string decoded as bytes")
+		}
+	}
+}
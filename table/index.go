@@ -0,0 +1,199 @@
+package table
+
+import (
+	"build_your_own_db/b-tree"
+	"encoding/json"
+	"fmt"
+)
+
+// secondary indexes. each index is a bucket named "table/index",
+// the key is the encoded indexed columns followed by the primary key,
+// the value is empty. the index entries are updated in the same
+// transaction as the row.
+
+type IndexDef struct {
+	Name   string
+	Cols   []string
+	Unique bool // at most one row for each value of the indexed columns
+}
+
+func indexBucket(tdef *TableDef, idx *IndexDef) string {
+	return tdef.Name + "/" + idx.Name
+}
+
+func colIndex(tdef *TableDef, col string) int {
+	for i, c := range tdef.Cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+func getIndexDef(tdef *TableDef, name string) *IndexDef {
+	for i := range tdef.Indexes {
+		if tdef.Indexes[i].Name == name {
+			return &tdef.Indexes[i]
+		}
+	}
+	return nil
+}
+
+func indexDefCheck(tdef *TableDef, idx *IndexDef) error {
+	if !isIdent(idx.Name) {
+		return fmt.Errorf("bad index name: %q", idx.Name)
+	}
+	if len(idx.Cols) == 0 {
+		return fmt.Errorf("index %s has no columns", idx.Name)
+	}
+	seen := map[string]bool{}
+	for _, col := range idx.Cols {
+		if colIndex(tdef, col) < 0 || seen[col] {
+			return fmt.Errorf("bad index column: %s", col)
+		}
+		seen[col] = true
+	}
+	return nil
+}
+
+// the columns of an index key, the primary key is appended
+func indexKeyCols(tdef *TableDef, idx *IndexDef) []string {
+	return append(append([]string(nil), idx.Cols...), tdef.Cols[:tdef.PKeys]...)
+}
+
+// encode the index key of a row, the values are in the table column order
+func indexKey(tdef *TableDef, idx *IndexDef, row []Value) []byte {
+	return encodeValues(nil, pickCols(tdef, indexKeyCols(tdef, idx), row))
+}
+
+func pickCols(tdef *TableDef, cols []string, row []Value) []Value {
+	vals := make([]Value, len(cols))
+	for i, col := range cols {
+		vals[i] = row[colIndex(tdef, col)]
+	}
+	return vals
+}
+
+// check that no other row has the same values in a unique index
+func indexUniqueCheck(tx *b_tree.KVTX, tdef *TableDef, idx *IndexDef, row []Value) error {
+	bucket, err := tx.Bucket(indexBucket(tdef, idx))
+	if err != nil {
+		return err
+	}
+	prefix := encodeValues(nil, pickCols(tdef, idx.Cols, row))
+	self := indexKey(tdef, idx, row)
+	iter := bucket.Seek(prefix)
+	for ; iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		if len(key) < len(prefix) || string(key[:len(prefix)]) != string(prefix) {
+			break
+		}
+		if string(key) != string(self) {
+			return fmt.Errorf("duplicate value in unique index %s", idx.Name)
+		}
+	}
+	return nil
+}
+
+// check the index entries of a new row before any index is changed,
+// so that a failed update leaves the indexes as they were. the entries
+// of the row being replaced are not conflicts, see indexUniqueCheck.
+func indexCheck(tx *b_tree.KVTX, tdef *TableDef, row []Value) error {
+	for i := range tdef.Indexes {
+		idx := &tdef.Indexes[i]
+		if len(indexKey(tdef, idx, row)) > b_tree.BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("index key too large: %s", idx.Name)
+		}
+		if idx.Unique {
+			if err := indexUniqueCheck(tx, tdef, idx, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add or remove the index entries of a row, see indexCheck
+func indexUpdate(tx *b_tree.KVTX, tdef *TableDef, row []Value, add bool) error {
+	for i := range tdef.Indexes {
+		idx := &tdef.Indexes[i]
+		bucket, err := tx.Bucket(indexBucket(tdef, idx))
+		if err != nil {
+			return err
+		}
+		key := indexKey(tdef, idx, row)
+		if add {
+			err = bucket.Set(key, nil)
+		} else {
+			_, err = bucket.Del(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add an index to an existing table, the index is built from the rows
+func (db *DB) IndexNew(table string, idx IndexDef) error {
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		return err
+	}
+	if err := indexDefCheck(tdef, &idx); err != nil {
+		return err
+	}
+	if getIndexDef(tdef, idx.Name) != nil {
+		return fmt.Errorf("index exists: %s", idx.Name)
+	}
+	ntdef := *tdef
+	ntdef.Indexes = append(append([]IndexDef(nil), tdef.Indexes...), idx)
+	def, err := json.Marshal(&ntdef)
+	if err != nil {
+		return err
+	}
+
+	var tx b_tree.KVTX
+	db.kv.Begin(&tx)
+	err = indexBuild(db, &tx, &ntdef, &ntdef.Indexes[len(ntdef.Indexes)-1])
+	if err == nil {
+		rec := (&Record{}).AddString("name", tdef.Name).AddBytes("def", def)
+		_, err = dbUpdate(&tx, TDEF_TABLE, *rec, MODE_UPDATE_ONLY)
+	}
+	if err != nil {
+		db.kv.Abort(&tx)
+		return err
+	}
+	if err := db.kv.Commit(&tx); err != nil {
+		return err
+	}
+	db.tables[table] = &ntdef
+	return nil
+}
+
+func indexBuild(db *DB, tx *b_tree.KVTX, tdef *TableDef, idx *IndexDef) error {
+	ibucket, err := tx.CreateBucket(indexBucket(tdef, idx))
+	if err != nil {
+		return err
+	}
+	bucket, err := tx.Bucket(tdef.Name)
+	if err != nil {
+		return err
+	}
+	for iter := bucket.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		row, err := decodeRow(tdef, key, val)
+		if err != nil {
+			return err
+		}
+		if idx.Unique {
+			if err := indexUniqueCheck(tx, tdef, idx, row); err != nil {
+				return err
+			}
+		}
+		if err := ibucket.Set(indexKey(tdef, idx, row), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
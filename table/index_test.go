@@ -0,0 +1,111 @@
+package table
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testOpen(t *testing.T) *DB {
+	t.Helper()
+	db := &DB{Path: t.TempDir() + "/table.db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// the decoded entries of an index, as "value:id"
+func indexEntries(t *testing.T, db *DB, table string, index string) []string {
+	t.Helper()
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := getIndexDef(tdef, index)
+	bucket, err := db.kv.Bucket(indexBucket(tdef, idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []string{}
+	for iter := bucket.Seek(nil); iter.Valid(); iter.Next() {
+		key, _ := iter.Deref()
+		vals := []Value{{Type: TYPE_STRING}, {Type: TYPE_INT64}}
+		if err := decodeValues(key, vals); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, fmt.Sprintf("%s:%d", vals[0].Str, vals[1].I64))
+	}
+	return entries
+}
+
+func abRow(id int64, a string, b string) Record {
+	return *(&Record{}).AddInt64("id", id).AddString("a", a).AddString("b", b)
+}
+
+func TestIndexUniqueViolation(t *testing.T) {
+	db := testOpen(t)
+	defer db.Close()
+	err := db.TableNew(&TableDef{
+		Name:  "t",
+		Cols:  []string{"id", "a", "b"},
+		Types: []uint32{TYPE_INT64, TYPE_STRING, TYPE_STRING},
+		PKeys: 1,
+		Indexes: []IndexDef{
+			{Name: "ia", Cols: []string{"a"}},
+			{Name: "ib", Cols: []string{"b"}, Unique: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []Record{abRow(1, "x", "p"), abRow(2, "y", "q")} {
+		if _, err := db.Insert("t", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(ia []string, ib []string) {
+		t.Helper()
+		if got := indexEntries(t, db, "t", "ia"); !reflect.DeepEqual(got, ia) {
+			t.Fatalf("index ia %v, want %v", got, ia)
+		}
+		if got := indexEntries(t, db, "t", "ib"); !reflect.DeepEqual(got, ib) {
+			t.Fatalf("index ib %v, want %v", got, ib)
+		}
+	}
+
+	// the violation is found before any index is changed
+	var tx TX
+	db.Begin(&tx)
+	if _, err := tx.Upsert("t", abRow(1, "z", "q")); err == nil {
+		t.Fatal("duplicate value in a unique index")
+	}
+	if err := db.Commit(&tx); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"x:1", "y:2"}, []string{"p:1", "q:2"})
+	rec := (&Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("t", rec); !ok || err != nil || string(rec.Get("a").Str) != "x" {
+		t.Fatalf("row 1 is changed: %v %v", ok, err)
+	}
+
+	// the old entries of the row itself are not conflicts
+	if _, err := db.Upsert("t", abRow(1, "z", "p")); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"y:2", "z:1"}, []string{"p:1", "q:2"})
+	if _, err := db.Upsert("t", abRow(2, "y", "r")); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"y:2", "z:1"}, []string{"p:1", "r:2"})
+	if _, err := db.Insert("t", abRow(3, "w", "r")); err == nil {
+		t.Fatal("duplicate value in a unique index")
+	}
+	if _, err := db.Delete("t", *(&Record{}).AddInt64("id", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Insert("t", abRow(3, "w", "r")); err != nil {
+		t.Fatal(err)
+	}
+	check([]string{"w:3", "z:1"}, []string{"p:1", "r:3"})
+}
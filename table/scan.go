@@ -0,0 +1,188 @@
+package table
+
+import (
+	"build_your_own_db/b-tree"
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	CMP_GE = +3 // >=
+	CMP_GT = +2 // >
+	CMP_LT = -2 // <
+	CMP_LE = -3 // <=
+)
+
+// a range scan on the primary key or on an index,
+// the rows are in the order of the key.
+// the keys can be prefixes of the index key, an empty key is unbounded.
+type Scanner struct {
+	Index string // the index name, the primary key if empty
+	Cmp1  int    // CMP_GE or CMP_GT, CMP_GE if zero
+	Cmp2  int    // CMP_LE or CMP_LT, CMP_LE if zero
+	Key1  Record
+	Key2  Record
+	// internal
+	db   *DB
+	tdef *TableDef
+	idx  *IndexDef // nil for the primary key
+	iter *b_tree.BIter
+	end  []byte // exclusive upper bound, nil if unbounded
+}
+
+// encode a prefix of the columns
+func encodeKeyPrefix(tdef *TableDef, cols []string, rec Record) ([]byte, error) {
+	if len(rec.Cols) > len(cols) {
+		return nil, errors.New("the scan key is not a prefix of the index")
+	}
+	vals := make([]Value, len(rec.Cols))
+	for i := range vals {
+		v := rec.Get(cols[i])
+		if v == nil {
+			return nil, errors.New("the scan key is not a prefix of the index")
+		}
+		if v.Type != tdef.Types[colIndex(tdef, cols[i])] {
+			return nil, fmt.Errorf("bad type for column: %s", cols[i])
+		}
+		vals[i] = *v
+	}
+	return encodeValues(nil, vals), nil
+}
+
+// the [start, end) range of the encoded keys
+func scanRange(tdef *TableDef, cols []string, req *Scanner) (start []byte, end []byte, err error) {
+	if req.Cmp1 == 0 {
+		req.Cmp1 = CMP_GE
+	}
+	if req.Cmp2 == 0 {
+		req.Cmp2 = CMP_LE
+	}
+	if !(req.Cmp1 == CMP_GE || req.Cmp1 == CMP_GT) || !(req.Cmp2 == CMP_LE || req.Cmp2 == CMP_LT) {
+		return nil, nil, errors.New("bad range")
+	}
+	key1, err := encodeKeyPrefix(tdef, cols, req.Key1)
+	if err != nil {
+		return nil, nil, err
+	}
+	key2, err := encodeKeyPrefix(tdef, cols, req.Key2)
+	if err != nil {
+		return nil, nil, err
+	}
+	// a prefix covers all the keys that start with it,
+	// so (> prefix) is (>= prefixEnd) and (<= prefix) is (< prefixEnd).
+	start = key1
+	if req.Cmp1 == CMP_GT && len(key1) > 0 {
+		start = prefixEnd(key1)
+		if start == nil {
+			return nil, []byte{}, nil // nothing is greater
+		}
+	}
+	if len(key2) > 0 {
+		end = key2
+		if req.Cmp2 == CMP_LE {
+			end = prefixEnd(key2)
+		}
+	}
+	return start, end, nil
+}
+
+// resolve the bucket and the range of the scan
+func scanInit(db *DB, table string, req *Scanner) (*b_tree.Bucket, []byte, error) {
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	cols, name := tdef.Cols[:tdef.PKeys], tdef.Name
+	req.idx = nil
+	if req.Index != "" {
+		req.idx = getIndexDef(tdef, req.Index)
+		if req.idx == nil {
+			return nil, nil, fmt.Errorf("index not found: %s", req.Index)
+		}
+		cols, name = indexKeyCols(tdef, req.idx), indexBucket(tdef, req.idx)
+	}
+	start, end, err := scanRange(tdef, cols, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.db = db
+	req.tdef = tdef
+	req.end = end
+	bucket, err := db.kv.Bucket(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bucket, start, nil
+}
+
+func (db *DB) Scan(table string, req *Scanner) error {
+	bucket, start, err := scanInit(db, table, req)
+	if err != nil {
+		return err
+	}
+	req.iter = bucket.Seek(start)
+	return nil
+}
+
+// the approximate number of rows of a scan without reading them,
+// see BTree.EstimateRange
+func (db *DB) EstimateScan(table string, req *Scanner) (int, error) {
+	tmp := *req
+	bucket, start, err := scanInit(db, table, &tmp)
+	if err != nil {
+		return 0, err
+	}
+	if tmp.end != nil && len(tmp.end) == 0 {
+		return 0, nil // the empty range
+	}
+	rows, _ := bucket.EstimateRange(start, tmp.end)
+	return rows, nil
+}
+
+// within the range or not
+func (sc *Scanner) Valid() bool {
+	if sc.iter == nil || !sc.iter.Valid() {
+		return false
+	}
+	key, _ := sc.iter.Deref()
+	return sc.end == nil || bytes.Compare(key, sc.end) < 0
+}
+
+// move the underlying B-tree iterator
+func (sc *Scanner) Next() {
+	sc.iter.Next()
+}
+
+// fetch the current row
+func (sc *Scanner) Deref(rec *Record) error {
+	key, val := sc.iter.Deref()
+	if sc.idx == nil {
+		row, err := decodeRow(sc.tdef, key, val)
+		if err != nil {
+			return err
+		}
+		rec.Cols = sc.tdef.Cols
+		rec.Vals = row
+		return nil
+	}
+	// fetch the row by the primary key in the index key
+	tdef := sc.tdef
+	vals := make([]Value, len(sc.idx.Cols)+tdef.PKeys)
+	for i, col := range indexKeyCols(tdef, sc.idx) {
+		vals[i].Type = tdef.Types[colIndex(tdef, col)]
+	}
+	if err := decodeValues(key, vals); err != nil {
+		return err
+	}
+	pk := Record{Cols: tdef.Cols[:tdef.PKeys], Vals: vals[len(sc.idx.Cols):]}
+	ok, err := dbGet(sc.db, tdef, &pk)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("index entry without a row")
+	}
+	*rec = pk
+	return nil
+}
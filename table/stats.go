@@ -0,0 +1,165 @@
+package table
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// statistics of a table for the query planner.
+// they are collected by Analyze and stored in the @stats table,
+// the numbers are exact when collected and drift with the updates.
+
+type TableStats struct {
+	Rows     int64
+	KeyBytes int64 // the total size of the keys
+	Bytes    int64 // the total size of the keys and values
+	// the number of distinct values of each prefix of the primary key
+	Distinct []int64
+	Indexes  []IndexStats
+}
+
+type IndexStats struct {
+	Name     string
+	KeyBytes int64
+	// the number of distinct values of each prefix of the indexed columns
+	Distinct []int64
+}
+
+var TSTATS_TABLE = &TableDef{
+	Name:  "@stats",
+	Types: []uint32{TYPE_STRING, TYPE_BYTES},
+	Cols:  []string{"name", "stats"},
+	PKeys: 1,
+}
+
+func sameValue(a, b Value) bool {
+	switch a.Type {
+	case TYPE_INT64:
+		return a.I64 == b.I64
+	case TYPE_FLOAT64:
+		return math.Float64bits(a.F64) == math.Float64bits(b.F64)
+	default:
+		return bytes.Equal(a.Str, b.Str)
+	}
+}
+
+// count the distinct prefixes of the sorted keys.
+// a new value in column i is a new value for all the longer prefixes.
+type prefixCounter struct {
+	prev     []Value
+	distinct []int64
+}
+
+func (pc *prefixCounter) add(vals []Value) {
+	i := 0
+	if pc.prev != nil {
+		for i < len(pc.distinct) && sameValue(pc.prev[i], vals[i]) {
+			i++
+		}
+	}
+	for ; i < len(pc.distinct); i++ {
+		pc.distinct[i]++
+	}
+	pc.prev = vals
+}
+
+// scan the table and its indexes, then save the statistics
+func (db *DB) Analyze(table string) (*TableStats, error) {
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := db.kv.Bucket(tdef.Name)
+	if err != nil {
+		return nil, err
+	}
+	stats := &TableStats{}
+	pc := prefixCounter{distinct: make([]int64, tdef.PKeys)}
+	for iter := bucket.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		vals := emptyRow(tdef)[:tdef.PKeys]
+		if err := decodeValues(key, vals); err != nil {
+			return nil, err
+		}
+		pc.add(vals)
+		stats.Rows++
+		stats.KeyBytes += int64(len(key))
+		stats.Bytes += int64(len(key) + len(val))
+	}
+	stats.Distinct = pc.distinct
+
+	for i := range tdef.Indexes {
+		idx := &tdef.Indexes[i]
+		ibucket, err := db.kv.Bucket(indexBucket(tdef, idx))
+		if err != nil {
+			return nil, err
+		}
+		istats := IndexStats{Name: idx.Name}
+		cols := indexKeyCols(tdef, idx)
+		pc := prefixCounter{distinct: make([]int64, len(idx.Cols))}
+		for iter := ibucket.Seek(nil); iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			vals := make([]Value, len(cols))
+			for j, col := range cols {
+				vals[j].Type = tdef.Types[colIndex(tdef, col)]
+			}
+			if err := decodeValues(key, vals); err != nil {
+				return nil, err
+			}
+			pc.add(vals)
+			istats.KeyBytes += int64(len(key))
+		}
+		istats.Distinct = pc.distinct
+		stats.Indexes = append(stats.Indexes, istats)
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	var tx TX
+	db.Begin(&tx)
+	if _, err := tx.kv.Bucket(TSTATS_TABLE.Name); err != nil {
+		_, err = tx.kv.CreateBucket(TSTATS_TABLE.Name)
+		if err != nil {
+			db.Abort(&tx)
+			return nil, err
+		}
+	}
+	rec := (&Record{}).AddString("name", tdef.Name).AddBytes("stats", data)
+	if _, err := dbUpdate(&tx.kv, TSTATS_TABLE, *rec, MODE_UPSERT); err != nil {
+		db.Abort(&tx)
+		return nil, err
+	}
+	return stats, db.Commit(&tx)
+}
+
+// the saved statistics, nil if the table is not analyzed
+func (db *DB) TableStats(table string) (*TableStats, error) {
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		return nil, err
+	}
+	rec := (&Record{}).AddString("name", tdef.Name)
+	ok, err := dbGet(db, TSTATS_TABLE, rec)
+	if err != nil || !ok {
+		return nil, err
+	}
+	stats := &TableStats{}
+	if err := json.Unmarshal(rec.Get("stats").Str, stats); err != nil {
+		return nil, fmt.Errorf("bad statistics %s: %w", table, err)
+	}
+	return stats, nil
+}
+
+// the statistics of an index, nil if it is not analyzed
+func (stats *TableStats) Index(name string) *IndexStats {
+	for i := range stats.Indexes {
+		if stats.Indexes[i].Name == name {
+			return &stats.Indexes[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package table
+
+import (
+	"build_your_own_db/b-tree"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// tables with typed columns on top of the KV.
+// the rows of a table are stored in a bucket with the table name,
+// the key is the encoded primary key and the value is the encoded
+// other columns. the table definitions are rows of the @table table.
+
+const (
+	TYPE_ERROR   = 0
+	TYPE_BYTES   = 1
+	TYPE_INT64   = 2
+	TYPE_STRING  = 3
+	TYPE_FLOAT64 = 4
+)
+
+// table cell
+type Value struct {
+	Type uint32
+	I64  int64
+	F64  float64
+	Str  []byte // bytes and strings
+}
+
+// table row
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+func (rec *Record) AddBytes(col string, val []byte) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+	return rec
+}
+
+func (rec *Record) AddString(col string, val string) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_STRING, Str: []byte(val)})
+	return rec
+}
+
+func (rec *Record) AddInt64(col string, val int64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+	return rec
+}
+
+func (rec *Record) AddFloat64(col string, val float64) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_FLOAT64, F64: val})
+	return rec
+}
+
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// table definition
+type TableDef struct {
+	Name  string
+	Types []uint32 // column types
+	Cols  []string // column names
+	PKeys int      // the first PKeys columns are the primary key
+	// secondary indexes, see index.go
+	Indexes []IndexDef
+}
+
+// the internal table of table definitions
+var TDEF_TABLE = &TableDef{
+	Name:  "@table",
+	Types: []uint32{TYPE_STRING, TYPE_BYTES},
+	Cols:  []string{"name", "def"},
+	PKeys: 1,
+}
+
+type DB struct {
+	Path string
+	// internals
+	kv     b_tree.KV
+	tables map[string]*TableDef // cached table definitions
+}
+
+func (db *DB) Open() error {
+	db.kv.Path = db.Path
+	db.tables = map[string]*TableDef{}
+	return db.kv.Open()
+}
+
+func (db *DB) Close() {
+	db.kv.Close()
+}
+
+// get the table definition by name
+func getTableDef(db *DB, name string) (*TableDef, error) {
+	if name == TDEF_TABLE.Name {
+		return TDEF_TABLE, nil
+	}
+	if tdef, ok := db.tables[name]; ok {
+		return tdef, nil
+	}
+	rec := (&Record{}).AddString("name", name)
+	ok, err := dbGet(db, TDEF_TABLE, rec)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("table not found: %s", name)
+	}
+	tdef := &TableDef{}
+	if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+		return nil, fmt.Errorf("bad table definition %s: %w", name, err)
+	}
+	db.tables[name] = tdef
+	return tdef, nil
+}
+
+func isIdent(name string) bool {
+	for i, ch := range name {
+		alpha := ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+		if !alpha && !(i > 0 && '0' <= ch && ch <= '9') {
+			return false
+		}
+	}
+	return len(name) > 0
+}
+
+func tableDefCheck(tdef *TableDef) error {
+	if !isIdent(tdef.Name) {
+		return fmt.Errorf("bad table name: %q", tdef.Name)
+	}
+	if len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types) {
+		return errors.New("bad columns")
+	}
+	if !(1 <= tdef.PKeys && tdef.PKeys <= len(tdef.Cols)) {
+		return errors.New("bad primary key")
+	}
+	seen := map[string]bool{}
+	for i, col := range tdef.Cols {
+		if !isIdent(col) || seen[col] {
+			return fmt.Errorf("bad column name: %q", col)
+		}
+		seen[col] = true
+		if !(TYPE_BYTES <= tdef.Types[i] && tdef.Types[i] <= TYPE_FLOAT64) {
+			return fmt.Errorf("bad column type: %s", col)
+		}
+	}
+	for i := range tdef.Indexes {
+		if err := indexDefCheck(tdef, &tdef.Indexes[i]); err != nil {
+			return err
+		}
+		if getIndexDef(tdef, tdef.Indexes[i].Name) != &tdef.Indexes[i] {
+			return fmt.Errorf("duplicate index: %s", tdef.Indexes[i].Name)
+		}
+	}
+	return nil
+}
+
+// create a new table
+func (db *DB) TableNew(tdef *TableDef) error {
+	if err := tableDefCheck(tdef); err != nil {
+		return err
+	}
+	def, err := json.Marshal(tdef)
+	if err != nil {
+		return err
+	}
+	var tx b_tree.KVTX
+	db.kv.Begin(&tx)
+	if _, err := tx.Bucket(TDEF_TABLE.Name); err != nil {
+		_, err = tx.CreateBucket(TDEF_TABLE.Name)
+		if err != nil {
+			db.kv.Abort(&tx)
+			return err
+		}
+	}
+	rec := (&Record{}).AddString("name", tdef.Name).AddBytes("def", def)
+	added, err := dbUpdate(&tx, TDEF_TABLE, *rec, MODE_INSERT_ONLY)
+	if err == nil && !added {
+		err = fmt.Errorf("table exists: %s", tdef.Name)
+	}
+	if err == nil {
+		_, err = tx.CreateBucket(tdef.Name)
+	}
+	for i := 0; err == nil && i < len(tdef.Indexes); i++ {
+		_, err = tx.CreateBucket(indexBucket(tdef, &tdef.Indexes[i]))
+	}
+	if err != nil {
+		db.kv.Abort(&tx)
+		return err
+	}
+	return db.kv.Commit(&tx)
+}
+
+// reorder the values of a record to the table column order.
+// n is the number of columns to check: tdef.PKeys or all of them.
+func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
+	if len(rec.Cols) != n || len(rec.Vals) != n {
+		return nil, fmt.Errorf("expect %d columns", n)
+	}
+	vals := make([]Value, n)
+	for i := 0; i < n; i++ {
+		v := rec.Get(tdef.Cols[i])
+		if v == nil {
+			return nil, fmt.Errorf("missing column: %s", tdef.Cols[i])
+		}
+		if v.Type != tdef.Types[i] {
+			return nil, fmt.Errorf("bad type for column: %s", tdef.Cols[i])
+		}
+		vals[i] = *v
+	}
+	return vals, nil
+}
+
+// an empty row with the column types set
+func emptyRow(tdef *TableDef) []Value {
+	vals := make([]Value, len(tdef.Cols))
+	for i := range vals {
+		vals[i].Type = tdef.Types[i]
+	}
+	return vals
+}
+
+// get a row by the primary key
+func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
+	vals, err := checkRecord(tdef, *rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	bucket, err := db.kv.Bucket(tdef.Name)
+	if err != nil {
+		return false, nil // no table yet
+	}
+	key := encodeValues(nil, vals)
+	val, ok := bucket.Get(key)
+	if !ok {
+		return false, nil
+	}
+	row, err := decodeRow(tdef, key, val)
+	if err != nil {
+		return false, err
+	}
+	rec.Cols = tdef.Cols
+	rec.Vals = row
+	return true, nil
+}
+
+// decode a row from the KV pair
+func decodeRow(tdef *TableDef, key []byte, val []byte) ([]Value, error) {
+	row := emptyRow(tdef)
+	if err := decodeValues(key, row[:tdef.PKeys]); err != nil {
+		return nil, err
+	}
+	if err := decodeValues(val, row[tdef.PKeys:]); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// get a row by the primary key, the other columns are filled
+func (db *DB) Get(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(db, table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(db, tdef, rec)
+}
+
+const (
+	MODE_UPSERT      = b_tree.MODE_UPSERT      // insert or replace
+	MODE_UPDATE_ONLY = b_tree.MODE_UPDATE_ONLY // update existing keys
+	MODE_INSERT_ONLY = b_tree.MODE_INSERT_ONLY // only add new keys
+)
+
+// add or replace a row in a transaction
+func dbUpdate(tx *b_tree.KVTX, tdef *TableDef, rec Record, mode int) (bool, error) {
+	vals, err := checkRecord(tdef, rec, len(tdef.Cols))
+	if err != nil {
+		return false, err
+	}
+	bucket, err := tx.Bucket(tdef.Name)
+	if err != nil {
+		return false, err
+	}
+	key := encodeValues(nil, vals[:tdef.PKeys])
+	val := encodeValues(nil, vals[tdef.PKeys:])
+	if len(key) > b_tree.BTREE_MAX_KEY_SIZE || len(val) > b_tree.BTREE_MAX_VAL_SIZE {
+		return false, errors.New("row too large")
+	}
+	old, exists := bucket.Get(key)
+	if (mode == MODE_INSERT_ONLY && exists) || (mode == MODE_UPDATE_ONLY && !exists) {
+		return false, nil
+	}
+	// maintain the indexes
+	if err := indexCheck(tx, tdef, vals); err != nil {
+		return false, err
+	}
+	if exists && len(tdef.Indexes) > 0 {
+		oldRow, err := decodeRow(tdef, key, old)
+		if err != nil {
+			return false, err
+		}
+		if err := indexUpdate(tx, tdef, oldRow, false); err != nil {
+			return false, err
+		}
+	}
+	if err := indexUpdate(tx, tdef, vals, true); err != nil {
+		return false, err
+	}
+	return true, bucket.Set(key, val)
+}
+
+// delete a row by the primary key in a transaction
+func dbDelete(tx *b_tree.KVTX, tdef *TableDef, rec Record) (bool, error) {
+	vals, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return false, err
+	}
+	bucket, err := tx.Bucket(tdef.Name)
+	if err != nil {
+		return false, err
+	}
+	key := encodeValues(nil, vals)
+	old, exists := bucket.Get(key)
+	if !exists {
+		return false, nil
+	}
+	if len(tdef.Indexes) > 0 {
+		row, err := decodeRow(tdef, key, old)
+		if err != nil {
+			return false, err
+		}
+		if err := indexUpdate(tx, tdef, row, false); err != nil {
+			return false, err
+		}
+	}
+	return bucket.Del(key)
+}
+
+// run a single update in its own transaction
+func (db *DB) update(table string, fn func(*TX) (bool, error)) (bool, error) {
+	var tx TX
+	db.Begin(&tx)
+	ok, err := fn(&tx)
+	if err != nil {
+		db.Abort(&tx)
+		return false, err
+	}
+	return ok, db.Commit(&tx)
+}
+
+func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
+	return db.update(table, func(tx *TX) (bool, error) {
+		return tx.Set(table, rec, mode)
+	})
+}
+
+func (db *DB) Insert(table string, rec Record) (bool, error) {
+	return db.Set(table, rec, MODE_INSERT_ONLY)
+}
+
+func (db *DB) Update(table string, rec Record) (bool, error) {
+	return db.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (db *DB) Upsert(table string, rec Record) (bool, error) {
+	return db.Set(table, rec, MODE_UPSERT)
+}
+
+func (db *DB) Delete(table string, rec Record) (bool, error) {
+	return db.update(table, func(tx *TX) (bool, error) {
+		return tx.Delete(table, rec)
+	})
+}
+
+// get a table definition
+func (db *DB) TableDef(name string) (*TableDef, error) {
+	return getTableDef(db, name)
+}
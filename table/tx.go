@@ -0,0 +1,61 @@
+package table
+
+import "build_your_own_db/b-tree"
+
+// a transaction over several rows and tables.
+// the reads see the updates of the transaction.
+type TX struct {
+	db *DB
+	kv b_tree.KVTX
+}
+
+func (db *DB) Begin(tx *TX) {
+	tx.db = db
+	db.kv.Begin(&tx.kv)
+}
+
+func (db *DB) Commit(tx *TX) error {
+	return db.kv.Commit(&tx.kv)
+}
+
+func (db *DB) Abort(tx *TX) {
+	db.kv.Abort(&tx.kv)
+	// the cached definitions may come from the aborted updates
+	db.tables = map[string]*TableDef{}
+}
+
+func (tx *TX) Get(table string, rec *Record) (bool, error) {
+	return tx.db.Get(table, rec)
+}
+
+func (tx *TX) Scan(table string, req *Scanner) error {
+	return tx.db.Scan(table, req)
+}
+
+func (tx *TX) Set(table string, rec Record, mode int) (bool, error) {
+	tdef, err := getTableDef(tx.db, table)
+	if err != nil {
+		return false, err
+	}
+	return dbUpdate(&tx.kv, tdef, rec, mode)
+}
+
+func (tx *TX) Insert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_INSERT_ONLY)
+}
+
+func (tx *TX) Update(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (tx *TX) Upsert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPSERT)
+}
+
+func (tx *TX) Delete(table string, rec Record) (bool, error) {
+	tdef, err := getTableDef(tx.db, table)
+	if err != nil {
+		return false, err
+	}
+	return dbDelete(&tx.kv, tdef, rec)
+}
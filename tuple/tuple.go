@@ -0,0 +1,230 @@
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// order-preserving encoding of typed tuples into B-tree keys.
+// the bytes.Compare order of the encoded tuples is the order of the
+// tuples, field by field, a shorter tuple first if it is a prefix.
+//
+// each field starts with a tag of its type, the types are ordered as:
+// null < false < true < int64 < float64 < []byte < string.
+// values of different types are not compared numerically.
+//   - int64: the sign bit is flipped, big-endian.
+//   - float64: the sign bit is flipped for positive numbers,
+//     all bits are flipped for negative numbers, big-endian.
+//     -0 is encoded as 0, all NaNs are the same and after +Inf.
+//   - []byte and string: 0x00 and 0x01 are escaped, terminated by 0x00,
+//     so that no encoded string is a prefix of another.
+//
+// a descending field is encoded with all its bytes flipped, including
+// the tag, so it can be decoded without knowing the directions.
+// no tag is 0x00 or 0xff in either direction, so a prefix is followed
+// by no key of the tuples that start with it.
+
+const (
+	TAG_NULL   = 0x01
+	TAG_FALSE  = 0x02
+	TAG_TRUE   = 0x03
+	TAG_INT64  = 0x04
+	TAG_FLOAT  = 0x05
+	TAG_BYTES  = 0x06
+	TAG_STRING = 0x07
+)
+
+// a tuple of nil, bool, int64, float64, []byte, string or Desc values.
+// int is also accepted and decoded as int64.
+type Tuple []interface{}
+
+// a field in the descending order
+type Desc struct {
+	V interface{}
+}
+
+var ErrBadEncoding = errors.New("bad tuple encoding")
+
+// encode a tuple as a key
+func Encode(t Tuple) ([]byte, error) {
+	return Append(nil, t)
+}
+
+// append the encoded tuple to a key
+func Append(out []byte, t Tuple) ([]byte, error) {
+	for _, v := range t {
+		desc := false
+		if d, ok := v.(Desc); ok {
+			desc, v = true, d.V
+		}
+		start := len(out)
+		var err error
+		if out, err = appendField(out, v); err != nil {
+			return nil, err
+		}
+		if desc {
+			for i := start; i < len(out); i++ {
+				out[i] = ^out[i]
+			}
+		}
+	}
+	return out, nil
+}
+
+func appendUint64(out []byte, tag byte, u uint64) []byte {
+	var buf [9]byte
+	buf[0] = tag
+	binary.BigEndian.PutUint64(buf[1:], u)
+	return append(out, buf[:]...)
+}
+
+func appendEscaped(out []byte, tag byte, in []byte) []byte {
+	out = append(out, tag)
+	for _, ch := range in {
+		if ch <= 1 {
+			out = append(out, 0x01, ch+1)
+		} else {
+			out = append(out, ch)
+		}
+	}
+	return append(out, 0)
+}
+
+func appendField(out []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(out, TAG_NULL), nil
+	case bool:
+		if v {
+			return append(out, TAG_TRUE), nil
+		}
+		return append(out, TAG_FALSE), nil
+	case int:
+		return appendUint64(out, TAG_INT64, uint64(v)^(1<<63)), nil
+	case int64:
+		return appendUint64(out, TAG_INT64, uint64(v)^(1<<63)), nil
+	case float64:
+		if v == 0 {
+			v = 0 // -0
+		}
+		bits := math.Float64bits(v)
+		if math.IsNaN(v) {
+			bits = math.Float64bits(math.NaN())
+		}
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		return appendUint64(out, TAG_FLOAT, bits), nil
+	case []byte:
+		return appendEscaped(out, TAG_BYTES, v), nil
+	case string:
+		return appendEscaped(out, TAG_STRING, []byte(v)), nil
+	case Desc:
+		return nil, fmt.Errorf("nested Desc")
+	default:
+		return nil, fmt.Errorf("unsupported tuple field type: %T", v)
+	}
+}
+
+// decode a key. the descending fields are returned as Desc.
+func Decode(key []byte) (Tuple, error) {
+	t := Tuple{}
+	for len(key) > 0 {
+		var mask byte
+		if key[0] >= 0x80 {
+			mask = 0xff // descending
+		}
+		v, n, err := decodeField(key, mask)
+		if err != nil {
+			return nil, err
+		}
+		if mask != 0 {
+			v = Desc{V: v}
+		}
+		t = append(t, v)
+		key = key[n:]
+	}
+	return t, nil
+}
+
+// decode the field at the start of the input, the bytes are XORed with
+// the mask. returns the value and its encoded length.
+func decodeField(in []byte, mask byte) (interface{}, int, error) {
+	switch in[0] ^ mask {
+	case TAG_NULL:
+		return nil, 1, nil
+	case TAG_FALSE:
+		return false, 1, nil
+	case TAG_TRUE:
+		return true, 1, nil
+	case TAG_INT64, TAG_FLOAT:
+		if len(in) < 9 {
+			return nil, 0, ErrBadEncoding
+		}
+		var buf [8]byte
+		for i := range buf {
+			buf[i] = in[1+i] ^ mask
+		}
+		bits := binary.BigEndian.Uint64(buf[:])
+		if in[0]^mask == TAG_INT64 {
+			return int64(bits ^ (1 << 63)), 9, nil
+		}
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), 9, nil
+	case TAG_BYTES, TAG_STRING:
+		str := []byte{}
+		for i := 1; ; i++ {
+			if i >= len(in) {
+				return nil, 0, ErrBadEncoding
+			}
+			ch := in[i] ^ mask
+			if ch == 0 {
+				if in[0]^mask == TAG_STRING {
+					return string(str), i + 1, nil
+				}
+				return str, i + 1, nil
+			}
+			if ch == 1 {
+				if i++; i >= len(in) {
+					return nil, 0, ErrBadEncoding
+				}
+				ch = (in[i] ^ mask) - 1
+				if ch > 1 {
+					return nil, 0, ErrBadEncoding
+				}
+			}
+			str = append(str, ch)
+		}
+	default:
+		return nil, 0, ErrBadEncoding
+	}
+}
+
+// the range [start, end) of the keys of the tuples that start with the
+// prefix, the prefix itself included. an empty prefix is every key.
+func PrefixRange(prefix Tuple) (start []byte, end []byte, err error) {
+	start, err = Encode(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	end = append(append([]byte(nil), start...), 0xff)
+	return start, end, nil
+}
+
+// the first key after the tuples that start with the prefix,
+// for an exclusive lower bound on a prefix.
+func After(prefix Tuple) ([]byte, error) {
+	key, err := Encode(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return append(key, 0xff), nil
+}
@@ -0,0 +1,357 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func mustEncode(t *testing.T, tup Tuple) []byte {
+	t.Helper()
+	key, err := Encode(tup)
+	if err != nil {
+		t.Fatalf("%v: %v", tup, err)
+	}
+	return key
+}
+
+// the order of the types
+func typeRank(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 2
+		}
+		return 1
+	case int64:
+		return 3
+	case float64:
+		return 4
+	case []byte:
+		return 5
+	case string:
+		return 6
+	}
+	panic("unreachable")
+}
+
+// the order of the fields without the encoding, NaN is after +Inf
+func compareField(a interface{}, b interface{}) int {
+	desc := false
+	if d, ok := a.(Desc); ok {
+		desc, a, b = true, d.V, b.(Desc).V
+	}
+	r := typeRank(a) - typeRank(b)
+	if r == 0 {
+		switch a := a.(type) {
+		case int64:
+			if a < b.(int64) {
+				r = -1
+			} else if a > b.(int64) {
+				r = 1
+			}
+		case float64:
+			r = compareNum(a, b.(float64))
+		case []byte:
+			r = bytes.Compare(a, b.([]byte))
+		case string:
+			r = bytes.Compare([]byte(a), []byte(b.(string)))
+		}
+	}
+	if desc {
+		r = -r
+	}
+	return r
+}
+
+func compareNum(a float64, b float64) int {
+	switch {
+	case math.IsNaN(a) && math.IsNaN(b):
+		return 0
+	case math.IsNaN(a) || (!math.IsNaN(b) && a > b):
+		return 1
+	case math.IsNaN(b) || a < b:
+		return -1
+	}
+	return 0
+}
+
+func compareTuples(a Tuple, b Tuple) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if r := compareField(a[i], b[i]); r != 0 {
+			return r
+		}
+	}
+	return len(a) - len(b)
+}
+
+func sign(r int) int {
+	if r < 0 {
+		return -1
+	} else if r > 0 {
+		return 1
+	}
+	return 0
+}
+
+func TestOrder(t *testing.T) {
+	ordered := []Tuple{
+		{},
+		{nil},
+		{nil, nil},
+		{false},
+		{true},
+		{int64(math.MinInt64)},
+		{int64(-1)},
+		{0},
+		{int64(0), nil},
+		{int64(0), "a"},
+		{int64(1)},
+		{int64(math.MaxInt64)},
+		{math.Inf(-1)},
+		{-math.MaxFloat64},
+		{-1.5},
+		{-math.SmallestNonzeroFloat64},
+		{math.Copysign(0, -1)},
+		{math.SmallestNonzeroFloat64},
+		{1.5},
+		{math.MaxFloat64},
+		{math.Inf(1)},
+		{math.NaN()},
+		{[]byte{}},
+		{[]byte{0}},
+		{[]byte{0, 0}},
+		{[]byte{0, 1}},
+		{[]byte{0, 2}},
+		{[]byte{1}},
+		{[]byte{1, 0}},
+		{[]byte{2}},
+		{[]byte{0xff}},
+		{""},
+		{"", ""},
+		{"\x00"},
+		{"\x00\x01"},
+		{"\x01"},
+		{"a"},
+		{"a", nil},
+		{"a", int64(1)},
+		{"a\x00"},
+		{"a\x00", "b"},
+		{"a\x01"},
+		{"ab"},
+		{"b"},
+		{"\xff"},
+	}
+	for i := range ordered {
+		key := mustEncode(t, ordered[i])
+		if i > 0 {
+			prev := mustEncode(t, ordered[i-1])
+			if bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("%v is not before %v: %x %x", ordered[i-1], ordered[i], prev, key)
+			}
+		}
+		// descending, except for the prefixes that are still first
+		if i > 0 && len(ordered[i-1]) == 1 && len(ordered[i]) == 1 {
+			a := mustEncode(t, Tuple{Desc{ordered[i-1][0]}})
+			b := mustEncode(t, Tuple{Desc{ordered[i][0]}})
+			if bytes.Compare(a, b) <= 0 {
+				t.Fatalf("descending %v is not after %v", ordered[i-1], ordered[i])
+			}
+		}
+	}
+}
+
+func TestFloatEncoding(t *testing.T) {
+	zero := mustEncode(t, Tuple{0.0})
+	if got := mustEncode(t, Tuple{math.Copysign(0, -1)}); !bytes.Equal(got, zero) {
+		t.Fatalf("-0 is %x, 0 is %x", got, zero)
+	}
+	out, err := Decode(zero)
+	if err != nil || out[0].(float64) != 0 || math.Signbit(out[0].(float64)) {
+		t.Fatalf("decoded 0 as %v %v", out, err)
+	}
+	nan := mustEncode(t, Tuple{math.NaN()})
+	for _, bits := range []uint64{0x7ff0000000000001, 0x7fffffffffffffff, 0xfff8000000000000, 0xffffffffffffffff} {
+		if got := mustEncode(t, Tuple{math.Float64frombits(bits)}); !bytes.Equal(got, nan) {
+			t.Fatalf("NaN %x is %x, not %x", bits, got, nan)
+		}
+	}
+	if out, err := Decode(nan); err != nil || !math.IsNaN(out[0].(float64)) {
+		t.Fatalf("decoded NaN as %v %v", out, err)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	cases := []struct {
+		in  string
+		out []byte
+	}{
+		{"", []byte{TAG_STRING, 0}},
+		{"a", []byte{TAG_STRING, 'a', 0}},
+		{"\x00", []byte{TAG_STRING, 1, 1, 0}},
+		{"\x01", []byte{TAG_STRING, 1, 2, 0}},
+		{"a\x00\x01\x02", []byte{TAG_STRING, 'a', 1, 1, 1, 2, 2, 0}},
+	}
+	for _, c := range cases {
+		key := mustEncode(t, Tuple{c.in})
+		if !bytes.Equal(key, c.out) {
+			t.Fatalf("%q is %x, want %x", c.in, key, c.out)
+		}
+		// no 0x00 before the end
+		if i := bytes.IndexByte(key, 0); i != len(key)-1 {
+			t.Fatalf("%q: 0x00 at %d of %x", c.in, i, key)
+		}
+		key = mustEncode(t, Tuple{Desc{[]byte(c.in)}})
+		if i := bytes.IndexByte(key, 0xff); i != len(key)-1 {
+			t.Fatalf("descending %q: 0xff at %d of %x", c.in, i, key)
+		}
+	}
+	bad := [][]byte{
+		{0},
+		{0xff},
+		{0x08},
+		{TAG_INT64, 1, 2},
+		{TAG_FLOAT},
+		{TAG_STRING, 'a'},
+		{TAG_STRING, 1},
+		{TAG_STRING, 1, 3, 0},
+		{TAG_BYTES, 1, 0, 0},
+		{^byte(TAG_STRING), ^byte('a')},
+		{TAG_NULL, TAG_INT64},
+	}
+	for _, key := range bad {
+		if out, err := Decode(key); err != ErrBadEncoding {
+			t.Fatalf("%x is decoded as %v", key, out)
+		}
+	}
+	for _, tup := range []Tuple{{int32(1)}, {uint64(1)}, {Desc{Desc{1}}}, {"a", struct{}{}}} {
+		if _, err := Encode(tup); err == nil {
+			t.Fatalf("%v is encoded", tup)
+		}
+	}
+}
+
+// random tuples, the directions of the fields are the same for all
+func randomTuples(rng *rand.Rand, n int, desc []bool) []Tuple {
+	ints := []int64{math.MinInt64, -1000, -1, 0, 1, 2, 1000, math.MaxInt64}
+	floats := []float64{math.Inf(-1), -1e300, -1, -1e-300, 0, 1e-300, 0.5, 1, 1e300, math.Inf(1), math.NaN()}
+	alphabet := []byte{0, 1, 2, 'a', 0xfe, 0xff}
+	str := func() []byte {
+		s := []byte{}
+		for i := rng.Intn(4); i > 0; i-- {
+			s = append(s, alphabet[rng.Intn(len(alphabet))])
+		}
+		return s
+	}
+	out := []Tuple{}
+	for i := 0; i < n; i++ {
+		tup := Tuple{}
+		for j := rng.Intn(len(desc) + 1); j > 0; j-- {
+			var v interface{}
+			switch rng.Intn(7) {
+			case 0:
+				v = nil
+			case 1:
+				v = rng.Intn(2) == 0
+			case 2:
+				v = ints[rng.Intn(len(ints))]
+			case 3:
+				v = floats[rng.Intn(len(floats))]
+			case 4:
+				v = str()
+			default:
+				v = string(str())
+			}
+			if desc[len(tup)] {
+				v = Desc{v}
+			}
+			tup = append(tup, v)
+		}
+		out = append(out, tup)
+	}
+	return out
+}
+
+// the decoded tuple is the same as the encoded one
+func sameTuple(a Tuple, b Tuple) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if reflect.TypeOf(a[i]) != reflect.TypeOf(b[i]) || compareField(a[i], b[i]) != 0 {
+			return false
+		}
+		if d, ok := a[i].(Desc); ok && reflect.TypeOf(d.V) != reflect.TypeOf(b[i].(Desc).V) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, desc := range [][]bool{{false, false, false}, {true, true, true}, {false, true, false}, {true, false, true}} {
+		tuples := randomTuples(rng, 300, desc)
+		keys := make([][]byte, len(tuples))
+		for i, tup := range tuples {
+			keys[i] = mustEncode(t, tup)
+			out, err := Decode(keys[i])
+			if err != nil || !sameTuple(out, tup) {
+				t.Fatalf("%v is decoded as %v %v", tup, out, err)
+			}
+		}
+		for i := range tuples {
+			for j := range tuples {
+				want := sign(compareTuples(tuples[i], tuples[j]))
+				if got := bytes.Compare(keys[i], keys[j]); got != want {
+					t.Fatalf("%v vs %v: %d, want %d", tuples[i], tuples[j], got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for _, desc := range [][]bool{{false, false, false}, {true, false, true}} {
+		tuples := randomTuples(rng, 300, desc)
+		// the prefixes of the tuples and some random ones
+		prefixes := randomTuples(rng, 50, desc)
+		for _, tup := range tuples[:50] {
+			prefixes = append(prefixes, tup[:rng.Intn(len(tup)+1)])
+		}
+		for _, prefix := range prefixes {
+			start, end, err := PrefixRange(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := After(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tup := range tuples {
+				key := mustEncode(t, tup)
+				has := len(tup) >= len(prefix) && compareTuples(tup[:len(prefix)], prefix) == 0
+				in := bytes.Compare(start, key) <= 0 && bytes.Compare(key, end) < 0
+				if has != in {
+					t.Fatalf("%v in the range of %v: %v", tup, prefix, in)
+				}
+				// After is the end of the range for the keys past the prefix
+				if has && bytes.Compare(key, after) >= 0 {
+					t.Fatalf("%v is after %v", tup, prefix)
+				}
+				if !has && compareTuples(tup, prefix) > 0 && bytes.Compare(key, after) < 0 {
+					t.Fatalf("%v is not after %v", tup, prefix)
+				}
+			}
+		}
+	}
+	start, end, err := PrefixRange(nil)
+	if err != nil || len(start) != 0 || !bytes.Equal(end, []byte{0xff}) {
+		t.Fatalf("the range of every key: %x %x %v", start, end, err)
+	}
+}